@@ -9,33 +9,99 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"google.golang.org/grpc/credentials/insecure"
-
 	uuid "github.com/gofrs/uuid/v5"
 	"github.com/spf13/viper"
 	"github.com/topfreegames/eventsgateway/v4/logger"
 	"github.com/topfreegames/eventsgateway/v4/metrics"
 	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// retryAfterMetadata is the trailer of rate limited requests with how many seconds to
+// wait before retrying, it must match app.RetryAfterMetadata at server/app/ratelimit.go
+const retryAfterMetadata = "retry-after"
+
+// rejectedIndexesMetadata is the trailer of SendEvents responses with the indexes of the
+// events the server rejected for good, it must match server/app.RejectedIndexesMetadata
+const rejectedIndexesMetadata = "rejected-indexes"
+
+// rateLimitedError is a ResourceExhausted error with the wait the server asked for
+type rateLimitedError struct {
+	error
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Unwrap() error {
+	return e.error
+}
+
+// GRPCStatus keeps the status of the wrapped error
+func (e *rateLimitedError) GRPCStatus() *status.Status {
+	return status.Convert(e.error)
+}
+
+const (
+	// OverflowPolicyBlock blocks Send until there's room in the events buffer
+	OverflowPolicyBlock = "block"
+	// OverflowPolicyBlockWithTimeout blocks Send until there's room in the events buffer,
+	// client.overflowTimeout elapses or the caller's context is done
+	OverflowPolicyBlockWithTimeout = "block-with-timeout"
+	// OverflowPolicyDropNewest discards the event being sent if the events buffer is full
+	OverflowPolicyDropNewest = "drop-newest"
+	// OverflowPolicyDropOldest discards the oldest buffered event to make room for the one being sent
+	OverflowPolicyDropOldest = "drop-oldest"
 )
 
+// ErrBufferFull is returned by Send when the async client events buffer is full
+// and the overflow policy discards the event
+var ErrBufferFull = errors.New("events buffer is full")
+
+// ErrClientClosed is returned by Send after the client is shut down
+var ErrClientClosed = errors.New("client is shut down")
+
 type gRPCClientAsync struct {
-	client         pb.GRPCForwarderClient
-	config         *viper.Viper
-	conn           *grpc.ClientConn
-	eventsChannel  chan *pb.Event
-	lingerInterval time.Duration
-	batchSize      int
-	logger         logger.Logger
-	maxRetries     int
-	retryInterval  time.Duration
-	timeout        time.Duration
-	wg             sync.WaitGroup
+	client          pb.GRPCForwarderClient
+	config          *viper.Viper
+	conn            *grpc.ClientConn
+	eventsChannel   chan *pb.Event
+	stopChannel     chan struct{}
+	stopMutex       sync.RWMutex
+	stopped         bool
+	pending         atomic.Int64
+	delivered       atomic.Int64
+	rejected        atomic.Int64
+	spooled         atomic.Int64
+	dropped         atomic.Int64
+	lingerInterval  time.Duration
+	batchSize       int
+	logger          logger.Logger
+	maxRetries      int
+	numRoutines     int
+	onDelivery      DeliveryCallback
+	overflowPolicy  string
+	overflowTimeout time.Duration
+	retryInterval   time.Duration
+	spool           *spool
+	replayChannel   chan struct{}
+	replayWg        sync.WaitGroup
+	abortCtx        context.Context // canceled when the Shutdown ctx is done, stopping requests and retries
+	abort           context.CancelFunc
+	timeout         time.Duration
+	wg              sync.WaitGroup
 }
 
 func newGRPCClientAsync(
@@ -45,6 +111,23 @@ func newGRPCClientAsync(
 	serverAddress string,
 	client pb.GRPCForwarderClient,
 	opts ...grpc.DialOption,
+) (*gRPCClientAsync, error) {
+	a, err := buildGRPCClientAsync(configPrefix, config, logger, serverAddress, client, opts...)
+	if err != nil {
+		return nil, err
+	}
+	a.start()
+	return a, nil
+}
+
+// buildGRPCClientAsync configures an async client without starting its routines
+func buildGRPCClientAsync(
+	configPrefix string,
+	config *viper.Viper,
+	logger logger.Logger,
+	serverAddress string,
+	client pb.GRPCForwarderClient,
+	opts ...grpc.DialOption,
 ) (*gRPCClientAsync, error) {
 	a := &gRPCClientAsync{
 		config: config,
@@ -63,6 +146,21 @@ func newGRPCClientAsync(
 	a.config.SetDefault(channelBufferConf, 500)
 	channelBuffer := a.config.GetInt(channelBufferConf)
 	a.eventsChannel = make(chan *pb.Event, channelBuffer)
+	a.stopChannel = make(chan struct{})
+	a.abortCtx, a.abort = context.WithCancel(context.Background())
+
+	overflowPolicyConf := fmt.Sprintf("%sclient.overflowPolicy", configPrefix)
+	a.config.SetDefault(overflowPolicyConf, OverflowPolicyBlock)
+	a.overflowPolicy = a.config.GetString(overflowPolicyConf)
+	switch a.overflowPolicy {
+	case OverflowPolicyBlock, OverflowPolicyBlockWithTimeout, OverflowPolicyDropNewest, OverflowPolicyDropOldest:
+	default:
+		return nil, fmt.Errorf("invalid overflow policy %q informed at %s", a.overflowPolicy, overflowPolicyConf)
+	}
+
+	overflowTimeoutConf := fmt.Sprintf("%sclient.overflowTimeout", configPrefix)
+	a.config.SetDefault(overflowTimeoutConf, 500*time.Millisecond)
+	a.overflowTimeout = a.config.GetDuration(overflowTimeoutConf)
 
 	maxRetriesConf := fmt.Sprintf("%sclient.maxRetries", configPrefix)
 	a.config.SetDefault(maxRetriesConf, 3)
@@ -80,26 +178,72 @@ func newGRPCClientAsync(
 		"lingerInterval": a.lingerInterval,
 		"batchSize":      a.batchSize,
 		"channelBuffer":  channelBuffer,
+		"overflowPolicy": a.overflowPolicy,
 		"timeout":        a.timeout,
 	})
 
+	if err := a.configureSpool(configPrefix); err != nil {
+		return nil, err
+	}
+
 	if err := a.configureGRPCForwarderClient(serverAddress, client, opts...); err != nil {
 		return nil, err
 	}
 
 	numRoutinesConf := fmt.Sprintf("%sclient.numRoutines", configPrefix)
 	a.config.SetDefault(numRoutinesConf, 5)
-	numSendRoutines := a.config.GetInt(numRoutinesConf)
+	a.numRoutines = a.config.GetInt(numRoutinesConf)
 
 	a.logger = a.logger.WithFields(map[string]interface{}{
-		"numRoutines": numSendRoutines,
+		"numRoutines": a.numRoutines,
 	})
 
-	for i := 0; i < numSendRoutines; i++ {
+	return a, nil
+}
+
+// start launches the routines that batch and send events
+func (a *gRPCClientAsync) start() {
+	for i := 0; i < a.numRoutines; i++ {
 		go a.sendRoutine()
 	}
 
-	return a, nil
+	if a.spool != nil {
+		a.replayWg.Add(1)
+		go a.replayRoutine()
+		a.triggerReplay()
+	}
+}
+
+func (a *gRPCClientAsync) configureSpool(configPrefix string) error {
+	spoolEnabledConf := fmt.Sprintf("%sclient.spool.enabled", configPrefix)
+	a.config.SetDefault(spoolEnabledConf, false)
+	if !a.config.GetBool(spoolEnabledConf) {
+		return nil
+	}
+
+	spoolDirectoryConf := fmt.Sprintf("%sclient.spool.directory", configPrefix)
+	a.config.SetDefault(spoolDirectoryConf, filepath.Join(os.TempDir(), "eventsgateway-spool"))
+	spoolDirectory := a.config.GetString(spoolDirectoryConf)
+
+	spoolMaxBytesConf := fmt.Sprintf("%sclient.spool.maxBytes", configPrefix)
+	a.config.SetDefault(spoolMaxBytesConf, 100*1024*1024)
+	spoolMaxBytes := a.config.GetInt64(spoolMaxBytesConf)
+
+	spoolSegmentBytesConf := fmt.Sprintf("%sclient.spool.segmentBytes", configPrefix)
+	a.config.SetDefault(spoolSegmentBytesConf, 10*1024*1024)
+	spoolSegmentBytes := a.config.GetInt64(spoolSegmentBytesConf)
+
+	a.logger = a.logger.WithFields(map[string]interface{}{
+		"spoolDirectory": spoolDirectory,
+	})
+
+	s, err := newSpool(spoolDirectory, spoolMaxBytes, spoolSegmentBytes, a.logger)
+	if err != nil {
+		return err
+	}
+	a.spool = s
+	a.replayChannel = make(chan struct{}, 1)
+	return nil
 }
 
 func (a *gRPCClientAsync) configureGRPCForwarderClient(
@@ -116,9 +260,9 @@ func (a *gRPCClientAsync) configureGRPCForwarderClient(
 	}).Info("connecting to grpc server")
 	dialOpts := append(
 		[]grpc.DialOption{
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
 			grpc.WithChainUnaryInterceptor(
 				a.metricsReporterInterceptor,
+				retryAfterInterceptor,
 			),
 		},
 		opts...,
@@ -151,7 +295,8 @@ func (a *gRPCClientAsync) metricsReporterInterceptor(
 	retry := fmt.Sprintf("%d", req.(*pb.SendEventsRequest).Retry)
 	startTime := time.Now()
 
-	err := invoker(ctx, method, req, reply, cc, opts...)
+	var trailer metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
 
 	if err != nil {
 		l.WithError(err).Error("error processing request")
@@ -179,17 +324,129 @@ func (a *gRPCClientAsync) metricsReporterInterceptor(
 			topicName,
 			"failed").Add(float64(len(failureIndexes)))
 	}
+	rejected := len(rejectedIndexes(trailer))
+	if rejected > 0 {
+		metrics.AsyncClientEventsCounter.WithLabelValues(
+			topicName,
+			"rejected").Add(float64(rejected))
+	}
 	metrics.AsyncClientEventsCounter.WithLabelValues(
 		topicName,
-		"ok").Add(float64(len(events) - len(failureIndexes)))
+		"ok").Add(float64(len(events) - len(failureIndexes) - rejected))
 
 	return nil
 }
 
+// retryAfterInterceptor returns the ResourceExhausted errors of rate limited requests
+// as a rateLimitedError with the wait of their retry-after trailer
+func retryAfterInterceptor(
+	ctx context.Context,
+	method string,
+	req interface{},
+	reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	var trailer metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+	return withRetryAfter(err, trailer)
+}
+
+// withRetryAfter returns err as a rateLimitedError if it's a ResourceExhausted error
+// and trailer has a valid retry-after
+func withRetryAfter(err error, trailer metadata.MD) error {
+	if status.Code(err) != codes.ResourceExhausted {
+		return err
+	}
+	values := trailer.Get(retryAfterMetadata)
+	if len(values) == 0 {
+		return err
+	}
+	seconds, parseErr := strconv.ParseFloat(values[0], 64)
+	if parseErr != nil || seconds < 0 {
+		return err
+	}
+	return &rateLimitedError{error: err, retryAfter: time.Duration(seconds * float64(time.Second))}
+}
+
+// rejectedIndexes returns the indexes of the rejectedIndexesMetadata trailer
+func rejectedIndexes(trailer metadata.MD) map[int64]bool {
+	rejected := map[int64]bool{}
+	for _, value := range trailer.Get(rejectedIndexesMetadata) {
+		for _, index := range strings.Split(value, ",") {
+			if i, err := strconv.ParseInt(index, 10, 64); err == nil {
+				rejected[i] = true
+			}
+		}
+	}
+	return rejected
+}
+
 func (a *gRPCClientAsync) send(ctx context.Context, event *pb.Event) error {
+	a.stopMutex.RLock()
+	defer a.stopMutex.RUnlock()
+	if a.stopped {
+		return ErrClientClosed
+	}
+
 	a.wg.Add(1)
-	a.eventsChannel <- event
-	return nil
+	a.pending.Add(1)
+	select {
+	case a.eventsChannel <- event:
+		return nil
+	default:
+	}
+
+	switch a.overflowPolicy {
+	case OverflowPolicyBlockWithTimeout:
+		timer := time.NewTimer(a.overflowTimeout)
+		defer timer.Stop()
+		select {
+		case a.eventsChannel <- event:
+			return nil
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+	case OverflowPolicyDropNewest:
+	case OverflowPolicyDropOldest:
+		for {
+			select {
+			case oldest := <-a.eventsChannel:
+				a.dropOverflow(oldest)
+			default:
+			}
+			select {
+			case a.eventsChannel <- event:
+				return nil
+			default:
+			}
+		}
+	default:
+		a.eventsChannel <- event
+		return nil
+	}
+
+	a.dropOverflow(event)
+	return ErrBufferFull
+}
+
+// dropOverflow discards an event that didn't fit in the events buffer
+func (a *gRPCClientAsync) dropOverflow(event *pb.Event) {
+	a.logger.WithFields(map[string]interface{}{
+		"operation": "send",
+		"eventId":   event.Id,
+	}).Warn("dropped event due to full events buffer")
+	metrics.AsyncClientEventsCounter.WithLabelValues(
+		event.Topic,
+		"dropped_overflow",
+	).Inc()
+	a.deliver(event, &DeliveryError{
+		Reason: DeliveryReasonOverflow,
+		Err:    ErrBufferFull,
+	})
+	a.pending.Add(-1)
+	a.wg.Done()
 }
 
 func (a *gRPCClientAsync) sendRoutine() {
@@ -205,31 +462,50 @@ func (a *gRPCClientAsync) sendRoutine() {
 		cpy.Id = uuidV4.String()
 		req = &pb.SendEventsRequest{}
 		req.Events = make([]*pb.Event, 0, a.batchSize)
-		go a.sendEvents(cpy, 0)
+		go a.sendEvents(cpy, 0, nil)
+	}
+
+	add := func(e *pb.Event) {
+		metrics.AsyncClientEventsBufferSize.WithLabelValues(
+			e.Topic).Set(float64(len(a.eventsChannel)))
+		if len(req.Events) == 0 {
+			a.wg.Add(1)
+		}
+		a.wg.Done()
+		req.Events = append(req.Events, e)
+		if len(req.Events) == a.batchSize {
+			send()
+		}
 	}
 
 	for {
 		select {
 		case e := <-a.eventsChannel:
-			metrics.AsyncClientEventsBufferSize.WithLabelValues(
-				e.Topic).Set(float64(len(a.eventsChannel)))
-			if len(req.Events) == 0 {
-				a.wg.Add(1)
-			}
-			a.wg.Done()
-			req.Events = append(req.Events, e)
-			if len(req.Events) == a.batchSize {
-				send()
-			}
+			add(e)
 		case <-ticker.C:
 			if len(req.Events) > 0 {
 				send()
 			}
+		case <-a.stopChannel:
+			// no events are sent after stopChannel is closed, so draining
+			// the buffer and flushing the partial batch is enough
+			for {
+				select {
+				case e := <-a.eventsChannel:
+					add(e)
+				default:
+					if len(req.Events) > 0 {
+						send()
+					}
+					return
+				}
+			}
 		}
 	}
 }
 
-func (a *gRPCClientAsync) sendEvents(req *pb.SendEventsRequest, retryCount int) {
+// sendEvents sends a batch, retrying it up to maxRetries; lastErr is why the previous attempt failed
+func (a *gRPCClientAsync) sendEvents(req *pb.SendEventsRequest, retryCount int, lastErr error) {
 	l := a.logger.WithFields(map[string]interface{}{
 		"operation":  "sendEvents",
 		"requestId":  req.Id,
@@ -237,49 +513,305 @@ func (a *gRPCClientAsync) sendEvents(req *pb.SendEventsRequest, retryCount int)
 		"size":       len(req.Events),
 	})
 	l.Debug("sending events")
-	topicName := req.Events[0].Topic
 	if retryCount > a.maxRetries {
-		l.Info("dropped events due to max retries")
-		metrics.AsyncClientEventsCounter.WithLabelValues(
-			topicName,
-			"dropped",
-		).Add(float64(len(req.Events)))
+		a.spoolOrDrop(l, req, retryCount-1, lastErr)
+		a.wg.Done()
+		return
+	}
+	if a.abortCtx.Err() != nil {
+		a.spoolOrDrop(l, req, max(retryCount-1, 0), ErrClientClosed)
 		a.wg.Done()
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	ctx, cancel := context.WithTimeout(a.abortCtx, a.timeout)
 	defer cancel()
 	// in case server's producer fail to send any event, failure indexes are sent
 	// in response to be retried
 	req.Retry = int64(retryCount)
-	res, err := a.client.SendEvents(ctx, req)
+	var trailer metadata.MD
+	res, err := a.client.SendEvents(ctx, req, grpc.Trailer(&trailer))
 	if ctx.Err() != nil {
 		err = ctx.Err()
 	}
 	if err != nil {
 		l.WithError(err).Error("failed to send events")
-		time.Sleep(time.Duration(math.Pow(2, float64(retryCount))) * a.retryInterval)
-		a.sendEvents(req, retryCount+1)
+		a.sleep(a.backoff(retryCount, err))
+		a.sendEvents(req, retryCount+1, err)
 		return
 	}
+	// events rejected for good aren't in the FailureIndexes, so they aren't retried
+	succeeded, rejected := a.deliverResponse(req.Events, res, rejectedIndexes(trailer), retryCount)
+	a.pending.Add(-int64(succeeded + rejected))
+	a.delivered.Add(int64(succeeded))
+	a.rejected.Add(int64(rejected))
 	if res != nil && len(res.FailureIndexes) != 0 {
 		l.WithFields(map[string]interface{}{
 			"failureIndexes": res.FailureIndexes,
 		}).Error("failed to send failedEvents")
-		time.Sleep(time.Duration(math.Pow(2, float64(retryCount))) * a.retryInterval)
+		a.sleep(a.backoff(retryCount, nil))
 		failedEvents := make([]*pb.Event, 0, len(res.FailureIndexes))
 		for _, index := range res.FailureIndexes {
 			failedEvents = append(failedEvents, req.Events[index])
 		}
 		req.Events = failedEvents
-		a.sendEvents(req, retryCount+1)
+		a.sendEvents(req, retryCount+1, ErrServerFailure)
 		return
 	}
+	a.triggerReplay()
 	a.wg.Done()
 }
 
+// backoff returns how long to wait before retrying a batch that failed retryCount
+// times, waiting at least as long as the server asked if it was rate limited
+func (a *gRPCClientAsync) backoff(retryCount int, err error) time.Duration {
+	backoff := time.Duration(math.Pow(2, float64(retryCount))) * a.retryInterval
+	var rateLimited *rateLimitedError
+	if errors.As(err, &rateLimited) && rateLimited.retryAfter > backoff {
+		return rateLimited.retryAfter
+	}
+	return backoff
+}
+
+// sleep waits for d, returning early if the client is aborting its retries
+func (a *gRPCClientAsync) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-a.abortCtx.Done():
+	}
+}
+
+// spoolOrDrop persists a batch that exhausted its retries, dropping it if there's
+// no spool configured or it's full
+func (a *gRPCClientAsync) spoolOrDrop(
+	l logger.Logger,
+	req *pb.SendEventsRequest,
+	retries int,
+	lastErr error,
+) {
+	topicName := req.Events[0].Topic
+	a.pending.Add(-int64(len(req.Events)))
+	if a.spool != nil {
+		err := a.spool.write(req)
+		if err == nil {
+			a.spooled.Add(int64(len(req.Events)))
+			l.Info("spooled events due to max retries")
+			metrics.AsyncClientEventsCounter.WithLabelValues(
+				topicName,
+				"spooled",
+			).Add(float64(len(req.Events)))
+			return
+		}
+		l.WithError(err).Error("failed to spool events")
+	}
+	a.dropped.Add(int64(len(req.Events)))
+	l.Info("dropped events due to max retries")
+	metrics.AsyncClientEventsCounter.WithLabelValues(
+		topicName,
+		"dropped",
+	).Add(float64(len(req.Events)))
+	for _, e := range req.Events {
+		a.deliver(e, &DeliveryError{
+			Reason:  DeliveryReasonDropped,
+			Retries: retries,
+			Err:     lastErr,
+		})
+	}
+}
+
+func (a *gRPCClientAsync) setDeliveryCallback(callback DeliveryCallback) {
+	a.onDelivery = callback
+}
+
+func (a *gRPCClientAsync) deliver(event *pb.Event, err error) {
+	if a.onDelivery != nil {
+		a.onDelivery(event, err)
+	}
+}
+
+// deliverResponse reports the events of a batch that aren't in the response
+// FailureIndexes, as delivered or as rejected if they're in rejected, returning how
+// many were delivered and rejected
+func (a *gRPCClientAsync) deliverResponse(
+	events []*pb.Event,
+	res *pb.SendEventsResponse,
+	rejected map[int64]bool,
+	retries int,
+) (int, int) {
+	failed := map[int64]bool{}
+	if res != nil {
+		for _, index := range res.FailureIndexes {
+			failed[index] = true
+		}
+	}
+	delivered, rejectedCount := 0, 0
+	for i, e := range events {
+		switch {
+		case failed[int64(i)]:
+		case rejected[int64(i)]:
+			rejectedCount++
+			a.deliver(e, &DeliveryError{
+				Reason:  DeliveryReasonRejected,
+				Retries: retries,
+				Err:     ErrRejected,
+			})
+		default:
+			delivered++
+			a.deliver(e, nil)
+		}
+	}
+	return delivered, rejectedCount
+}
+
+// triggerReplay wakes up replayRoutine if there are spooled events
+func (a *gRPCClientAsync) triggerReplay() {
+	if a.spool == nil || a.spool.isEmpty() {
+		return
+	}
+	select {
+	case a.replayChannel <- struct{}{}:
+	default:
+	}
+}
+
+// replayRoutine replays the spool when triggered until the client is stopped,
+// spooled events are kept for the next start after that
+func (a *gRPCClientAsync) replayRoutine() {
+	defer a.replayWg.Done()
+	for {
+		select {
+		case <-a.replayChannel:
+			a.replaySpool()
+		case <-a.stopChannel:
+			return
+		}
+	}
+}
+
+// replaySpool re-sends spooled batches in order until the spool is empty, the
+// server becomes unreachable again or the client is stopped
+func (a *gRPCClientAsync) replaySpool() {
+	for {
+		select {
+		case <-a.stopChannel:
+			return
+		default:
+		}
+		req, n, err := a.spool.peek()
+		if err != nil {
+			a.logger.WithError(err).Error("failed to read spooled events")
+			return
+		}
+		if req == nil {
+			return
+		}
+		l := a.logger.WithFields(map[string]interface{}{
+			"operation": "replaySpool",
+			"requestId": req.Id,
+			"size":      len(req.Events),
+		})
+		ctx, cancel := context.WithTimeout(a.abortCtx, a.timeout)
+		var trailer metadata.MD
+		res, err := a.client.SendEvents(ctx, req, grpc.Trailer(&trailer))
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		cancel()
+		if err != nil {
+			l.WithError(err).Warn("failed to replay spooled events")
+			return
+		}
+		a.spool.commit(n)
+		metrics.AsyncClientEventsCounter.WithLabelValues(
+			req.Events[0].Topic,
+			"replayed",
+		).Add(float64(len(req.Events)))
+		a.deliverResponse(req.Events, res, rejectedIndexes(trailer), 0)
+		if res != nil && len(res.FailureIndexes) != 0 {
+			failedEvents := make([]*pb.Event, 0, len(res.FailureIndexes))
+			for _, index := range res.FailureIndexes {
+				failedEvents = append(failedEvents, req.Events[index])
+			}
+			req.Events = failedEvents
+			a.wg.Add(1)
+			a.pending.Add(int64(len(failedEvents)))
+			go a.sendEvents(req, 0, ErrServerFailure)
+		}
+	}
+}
+
+// Shutdown stops accepting events, flushes the partial batches of every send routine and
+// waits for in-flight requests and retries until they finish or ctx is done. Then retries
+// stop, spooling or dropping their events, before the client connection is closed. The
+// spool isn't replayed during shutdown, spooled events are kept for the next start.
+func (a *gRPCClientAsync) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	a.stopMutex.Lock()
+	if a.stopped {
+		a.stopMutex.Unlock()
+		return nil, ErrClientClosed
+	}
+	a.stopped = true
+	a.stopMutex.Unlock()
+
+	pending := a.pending.Load()
+	delivered := a.delivered.Load()
+	rejected := a.rejected.Load()
+	spooled := a.spooled.Load()
+	dropped := a.dropped.Load()
+	l := a.logger.WithFields(map[string]interface{}{
+		"operation": "shutdown",
+		"pending":   pending,
+	})
+	l.Info("shutting down client")
+	close(a.stopChannel)
+
+	done := make(chan struct{})
+	go func() {
+		// replays add retries to wg, so they must be over before waiting for it
+		a.replayWg.Wait()
+		a.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		a.abort()
+		<-done
+	}
+	a.abort()
+
+	report := &ShutdownReport{
+		Flushed:   int(a.delivered.Load() - delivered),
+		Rejected:  int(a.rejected.Load() - rejected),
+		Spooled:   int(a.spooled.Load() - spooled),
+		Abandoned: int(a.dropped.Load() - dropped),
+	}
+	l.WithFields(map[string]interface{}{
+		"flushed":   report.Flushed,
+		"rejected":  report.Rejected,
+		"spooled":   report.Spooled,
+		"abandoned": report.Abandoned,
+	}).Info("client shut down")
+
+	if a.spool != nil {
+		if spoolErr := a.spool.close(); spoolErr != nil && err == nil {
+			err = spoolErr
+		}
+	}
+	if a.conn != nil {
+		if connErr := a.conn.Close(); connErr != nil && err == nil {
+			err = connErr
+		}
+	}
+	return report, err
+}
+
 // GracefulStop waits pending async send of events and closes client connection
 func (a *gRPCClientAsync) GracefulStop() error {
-	a.wg.Wait()
-	return a.conn.Close()
+	_, err := a.Shutdown(context.Background())
+	return err
 }
@@ -0,0 +1,343 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	t "github.com/topfreegames/eventsgateway/v4/testing"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	mockpb "github.com/topfreegames/protos/eventsgateway/grpc/mock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Async Client", func() {
+	var (
+		config         *viper.Viper
+		mockGRPCClient *mockpb.MockGRPCForwarderClient
+	)
+
+	newEvent := func(id string) *pb.Event {
+		return &pb.Event{Id: id, Name: "EventName", Topic: "test-topic", Timestamp: 1}
+	}
+
+	newAsyncClient := func() *gRPCClientAsync {
+		a, err := newGRPCClientAsync("", config, &logger.NullLogger{}, "", mockGRPCClient)
+		Expect(err).NotTo(HaveOccurred())
+		return a
+	}
+
+	BeforeEach(func() {
+		config, _ = t.GetDefaultConfig()
+		// no routines consuming the events channel, so the buffer fills up
+		config.Set("client.numRoutines", 0)
+		config.Set("client.channelBuffer", 1)
+		mockGRPCClient = mockpb.NewMockGRPCForwarderClient(gomock.NewController(GinkgoT()))
+	})
+
+	Describe("Overflow policy", func() {
+		It("should fail on unknown policy", func() {
+			config.Set("client.overflowPolicy", "whatever")
+			_, err := newGRPCClientAsync("", config, &logger.NullLogger{}, "", mockGRPCClient)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid overflow policy"))
+		})
+
+		It("should return ErrBufferFull with drop-newest", func() {
+			config.Set("client.overflowPolicy", OverflowPolicyDropNewest)
+			a := newAsyncClient()
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			Expect(a.send(context.Background(), newEvent("b"))).To(MatchError(ErrBufferFull))
+			Expect((<-a.eventsChannel).Id).To(Equal("a"))
+		})
+
+		It("should replace the oldest event with drop-oldest", func() {
+			config.Set("client.overflowPolicy", OverflowPolicyDropOldest)
+			a := newAsyncClient()
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			Expect(a.send(context.Background(), newEvent("b"))).To(Succeed())
+			Expect((<-a.eventsChannel).Id).To(Equal("b"))
+		})
+
+		It("should return ErrBufferFull after overflowTimeout with block-with-timeout", func() {
+			config.Set("client.overflowPolicy", OverflowPolicyBlockWithTimeout)
+			config.Set("client.overflowTimeout", 10*time.Millisecond)
+			a := newAsyncClient()
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			start := time.Now()
+			Expect(a.send(context.Background(), newEvent("b"))).To(MatchError(ErrBufferFull))
+			Expect(time.Since(start)).To(BeNumerically(">=", 10*time.Millisecond))
+		})
+
+		It("should honor the caller's context with block-with-timeout", func() {
+			config.Set("client.overflowPolicy", OverflowPolicyBlockWithTimeout)
+			config.Set("client.overflowTimeout", time.Minute)
+			a := newAsyncClient()
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			Expect(a.send(ctx, newEvent("b"))).To(MatchError(ErrBufferFull))
+		})
+
+		It("should block until there's room with block", func() {
+			a := newAsyncClient()
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			done := make(chan error)
+			go func() {
+				done <- a.send(context.Background(), newEvent("b"))
+			}()
+			Consistently(done, 20*time.Millisecond).ShouldNot(Receive())
+			Expect((<-a.eventsChannel).Id).To(Equal("a"))
+			Eventually(done).Should(Receive(BeNil()))
+		})
+	})
+
+	Describe("OnDelivery", func() {
+		type delivery struct {
+			id  string
+			err error
+		}
+
+		var (
+			a          *gRPCClientAsync
+			deliveries chan delivery
+		)
+
+		BeforeEach(func() {
+			config.Set("client.maxRetries", 1)
+			config.Set("client.retryInterval", time.Millisecond)
+			a = newAsyncClient()
+			deliveries = make(chan delivery, 10)
+			a.setDeliveryCallback(func(e *pb.Event, err error) {
+				deliveries <- delivery{e.Id, err}
+			})
+		})
+
+		request := func(ids ...string) *pb.SendEventsRequest {
+			req := &pb.SendEventsRequest{}
+			for _, id := range ids {
+				req.Events = append(req.Events, newEvent(id))
+			}
+			return req
+		}
+
+		It("should report delivered events", func() {
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(&pb.SendEventsResponse{}, nil)
+			a.wg.Add(1)
+			a.sendEvents(request("a", "b"), 0, nil)
+			Expect(deliveries).To(Receive(Equal(delivery{"a", nil})))
+			Expect(deliveries).To(Receive(Equal(delivery{"b", nil})))
+		})
+
+		It("should report events retried after a server failure", func() {
+			gomock.InOrder(
+				mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(&pb.SendEventsResponse{FailureIndexes: []int64{1}}, nil),
+				mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(&pb.SendEventsResponse{FailureIndexes: []int64{0}}, nil),
+			)
+			a.wg.Add(1)
+			a.sendEvents(request("a", "b"), 0, nil)
+			Expect(deliveries).To(Receive(Equal(delivery{"a", nil})))
+			var d delivery
+			Expect(deliveries).To(Receive(&d))
+			Expect(d.id).To(Equal("b"))
+			var deliveryErr *DeliveryError
+			Expect(errors.As(d.err, &deliveryErr)).To(BeTrue())
+			Expect(deliveryErr.Reason).To(Equal(DeliveryReasonDropped))
+			Expect(deliveryErr.Retries).To(Equal(1))
+			Expect(d.err).To(MatchError(ErrServerFailure))
+		})
+
+		It("should report events rejected by the server without retrying them", func() {
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *pb.SendEventsRequest, opts ...grpc.CallOption) (*pb.SendEventsResponse, error) {
+					*opts[0].(grpc.TrailerCallOption).TrailerAddr = metadata.Pairs(rejectedIndexesMetadata, "1")
+					return &pb.SendEventsResponse{}, nil
+				})
+			a.wg.Add(1)
+			a.pending.Add(2)
+			a.sendEvents(request("a", "b"), 0, nil)
+			Expect(deliveries).To(Receive(Equal(delivery{"a", nil})))
+			var d delivery
+			Expect(deliveries).To(Receive(&d))
+			Expect(d.id).To(Equal("b"))
+			var deliveryErr *DeliveryError
+			Expect(errors.As(d.err, &deliveryErr)).To(BeTrue())
+			Expect(deliveryErr.Reason).To(Equal(DeliveryReasonRejected))
+			Expect(d.err).To(MatchError(ErrRejected))
+			Expect(a.pending.Load()).To(BeZero())
+			Expect(a.delivered.Load()).To(Equal(int64(1)))
+		})
+
+		It("should report events dropped after max retries", func() {
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(nil, errors.New("unavailable")).Times(2)
+			a.wg.Add(1)
+			a.sendEvents(request("a"), 0, nil)
+			var d delivery
+			Expect(deliveries).To(Receive(&d))
+			Expect(d.err.Error()).To(Equal("event dropped after 1 retries: unavailable"))
+		})
+
+		It("should report events discarded by the overflow policy", func() {
+			config.Set("client.overflowPolicy", OverflowPolicyDropNewest)
+			a = newAsyncClient()
+			a.setDeliveryCallback(func(e *pb.Event, err error) {
+				deliveries <- delivery{e.Id, err}
+			})
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			Expect(a.send(context.Background(), newEvent("b"))).To(MatchError(ErrBufferFull))
+			var d delivery
+			Expect(deliveries).To(Receive(&d))
+			Expect(d.id).To(Equal("b"))
+			Expect(d.err).To(MatchError(ErrBufferFull))
+		})
+	})
+
+	Describe("Shutdown", func() {
+		BeforeEach(func() {
+			config.Set("client.numRoutines", 2)
+			config.Set("client.channelBuffer", 10)
+			config.Set("client.batchSize", 10)
+			config.Set("client.lingerInterval", time.Minute)
+		})
+
+		It("should flush partial batches without waiting for the linger interval", func() {
+			a := newAsyncClient()
+			sent := make(chan int, 2)
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, r *pb.SendEventsRequest, _ ...interface{}) (*pb.SendEventsResponse, error) {
+					sent <- len(r.Events)
+					return &pb.SendEventsResponse{}, nil
+				}).AnyTimes()
+			for _, id := range []string{"a", "b", "c"} {
+				Expect(a.send(context.Background(), newEvent(id))).To(Succeed())
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			report, err := a.Shutdown(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report).To(Equal(&ShutdownReport{Flushed: 3}))
+			total := 0
+			for len(sent) > 0 {
+				total += <-sent
+			}
+			Expect(total).To(Equal(3))
+		})
+
+		It("should stop accepting events", func() {
+			a := newAsyncClient()
+			_, err := a.Shutdown(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(a.send(context.Background(), newEvent("a"))).To(MatchError(ErrClientClosed))
+			_, err = a.Shutdown(context.Background())
+			Expect(err).To(MatchError(ErrClientClosed))
+		})
+
+		It("should report in-flight events as abandoned when ctx is done", func() {
+			config.Set("client.grpc.timeout", time.Second)
+			a := newAsyncClient()
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, r *pb.SendEventsRequest, _ ...interface{}) (*pb.SendEventsResponse, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}).AnyTimes()
+			Expect(a.send(context.Background(), newEvent("a"))).To(Succeed())
+			Expect(a.send(context.Background(), newEvent("b"))).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			report, err := a.Shutdown(ctx)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(report).To(Equal(&ShutdownReport{Flushed: 0, Abandoned: 2}))
+		})
+	})
+
+	Describe("Rate limits", func() {
+		rateLimited := status.Error(codes.ResourceExhausted, "caller rate limit exceeded")
+
+		// invokerWithTrailer fails with err, setting the trailer of the call to trailer
+		invokerWithTrailer := func(err error, trailer metadata.MD) grpc.UnaryInvoker {
+			return func(_ context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, opts ...grpc.CallOption) error {
+				for _, opt := range opts {
+					if t, ok := opt.(grpc.TrailerCallOption); ok {
+						*t.TrailerAddr = trailer
+					}
+				}
+				return err
+			}
+		}
+
+		It("should return the wait of the retry-after trailer", func() {
+			err := retryAfterInterceptor(
+				context.Background(), "method", nil, nil, nil,
+				invokerWithTrailer(rateLimited, metadata.Pairs("retry-after", "1.5")),
+			)
+			var rateLimitedErr *rateLimitedError
+			Expect(errors.As(err, &rateLimitedErr)).To(BeTrue())
+			Expect(rateLimitedErr.retryAfter).To(Equal(1500 * time.Millisecond))
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+		})
+
+		It("should keep other errors as they are", func() {
+			unavailable := status.Error(codes.Unavailable, "unavailable")
+			err := retryAfterInterceptor(
+				context.Background(), "method", nil, nil, nil,
+				invokerWithTrailer(unavailable, metadata.Pairs("retry-after", "1.5")),
+			)
+			Expect(err).To(Equal(unavailable))
+			err = retryAfterInterceptor(
+				context.Background(), "method", nil, nil, nil,
+				invokerWithTrailer(rateLimited, metadata.MD{}),
+			)
+			Expect(err).To(Equal(rateLimited))
+		})
+
+		It("should wait for the retry-after before retrying", func() {
+			config.Set("client.retryInterval", time.Millisecond)
+			a := newAsyncClient()
+			var firstAttempt time.Time
+			gomock.InOrder(
+				mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(context.Context, *pb.SendEventsRequest, ...interface{}) (*pb.SendEventsResponse, error) {
+						firstAttempt = time.Now()
+						return nil, &rateLimitedError{error: rateLimited, retryAfter: 50 * time.Millisecond}
+					}),
+				mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(context.Context, *pb.SendEventsRequest, ...interface{}) (*pb.SendEventsResponse, error) {
+						Expect(time.Since(firstAttempt)).To(BeNumerically(">=", 50*time.Millisecond))
+						return &pb.SendEventsResponse{}, nil
+					}),
+			)
+			a.wg.Add(1)
+			a.sendEvents(&pb.SendEventsRequest{Events: []*pb.Event{newEvent("a")}}, 0, nil)
+		})
+
+		It("should keep the exponential backoff if it's longer than the retry-after", func() {
+			config.Set("client.retryInterval", time.Second)
+			a := newAsyncClient()
+			Expect(a.backoff(1, &rateLimitedError{error: rateLimited, retryAfter: time.Second})).To(Equal(2 * time.Second))
+		})
+	})
+})
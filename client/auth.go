@@ -0,0 +1,112 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/credentials"
+)
+
+// Metadata keys of the credentials, they must match the ones at server/app/auth.go
+const (
+	apiKeyMetadata        = "x-api-key"
+	authorizationMetadata = "authorization"
+)
+
+// authCredentials attaches the API key or the token of client.auth to every request
+type authCredentials struct {
+	apiKey    string
+	token     string
+	tokenFile string
+
+	// mu guards the token read from tokenFile, reloaded when the file changes
+	mu        sync.Mutex
+	fileToken string
+	modTime   time.Time
+	size      int64
+}
+
+// newAuthCredentials returns the credentials of client.auth, or nil if none is set
+func newAuthCredentials(configPrefix string, config *viper.Viper) (credentials.PerRPCCredentials, error) {
+	prefix := fmt.Sprintf("%sclient.auth", configPrefix)
+	c := &authCredentials{
+		apiKey:    config.GetString(fmt.Sprintf("%s.apiKey", prefix)),
+		token:     config.GetString(fmt.Sprintf("%s.token", prefix)),
+		tokenFile: config.GetString(fmt.Sprintf("%s.tokenFile", prefix)),
+	}
+	set := 0
+	for _, s := range []string{c.apiKey, c.token, c.tokenFile} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set > 1:
+		return nil, fmt.Errorf("only one of %s.apiKey, token or tokenFile should be set", prefix)
+	}
+	if c.tokenFile != "" {
+		if _, err := os.Stat(c.tokenFile); err != nil {
+			return nil, fmt.Errorf("%s.tokenFile: %w", prefix, err)
+		}
+	}
+	return c, nil
+}
+
+// GetRequestMetadata returns the credential metadata. The token file is read again
+// whenever its modification time or size changes, so it can be rotated by whatever
+// writes it. Streams only send the credentials when they're opened, so a rotated
+// token is only sent once the stream is reopened.
+func (c *authCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if c.apiKey != "" {
+		return map[string]string{apiKeyMetadata: c.apiKey}, nil
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		var err error
+		if token, err = c.readTokenFile(); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]string{authorizationMetadata: "Bearer " + token}, nil
+}
+
+// readTokenFile returns the token of tokenFile, reading it only if it changed
+func (c *authCredentials) readTokenFile() (string, error) {
+	info, err := os.Stat(c.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fileToken != "" && info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.fileToken, nil
+	}
+	content, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	c.fileToken = strings.TrimSpace(string(content))
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+	return c.fileToken, nil
+}
+
+// RequireTransportSecurity is false so credentials also work on plaintext connections
+// inside trusted networks, client.grpc.tls should be enabled anywhere else
+func (c *authCredentials) RequireTransportSecurity() bool {
+	return false
+}
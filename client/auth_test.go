@@ -0,0 +1,90 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Auth", func() {
+	var config *viper.Viper
+
+	BeforeEach(func() {
+		config = viper.New()
+	})
+
+	It("should attach no credentials by default", func() {
+		creds, err := newAuthCredentials("", config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds).To(BeNil())
+	})
+
+	It("should attach the api key", func() {
+		config.Set("eventsgateway.client.auth.apiKey", "some-key")
+		creds, err := newAuthCredentials("eventsgateway.", config)
+		Expect(err).NotTo(HaveOccurred())
+		md, err := creds.GetRequestMetadata(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md).To(Equal(map[string]string{"x-api-key": "some-key"}))
+	})
+
+	It("should attach the token of tokenFile as it's rotated", func() {
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("first-token\n"), 0o600)).To(Succeed())
+		config.Set("client.auth.tokenFile", tokenFile)
+		creds, err := newAuthCredentials("", config)
+		Expect(err).NotTo(HaveOccurred())
+		md, err := creds.GetRequestMetadata(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md).To(Equal(map[string]string{"authorization": "Bearer first-token"}))
+
+		Expect(os.WriteFile(tokenFile, []byte("second-token"), 0o600)).To(Succeed())
+		// the file is only read again if it changed, whatever the time resolution
+		modTime := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(tokenFile, modTime, modTime)).To(Succeed())
+		md, err = creds.GetRequestMetadata(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md).To(Equal(map[string]string{"authorization": "Bearer second-token"}))
+	})
+
+	It("should not read tokenFile again while it doesn't change", func() {
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("first-token"), 0o600)).To(Succeed())
+		config.Set("client.auth.tokenFile", tokenFile)
+		creds, err := newAuthCredentials("", config)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = creds.GetRequestMetadata(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		// same size and modification time, so the cached token is kept
+		info, err := os.Stat(tokenFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(tokenFile, []byte("other-token"), 0o600)).To(Succeed())
+		Expect(os.Chtimes(tokenFile, info.ModTime(), info.ModTime())).To(Succeed())
+		md, err := creds.GetRequestMetadata(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md).To(Equal(map[string]string{"authorization": "Bearer first-token"}))
+	})
+
+	It("should fail with more than one credential", func() {
+		config.Set("client.auth.apiKey", "some-key")
+		config.Set("client.auth.token", "some-token")
+		_, err := newAuthCredentials("", config)
+		Expect(err).To(MatchError("only one of client.auth.apiKey, token or tokenFile should be set"))
+	})
+})
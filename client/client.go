@@ -31,6 +31,10 @@ import (
 	"google.golang.org/grpc"
 )
 
+// keyProp is the reserved prop carrying the message key of an event,
+// it must match sender.KeyProp at server/sender/kafka.go
+const keyProp = "eventsgateway.key"
+
 // Client struct
 type Client struct {
 	client        GRPCClient
@@ -83,9 +87,15 @@ func New(
 	clientKeepaliveTimeout := c.config.GetDuration(fmt.Sprintf("%sclient.keepalive.timeout", configPrefix))
 	clientKeepalivePermitWithoutStreams := c.config.GetBool(fmt.Sprintf("%sclient.keepalive.permitwithoutstreams", configPrefix))
 	async := c.config.GetBool(fmt.Sprintf("%sclient.async", configPrefix))
+	stream := c.config.GetBool(fmt.Sprintf("%sclient.stream", configPrefix))
+	creds, err := transportCredentials(configPrefix, c.config)
+	if err != nil {
+		return nil, err
+	}
 
 	dialOpts := append(
 		[]grpc.DialOption{
+			grpc.WithTransportCredentials(creds),
 			grpc.WithStatsHandler(
 				otelgrpc.NewClientHandler(
 					otelgrpc.WithPropagators(otel.GetTextMapPropagator()),
@@ -105,6 +115,14 @@ func New(
 		opts...,
 	)
 
+	authCreds, err := newAuthCredentials(configPrefix, c.config)
+	if err != nil {
+		return nil, err
+	}
+	if authCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(authCreds))
+	}
+
 	gzipEnabled := c.config.GetBool(fmt.Sprintf("%sclient.gzip.enabled", configPrefix))
 	if gzipEnabled {
 		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
@@ -113,11 +131,14 @@ func New(
 	c.logger = c.logger.WithFields(map[string]interface{}{
 		"serverAddress": c.serverAddress,
 		"async":         async,
+		"stream":        stream,
 		"source":        "eventsgateway/client",
 		"topic":         c.topic,
 	})
 
-	if async {
+	if stream {
+		c.client, err = newGRPCClientStream(configPrefix, c.config, c.logger, c.serverAddress, client, dialOpts...)
+	} else if async {
 		c.client, err = newGRPCClientAsync(configPrefix, c.config, c.logger, c.serverAddress, client, dialOpts...)
 	} else {
 		c.client, err = newGRPCClientSync(configPrefix, c.config, c.logger, c.serverAddress, client, dialOpts...)
@@ -151,12 +172,22 @@ func (c *Client) initConfig(configPrefix string) error {
 	c.config.SetDefault(fmt.Sprintf("%sclient.keepalive.time", configPrefix), keepaliveTime)
 	c.config.SetDefault(fmt.Sprintf("%sclient.keepalive.timeout", configPrefix), keepaliveTimeout)
 	c.config.SetDefault(fmt.Sprintf("%sclient.keepalive.permitwithoutstreams", configPrefix), true)
+	c.config.SetDefault(fmt.Sprintf("%sclient.stream", configPrefix), false)
 	c.config.SetDefault(fmt.Sprintf("%sclient.channelBuffer", configPrefix), 500)
 	c.config.SetDefault(fmt.Sprintf("%sclient.lingerInterval", configPrefix), lingerInterval)
 	c.config.SetDefault(fmt.Sprintf("%sclient.batchSize", configPrefix), 50)
 	c.config.SetDefault(fmt.Sprintf("%sclient.maxRetries", configPrefix), 3)
 	c.config.SetDefault(fmt.Sprintf("%sclient.numRoutines", configPrefix), 2)
 	c.config.SetDefault(fmt.Sprintf("%sclient.retryInterval", configPrefix), retryInterval)
+	c.config.SetDefault(fmt.Sprintf("%sclient.grpc.tls.enabled", configPrefix), false)
+	c.config.SetDefault(fmt.Sprintf("%sclient.grpc.tls.caFile", configPrefix), "")
+	c.config.SetDefault(fmt.Sprintf("%sclient.grpc.tls.certFile", configPrefix), "")
+	c.config.SetDefault(fmt.Sprintf("%sclient.grpc.tls.keyFile", configPrefix), "")
+	c.config.SetDefault(fmt.Sprintf("%sclient.grpc.tls.serverName", configPrefix), "")
+	c.config.SetDefault(fmt.Sprintf("%sclient.grpc.tls.insecureSkipVerify", configPrefix), false)
+	c.config.SetDefault(fmt.Sprintf("%sclient.auth.apiKey", configPrefix), "")
+	c.config.SetDefault(fmt.Sprintf("%sclient.auth.token", configPrefix), "")
+	c.config.SetDefault(fmt.Sprintf("%sclient.auth.tokenFile", configPrefix), "")
 
 	return nil
 }
@@ -179,6 +210,73 @@ func (c *Client) Send(
 	return nil
 }
 
+// SendTyped sends an event with typed props to another server via grpc using the client's
+// configured topic, props are encoded with EncodeProps
+func (c *Client) SendTyped(
+	ctx context.Context,
+	name string,
+	props map[string]interface{},
+) error {
+	return c.SendTypedToTopic(ctx, name, props, c.topic)
+}
+
+// SendTypedToTopic sends an event with typed props to another server via grpc using an
+// explicit topic, props are encoded with EncodeProps
+func (c *Client) SendTypedToTopic(
+	ctx context.Context,
+	name string,
+	props map[string]interface{},
+	topic string,
+) error {
+	l := c.logger.WithFields(map[string]interface{}{
+		"operation": "sendTypedToTopic",
+		"event":     name,
+		"topic":     topic,
+	})
+	l.Debug("sending event")
+	encodedProps, err := EncodeProps(props)
+	if err != nil {
+		l.WithError(err).Error("failed to encode props")
+		return err
+	}
+	if err := c.client.send(ctx, buildEvent(name, encodedProps, topic, time.Now())); err != nil {
+		l.WithError(err).Error("send event failed")
+		return err
+	}
+	return nil
+}
+
+// SendWithKey sends an event to another server via grpc using the client's configured topic,
+// events with the same key are produced to the same partition, in order. Prop names
+// starting with eventsgateway. are reserved.
+func (c *Client) SendWithKey(
+	ctx context.Context,
+	name string,
+	key string,
+	props map[string]string,
+) error {
+	l := c.logger.WithFields(map[string]interface{}{
+		"operation": "sendWithKey",
+		"event":     name,
+		"key":       key,
+	})
+	l.Debug("sending event")
+	keyedProps := make(map[string]string, len(props)+1)
+	for k, v := range props {
+		if err := checkPropName(k); err != nil {
+			l.WithError(err).Error("send event failed")
+			return err
+		}
+		keyedProps[k] = v
+	}
+	keyedProps[keyProp] = key
+	if err := c.client.send(ctx, buildEvent(name, keyedProps, c.topic, time.Now())); err != nil {
+		l.WithError(err).Error("send event failed")
+		return err
+	}
+	return nil
+}
+
 // SendToTopic sends an event to another server via grpc using an explicit topic
 func (c *Client) SendToTopic(
 	ctx context.Context,
@@ -219,6 +317,31 @@ func (c *Client) SendAtTime(
 	return nil
 }
 
+// Resend sends a previously built event as is, keeping its id, topic and timestamp,
+// so servers with dedup enabled drop events already received
+func (c *Client) Resend(ctx context.Context, event *pb.Event) error {
+	l := c.logger.WithFields(map[string]interface{}{
+		"operation": "resend",
+		"event":     event.GetName(),
+		"id":        event.GetId(),
+		"topic":     event.GetTopic(),
+	})
+	l.Debug("sending event")
+	if err := c.client.send(ctx, event); err != nil {
+		l.WithError(err).Error("send event failed")
+		return err
+	}
+	return nil
+}
+
+// OnDelivery registers a callback called with the final outcome of every event sent
+// afterwards. Async clients report a *DeliveryError for events that are dropped; events
+// persisted to the spool are reported once replayed, or never if the process stops before.
+// It must be called before sending events.
+func (c *Client) OnDelivery(callback DeliveryCallback) {
+	c.client.setDeliveryCallback(callback)
+}
+
 func (c *Client) GetGRPCClient() GRPCClient {
 	return c.client
 }
@@ -228,6 +351,12 @@ func (c *Client) GracefulStop() error {
 	return c.client.GracefulStop()
 }
 
+// Shutdown stops accepting events and flushes pending async events until ctx is done,
+// then closes client connection
+func (c *Client) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	return c.client.Shutdown(ctx)
+}
+
 func buildEvent(name string, props map[string]string, topic string, time time.Time) *pb.Event {
 	uuidV4, _ := uuid.NewV4()
 	return &pb.Event{
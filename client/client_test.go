@@ -140,6 +140,55 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Describe("SendWithKey", func() {
+		It("should send event with the key on the reserved prop", func() {
+			mockGRPCClient.EXPECT().SendEvent(
+				gomock.Any(),
+				gomock.Any(),
+			).Do(func(ctx context.Context, event *pb.Event) {
+				Expect(event.Topic).To(Equal("test-topic"))
+				Expect(event.Props).To(Equal(map[string]string{
+					"prop1":             "val1",
+					"prop2":             "val2",
+					"eventsgateway.key": "user-1",
+				}))
+			}).Return(nil, nil)
+
+			err := c.SendWithKey(context.Background(), name, "user-1", props)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(props).NotTo(HaveKey("eventsgateway.key"))
+		})
+
+		It("should not send events with reserved props", func() {
+			err := c.SendWithKey(context.Background(), name, "user-1", map[string]string{
+				"prop1":             "val1",
+				"eventsgateway.key": "user-2",
+			})
+			Expect(err).To(MatchError("prop eventsgateway.key: names starting with eventsgateway. are reserved"))
+		})
+	})
+
+	Describe("Resend", func() {
+		It("should send the event as is", func() {
+			event := &pb.Event{
+				Id:        "event-id",
+				Name:      name,
+				Topic:     "other-topic",
+				Props:     props,
+				Timestamp: 1500000000000,
+			}
+			mockGRPCClient.EXPECT().SendEvent(
+				gomock.Any(),
+				gomock.Any(),
+			).Do(func(ctx context.Context, sent *pb.Event) {
+				Expect(sent).To(Equal(event))
+			}).Return(nil, nil)
+
+			err := c.Resend(context.Background(), event)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
 	Describe("SendAtTime", func() {
 		It("should send event with a specific timestamp", func() {
 			t1 := time.Now()
@@ -0,0 +1,56 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+const (
+	// DeliveryReasonDropped is reported for events dropped after exhausting client.maxRetries
+	DeliveryReasonDropped = "dropped"
+	// DeliveryReasonOverflow is reported for events discarded by client.overflowPolicy
+	DeliveryReasonOverflow = "overflow"
+	// DeliveryReasonRejected is reported for events the server rejected for good, such as
+	// invalid ones, which aren't retried
+	DeliveryReasonRejected = "rejected"
+)
+
+// ErrServerFailure is the last error of events the server reported in the
+// FailureIndexes of a SendEventsResponse
+var ErrServerFailure = errors.New("server failed to produce event")
+
+// ErrRejected is the error of events the server rejected for good
+var ErrRejected = errors.New("server rejected event")
+
+// DeliveryCallback is called once with the final outcome of each sent event, err is
+// nil if the event reached the server. In async mode it's called from the client
+// send routines, so it must be safe for concurrent use and return quickly.
+type DeliveryCallback func(event *pb.Event, err error)
+
+// DeliveryError is reported to the DeliveryCallback of async clients when an event is not delivered
+type DeliveryError struct {
+	// Reason is DeliveryReasonDropped, DeliveryReasonOverflow or DeliveryReasonRejected
+	Reason string
+	// Retries is how many times the event was retried
+	Retries int
+	// Err is the error of the last attempt, ErrServerFailure if it was listed in the response FailureIndexes
+	// and ErrRejected if it was rejected
+	Err error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("event %s after %d retries: %v", e.Reason, e.Retries, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
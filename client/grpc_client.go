@@ -15,5 +15,21 @@ import (
 
 type GRPCClient interface {
 	send(context.Context, *pb.Event) error
+	setDeliveryCallback(DeliveryCallback)
+	Shutdown(context.Context) (*ShutdownReport, error)
 	GracefulStop() error
 }
+
+// ShutdownReport is the outcome of the events pending when Shutdown was called
+type ShutdownReport struct {
+	// Flushed is the number of pending events delivered to the server during shutdown
+	Flushed int
+	// Rejected is the number of pending events the server rejected for good
+	Rejected int
+	// Spooled is the number of pending events persisted to the spool, they're sent
+	// after the next start
+	Spooled int
+	// Abandoned is the number of pending events that were dropped, either they exhausted
+	// their retries or the shutdown context was done, and they couldn't be spooled
+	Abandoned int
+}
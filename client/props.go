@@ -0,0 +1,177 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typesProp is the reserved prop with the types of the typed props of an event,
+// it must match sender.TypesProp at server/sender/kafka.go
+const typesProp = "eventsgateway.types"
+
+// reservedPropPrefix is the prefix of the props the client and the server set
+const reservedPropPrefix = "eventsgateway."
+
+// checkPropName returns an error if name is a reserved prop
+func checkPropName(name string) error {
+	if strings.HasPrefix(name, reservedPropPrefix) {
+		return fmt.Errorf("prop %s: names starting with %s are reserved", name, reservedPropPrefix)
+	}
+	return nil
+}
+
+// Types of the typed props, props without a type are strings
+const (
+	PropTypeBool      = "bool"
+	PropTypeInt       = "int"
+	PropTypeUint      = "uint"
+	PropTypeFloat     = "float"
+	PropTypeTimestamp = "timestamp"
+	PropTypeList      = "list"
+	PropTypeMap       = "map"
+)
+
+// EncodeProps encodes typed props into string props, keeping their types on a reserved
+// prop so DecodeProps can restore them. Values can be strings, bools, integers, floats,
+// time.Time, slices and maps with string keys; slices and maps are encoded as JSON.
+// Prop names starting with eventsgateway. are reserved.
+func EncodeProps(props map[string]interface{}) (map[string]string, error) {
+	encoded := make(map[string]string, len(props)+1)
+	types := map[string]string{}
+	for name, value := range props {
+		if err := checkPropName(name); err != nil {
+			return nil, err
+		}
+		s, propType, err := encodeProp(value)
+		if err != nil {
+			return nil, fmt.Errorf("prop %s: %w", name, err)
+		}
+		encoded[name] = s
+		if propType != "" {
+			types[name] = propType
+		}
+	}
+	if len(types) > 0 {
+		b, err := json.Marshal(types)
+		if err != nil {
+			return nil, err
+		}
+		encoded[typesProp] = string(b)
+	}
+	return encoded, nil
+}
+
+func encodeProp(value interface{}) (string, string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, "", nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), PropTypeTimestamp, nil
+	case []byte:
+		return "", "", fmt.Errorf("unsupported type %T, use a string", value)
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String(), PropTypeInt, nil
+		}
+		return v.String(), PropTypeFloat, nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), PropTypeBool, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), PropTypeInt, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), PropTypeUint, nil
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32), PropTypeFloat, nil
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), PropTypeFloat, nil
+	case reflect.Slice, reflect.Array:
+		b, err := json.Marshal(value)
+		return string(b), PropTypeList, err
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return "", "", fmt.Errorf("map keys should be strings, got %s", v.Type().Key())
+		}
+		b, err := json.Marshal(value)
+		return string(b), PropTypeMap, err
+	default:
+		return "", "", fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+// DecodeProps restores the typed props encoded by EncodeProps. Props of events sent
+// with plain string props are returned as strings. Integers are returned as int64,
+// unsigned integers as uint64, floats as float64 and timestamps as time.Time; numbers
+// inside lists and maps are returned as json.Number.
+func DecodeProps(props map[string]string) (map[string]interface{}, error) {
+	types := map[string]string{}
+	if encodedTypes, ok := props[typesProp]; ok {
+		if err := json.Unmarshal([]byte(encodedTypes), &types); err != nil {
+			return nil, fmt.Errorf("invalid %s prop: %w", typesProp, err)
+		}
+	}
+	decoded := make(map[string]interface{}, len(props))
+	for name, s := range props {
+		if name == typesProp {
+			continue
+		}
+		value, err := decodeProp(s, types[name])
+		if err != nil {
+			return nil, fmt.Errorf("prop %s: %w", name, err)
+		}
+		decoded[name] = value
+	}
+	return decoded, nil
+}
+
+func decodeProp(s, propType string) (interface{}, error) {
+	switch propType {
+	case "":
+		return s, nil
+	case PropTypeBool:
+		return strconv.ParseBool(s)
+	case PropTypeInt:
+		return strconv.ParseInt(s, 10, 64)
+	case PropTypeUint:
+		return strconv.ParseUint(s, 10, 64)
+	case PropTypeFloat:
+		return strconv.ParseFloat(s, 64)
+	case PropTypeTimestamp:
+		return time.Parse(time.RFC3339Nano, s)
+	case PropTypeList:
+		var list []interface{}
+		if err := decodeJSON(s, &list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	case PropTypeMap:
+		var m map[string]interface{}
+		if err := decodeJSON(s, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", propType)
+	}
+}
+
+func decodeJSON(s string, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
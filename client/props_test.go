@@ -0,0 +1,112 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/client"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("Typed props", func() {
+	timestamp := time.Date(2024, 5, 17, 10, 30, 0, 123456789, time.UTC)
+	typedProps := map[string]interface{}{
+		"name":      "someone",
+		"premium":   true,
+		"level":     int32(42),
+		"coins":     int64(math.MaxInt64),
+		"gems":      uint64(math.MaxUint64),
+		"ratio":     0.1,
+		"joinedAt":  timestamp,
+		"tags":      []string{"a", "b"},
+		"inventory": map[string]interface{}{"sword": 1, "shield": map[string]bool{"equipped": true}},
+	}
+
+	It("should decode the props it encodes", func() {
+		encoded, err := client.EncodeProps(typedProps)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encoded).To(HaveKeyWithValue("name", "someone"))
+		Expect(encoded).To(HaveKeyWithValue("level", "42"))
+		Expect(encoded).To(HaveKeyWithValue("tags", `["a","b"]`))
+
+		decoded, err := client.DecodeProps(encoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(map[string]interface{}{
+			"name":     "someone",
+			"premium":  true,
+			"level":    int64(42),
+			"coins":    int64(math.MaxInt64),
+			"gems":     uint64(math.MaxUint64),
+			"ratio":    0.1,
+			"joinedAt": timestamp,
+			"tags":     []interface{}{"a", "b"},
+			"inventory": map[string]interface{}{
+				"sword":  json.Number("1"),
+				"shield": map[string]interface{}{"equipped": true},
+			},
+		}))
+	})
+
+	It("should decode plain string props as strings", func() {
+		decoded, err := client.DecodeProps(map[string]string{"level": "42"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(map[string]interface{}{"level": "42"}))
+	})
+
+	It("should not add the types of props that are all strings", func() {
+		encoded, err := client.EncodeProps(map[string]interface{}{"name": "someone"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encoded).To(Equal(map[string]string{"name": "someone"}))
+	})
+
+	It("should fail to encode unsupported types", func() {
+		_, err := client.EncodeProps(map[string]interface{}{"callback": func() {}})
+		Expect(err).To(MatchError(ContainSubstring("prop callback: unsupported type func()")))
+		_, err = client.EncodeProps(map[string]interface{}{"ids": map[int]string{1: "a"}})
+		Expect(err).To(MatchError(ContainSubstring("map keys should be strings")))
+	})
+
+	It("should fail to encode reserved props", func() {
+		_, err := client.EncodeProps(map[string]interface{}{"eventsgateway.types": "{}", "level": 42})
+		Expect(err).To(MatchError("prop eventsgateway.types: names starting with eventsgateway. are reserved"))
+	})
+
+	Describe("SendTyped", func() {
+		It("should send the encoded props", func() {
+			c, err := client.New("", config, log, mockGRPCClient)
+			Expect(err).NotTo(HaveOccurred())
+			mockGRPCClient.EXPECT().SendEvent(gomock.Any(), gomock.Any()).Do(
+				func(ctx context.Context, event *pb.Event) {
+					Expect(event.Topic).To(Equal("test-topic"))
+					decoded, err := client.DecodeProps(event.Props)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(decoded).To(HaveKeyWithValue("level", int64(42)))
+					Expect(decoded).To(HaveKeyWithValue("joinedAt", timestamp))
+				}).Return(nil, nil)
+
+			Expect(c.SendTyped(context.Background(), "EventName", typedProps)).To(Succeed())
+		})
+
+		It("should not send events with props it can't encode", func() {
+			c, err := client.New("", config, log, mockGRPCClient)
+			Expect(err).NotTo(HaveOccurred())
+			err = c.SendTyped(context.Background(), "EventName", map[string]interface{}{"ch": make(chan int)})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
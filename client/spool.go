@@ -0,0 +1,330 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+const (
+	spoolSegmentExt    = ".seg"
+	spoolRecordHeader  = 4
+	spoolSegmentFormat = "%020d" + spoolSegmentExt
+	spoolOffsetFile    = "offset"
+	spoolOffsetSize    = 16
+	// spoolMaxRecordBytes is the max size of a spooled batch, grpc's default max
+	// message size, so a length beyond it can't be one of a record
+	spoolMaxRecordBytes = 4 << 20
+)
+
+var (
+	// errSpoolFull is returned when persisting a batch would exceed the spool size cap
+	errSpoolFull = errors.New("spool is full")
+	// errSpoolRecordTooLarge is returned when a batch is larger than spoolMaxRecordBytes
+	errSpoolRecordTooLarge = errors.New("batch is too large to spool")
+	// errSpoolCorrupted is returned when a record length can't have been written,
+	// so the records after it can't be found
+	errSpoolCorrupted = errors.New("spool segment is corrupted")
+)
+
+// spool is a write-ahead queue of SendEventsRequests persisted in segment files.
+// Each record is a 4 bytes big endian length followed by the marshalled request.
+// Records are read back in the same order they were written, oldest segment first.
+// The offset of the oldest segment that was committed is persisted in the offset
+// file as its big endian sequence and offset, so restarts don't replay it.
+type spool struct {
+	mu           sync.Mutex
+	dir          string
+	logger       logger.Logger
+	maxBytes     int64
+	segmentBytes int64
+	size         int64
+	segments     []uint64
+	active       *os.File
+	activeSeq    uint64
+	activeSize   int64
+	readOffset   int64
+}
+
+func newSpool(
+	dir string,
+	maxBytes int64,
+	segmentBytes int64,
+	logger logger.Logger,
+) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:          dir,
+		logger:       logger,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seq)
+		s.size += info.Size()
+		if seq >= s.activeSeq {
+			s.activeSeq = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	if err := s.loadOffset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadOffset restores the committed offset of the oldest segment, it's ignored
+// if the segment was already removed
+func (s *spool) loadOffset() error {
+	content, err := os.ReadFile(filepath.Join(s.dir, spoolOffsetFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(content) != spoolOffsetSize {
+		s.logger.WithField("file", spoolOffsetFile).Warn("ignoring corrupted spool offset")
+		return nil
+	}
+	seq := binary.BigEndian.Uint64(content)
+	if len(s.segments) > 0 && s.segments[0] == seq {
+		s.readOffset = int64(binary.BigEndian.Uint64(content[8:]))
+	}
+	return nil
+}
+
+// saveOffset persists readOffset, replacing the offset file so it's never
+// partially written
+func (s *spool) saveOffset() error {
+	content := make([]byte, spoolOffsetSize)
+	binary.BigEndian.PutUint64(content, s.segments[0])
+	binary.BigEndian.PutUint64(content[8:], uint64(s.readOffset))
+
+	path := filepath.Join(s.dir, spoolOffsetFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf(spoolSegmentFormat, seq))
+}
+
+// write appends req to the active segment, rolling it when segmentBytes is reached
+func (s *spool) write(req *pb.SendEventsRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if len(data) > spoolMaxRecordBytes {
+		return errSpoolRecordTooLarge
+	}
+	recordSize := int64(spoolRecordHeader + len(data))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+recordSize > s.maxBytes {
+		return errSpoolFull
+	}
+	if s.active != nil && s.activeSize+recordSize > s.segmentBytes {
+		if err := s.seal(); err != nil {
+			return err
+		}
+	}
+	if s.active == nil {
+		f, err := os.OpenFile(s.segmentPath(s.activeSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.active = f
+		s.activeSize = 0
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[spoolRecordHeader:], data)
+	n, err := s.active.Write(record)
+	s.activeSize += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.active.Sync()
+}
+
+// seal closes the active segment and makes it available for reading
+func (s *spool) seal() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.segments = append(s.segments, s.activeSeq)
+	s.active = nil
+	s.activeSeq++
+	s.activeSize = 0
+	return err
+}
+
+// peek returns the oldest spooled request without removing it from the spool,
+// along with the record size that must be passed to commit once it's delivered.
+// It returns a nil request if the spool is empty.
+func (s *spool) peek() (*pb.SendEventsRequest, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if len(s.segments) == 0 {
+			if s.activeSize == 0 {
+				return nil, 0, nil
+			}
+			if err := s.seal(); err != nil {
+				return nil, 0, err
+			}
+		}
+		req, n, err := s.readRecord(s.segments[0], s.readOffset)
+		if err == io.EOF {
+			// segment fully consumed, or truncated by a crash in the middle of a write
+			s.removeOldest()
+			continue
+		}
+		if err == errSpoolCorrupted {
+			s.logger.WithField("segment", s.segmentPath(s.segments[0])).Warn("dropping the rest of corrupted spool segment")
+			s.removeOldest()
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if req == nil {
+			s.logger.WithField("segment", s.segmentPath(s.segments[0])).Warn("skipping corrupted spool record")
+			s.readOffset += n
+			continue
+		}
+		return req, n, nil
+	}
+}
+
+func (s *spool) readRecord(seq uint64, offset int64) (*pb.SendEventsRequest, int64, error) {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, spoolRecordHeader)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, io.EOF
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	if length > spoolMaxRecordBytes {
+		return nil, 0, errSpoolCorrupted
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+spoolRecordHeader); err != nil {
+		return nil, 0, io.EOF
+	}
+	n := int64(spoolRecordHeader + len(data))
+	req := &pb.SendEventsRequest{}
+	if err := proto.Unmarshal(data, req); err != nil || len(req.Events) == 0 {
+		return nil, n, nil
+	}
+	return req, n, nil
+}
+
+// commit removes the record returned by the last peek from the spool
+func (s *spool) commit(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readOffset += n
+	if err := s.saveOffset(); err != nil {
+		s.logger.WithError(err).Error("failed to persist spool offset, committed events may be replayed")
+	}
+}
+
+func (s *spool) removeOldest() {
+	path := s.segmentPath(s.segments[0])
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		s.logger.WithError(err).WithField("segment", path).Error("failed to remove spool segment")
+	}
+	// the offset is of the removed segment, a new one might reuse its sequence
+	if err := os.Remove(filepath.Join(s.dir, spoolOffsetFile)); err != nil && !os.IsNotExist(err) {
+		s.logger.WithError(err).Error("failed to remove spool offset")
+	}
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+}
+
+// isEmpty returns true if there are no spooled requests
+func (s *spool) isEmpty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size == 0
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
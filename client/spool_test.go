@@ -0,0 +1,277 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	t "github.com/topfreegames/eventsgateway/v4/testing"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	mockpb "github.com/topfreegames/protos/eventsgateway/grpc/mock"
+)
+
+var _ = Describe("Spool", func() {
+	var (
+		dir string
+		log logger.Logger
+	)
+
+	newRequest := func(id string) *pb.SendEventsRequest {
+		return &pb.SendEventsRequest{
+			Id: id,
+			Events: []*pb.Event{
+				{Id: id, Name: "EventName", Topic: "test-topic", Timestamp: 1},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "eventsgateway-spool")
+		Expect(err).NotTo(HaveOccurred())
+		log = &logger.NullLogger{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should replay requests in order across segments", func() {
+		s, err := newSpool(dir, 1<<20, 64, log)
+		Expect(err).NotTo(HaveOccurred())
+		for _, id := range []string{"a", "b", "c"} {
+			Expect(s.write(newRequest(id))).To(Succeed())
+		}
+		Expect(len(s.segments)).To(BeNumerically(">", 0))
+
+		for _, id := range []string{"a", "b", "c"} {
+			req, n, err := s.peek()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Id).To(Equal(id))
+			s.commit(n)
+		}
+		req, _, err := s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req).To(BeNil())
+		Expect(s.isEmpty()).To(BeTrue())
+	})
+
+	It("should keep the request if it's not committed", func() {
+		s, err := newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("a"))).To(Succeed())
+
+		req, _, err := s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Id).To(Equal("a"))
+		req, _, err = s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Id).To(Equal("a"))
+	})
+
+	It("should survive restarts", func() {
+		s, err := newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("a"))).To(Succeed())
+		Expect(s.write(newRequest("b"))).To(Succeed())
+		Expect(s.close()).To(Succeed())
+
+		s, err = newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.isEmpty()).To(BeFalse())
+		Expect(s.write(newRequest("c"))).To(Succeed())
+		for _, id := range []string{"a", "b", "c"} {
+			req, n, err := s.peek()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Id).To(Equal(id))
+			s.commit(n)
+		}
+	})
+
+	It("should not replay committed requests after restarts", func() {
+		s, err := newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		for _, id := range []string{"a", "b", "c"} {
+			Expect(s.write(newRequest(id))).To(Succeed())
+		}
+		req, n, err := s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Id).To(Equal("a"))
+		s.commit(n)
+		Expect(s.close()).To(Succeed())
+
+		s, err = newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		for _, id := range []string{"b", "c"} {
+			req, n, err := s.peek()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Id).To(Equal(id))
+			s.commit(n)
+		}
+		req, _, err = s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req).To(BeNil())
+	})
+
+	It("should not reuse the offset of a removed segment", func() {
+		s, err := newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("a"))).To(Succeed())
+		req, n, err := s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		s.commit(n)
+		req, _, err = s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req).To(BeNil())
+		Expect(s.close()).To(Succeed())
+
+		s, err = newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("b"))).To(Succeed())
+		Expect(s.close()).To(Succeed())
+
+		s, err = newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		req, _, err = s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Id).To(Equal("b"))
+	})
+
+	It("should drop the rest of a segment with a record length beyond spoolMaxRecordBytes", func() {
+		s, err := newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("a"))).To(Succeed())
+		Expect(s.write(newRequest("b"))).To(Succeed())
+		Expect(s.seal()).To(Succeed())
+		Expect(s.write(newRequest("c"))).To(Succeed())
+
+		f, err := os.OpenFile(s.segmentPath(s.segments[0]), os.O_WRONLY, 0644)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		req, _, err := s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Id).To(Equal("c"))
+	})
+
+	It("should read records written with a larger maxBytes", func() {
+		s, err := newSpool(dir, 1<<20, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("a"))).To(Succeed())
+		Expect(s.close()).To(Succeed())
+
+		s, err = newSpool(dir, 10, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		req, _, err := s.peek()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.Id).To(Equal("a"))
+	})
+
+	It("should refuse batches larger than spoolMaxRecordBytes", func() {
+		s, err := newSpool(dir, 1<<30, 1<<30, log)
+		Expect(err).NotTo(HaveOccurred())
+		req := newRequest("a")
+		req.Events[0].Props = map[string]string{"big": strings.Repeat("x", spoolMaxRecordBytes)}
+		Expect(s.write(req)).To(MatchError(errSpoolRecordTooLarge))
+		Expect(s.isEmpty()).To(BeTrue())
+	})
+
+	It("should refuse writes beyond maxBytes", func() {
+		s, err := newSpool(dir, 40, 1<<20, log)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.write(newRequest("a"))).To(Succeed())
+		Expect(s.write(newRequest("b"))).To(MatchError(errSpoolFull))
+	})
+
+	Describe("Async client", func() {
+		var (
+			a              *gRPCClientAsync
+			mockGRPCClient *mockpb.MockGRPCForwarderClient
+		)
+
+		BeforeEach(func() {
+			config, _ := t.GetDefaultConfig()
+			config.Set("client.maxRetries", 0)
+			config.Set("client.retryInterval", time.Millisecond)
+			config.Set("client.spool.enabled", true)
+			config.Set("client.spool.directory", dir)
+
+			mockCtrl := gomock.NewController(GinkgoT())
+			mockGRPCClient = mockpb.NewMockGRPCForwarderClient(mockCtrl)
+			var err error
+			a, err = newGRPCClientAsync("", config, log, "", mockGRPCClient)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should spool events after max retries and replay them once the server is back", func() {
+			req := newRequest("a")
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(nil, errors.New("unavailable"))
+			a.wg.Add(1)
+			a.sendEvents(req, 0, nil)
+			Expect(a.spool.isEmpty()).To(BeFalse())
+
+			replayed := make(chan string, 2)
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, r *pb.SendEventsRequest, _ ...interface{}) (*pb.SendEventsResponse, error) {
+					replayed <- r.Id
+					return &pb.SendEventsResponse{}, nil
+				}).Times(2)
+			a.wg.Add(1)
+			a.sendEvents(newRequest("b"), 0, nil)
+
+			Eventually(replayed).Should(Receive(Equal("b")))
+			Eventually(replayed).Should(Receive(Equal("a")))
+			Eventually(a.spool.isEmpty).Should(BeTrue())
+		})
+
+		It("should stop retries and spool their events when the shutdown ctx is done", func() {
+			a.maxRetries = 3
+			a.retryInterval = time.Minute
+			mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(nil, errors.New("unavailable")).AnyTimes()
+			Expect(a.send(context.Background(), newRequest("a").Events[0])).To(Succeed())
+			Expect(a.send(context.Background(), newRequest("b").Events[0])).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			report, err := a.Shutdown(ctx)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(report).To(Equal(&ShutdownReport{Spooled: 2}))
+
+			s, err := newSpool(dir, 1<<20, 1<<20, log)
+			Expect(err).NotTo(HaveOccurred())
+			spooled := 0
+			for {
+				req, n, err := s.peek()
+				Expect(err).NotTo(HaveOccurred())
+				if req == nil {
+					break
+				}
+				spooled += len(req.Events)
+				s.commit(n)
+			}
+			Expect(spooled).To(Equal(2))
+		})
+	})
+})
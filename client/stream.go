@@ -0,0 +1,275 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// sendEventsStreamMethod must match the stream registered by the server at server/app/stream.go
+const sendEventsStreamMethod = "/eventsgateway.GRPCForwarderStream/SendEventsStream"
+
+var sendEventsStreamDesc = &grpc.StreamDesc{
+	StreamName:    "SendEventsStream",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// errStreamClosed is returned to requests waiting for an ack when the stream breaks
+// without an error status
+var errStreamClosed = errors.New("events stream closed")
+
+// sendEventsAck is the server reply to each SendEventsRequest sent on the stream,
+// its wire format must match server/app.SendEventsAck
+type sendEventsAck struct {
+	Id              string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	FailureIndexes  []int64 `protobuf:"varint,2,rep,packed,name=failureIndexes,proto3" json:"failureIndexes,omitempty"`
+	RejectedIndexes []int64 `protobuf:"varint,3,rep,packed,name=rejectedIndexes,proto3" json:"rejectedIndexes,omitempty"`
+}
+
+func (m *sendEventsAck) Reset()         { *m = sendEventsAck{} }
+func (m *sendEventsAck) String() string { return proto.CompactTextString(m) }
+func (*sendEventsAck) ProtoMessage()    {}
+
+// eventsStream is a stream opened by streamForwarderClient
+type eventsStream struct {
+	grpc.ClientStream
+	// cancel ends the stream, unblocking the sends waiting for the server to read
+	cancel context.CancelFunc
+	// done is closed by receiveRoutine once the stream breaks, after setting err
+	done chan struct{}
+	err  error
+}
+
+// newGRPCClientStream returns an async client that sends its batches through a
+// long-lived bidirectional stream instead of one SendEvents call per batch
+func newGRPCClientStream(
+	configPrefix string,
+	config *viper.Viper,
+	logger logger.Logger,
+	serverAddress string,
+	client pb.GRPCForwarderClient,
+	opts ...grpc.DialOption,
+) (*gRPCClientAsync, error) {
+	a, err := buildGRPCClientAsync(configPrefix, config, logger, serverAddress, client, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// a client informed by the caller is kept as is, it's only used on unit tests
+	if a.conn != nil {
+		a.client = newStreamForwarderClient(a.conn, a.client, a.logger, a.metricsReporterInterceptor)
+	}
+	a.start()
+	return a, nil
+}
+
+// streamForwarderClient implements pb.GRPCForwarderClient sending SendEvents requests
+// on a shared stream and matching the acks back by request id. It falls back to the
+// unary SendEvents if the server doesn't implement the stream.
+type streamForwarderClient struct {
+	pb.GRPCForwarderClient
+	conn        *grpc.ClientConn
+	interceptor grpc.UnaryClientInterceptor
+	logger      logger.Logger
+	mu          sync.Mutex
+	sendMutex   sync.Mutex
+	stream      *eventsStream
+	unsupported bool
+	pending     map[string]chan *sendEventsAck
+}
+
+func newStreamForwarderClient(
+	conn *grpc.ClientConn,
+	client pb.GRPCForwarderClient,
+	logger logger.Logger,
+	interceptor grpc.UnaryClientInterceptor,
+) *streamForwarderClient {
+	return &streamForwarderClient{
+		GRPCForwarderClient: client,
+		conn:                conn,
+		interceptor:         interceptor,
+		logger:              logger.WithField("transport", "stream"),
+		pending:             map[string]chan *sendEventsAck{},
+	}
+}
+
+// SendEvents sends req on the stream, opening it if needed, and waits for its ack
+func (s *streamForwarderClient) SendEvents(
+	ctx context.Context,
+	req *pb.SendEventsRequest,
+	opts ...grpc.CallOption,
+) (*pb.SendEventsResponse, error) {
+	s.mu.Lock()
+	unsupported := s.unsupported
+	s.mu.Unlock()
+	if unsupported {
+		return s.GRPCForwarderClient.SendEvents(ctx, req, opts...)
+	}
+
+	res := &pb.SendEventsResponse{}
+	err := s.interceptor(ctx, sendEventsStreamMethod, req, res, s.conn, s.invoke, opts...)
+	if status.Code(err) == codes.Unimplemented {
+		s.logger.Warn("server doesn't support events stream, falling back to unary requests")
+		s.mu.Lock()
+		s.unsupported = true
+		s.mu.Unlock()
+		return s.GRPCForwarderClient.SendEvents(ctx, req, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *streamForwarderClient) invoke(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	opts ...grpc.CallOption,
+) error {
+	r := req.(*pb.SendEventsRequest)
+	ackChannel := make(chan *sendEventsAck, 1)
+
+	s.mu.Lock()
+	stream, err := s.getStream()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.pending[r.Id] = ackChannel
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if s.pending[r.Id] == ackChannel {
+			delete(s.pending, r.Id)
+		}
+		s.mu.Unlock()
+	}()
+
+	// SendMsg blocks while the server doesn't read the stream and ignores ctx, so
+	// the stream is canceled if ctx is done before the request is sent
+	sent := make(chan error, 1)
+	go func() {
+		s.sendMutex.Lock()
+		defer s.sendMutex.Unlock()
+		sent <- stream.SendMsg(r)
+	}()
+	select {
+	case err = <-sent:
+	case <-ctx.Done():
+		stream.cancel()
+		return ctx.Err()
+	}
+	if err == io.EOF {
+		// the stream was closed by the server, the actual error is returned by RecvMsg
+		<-stream.done
+		err = stream.err
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ack, ok := <-ackChannel:
+		if !ok {
+			return stream.err
+		}
+		reply.(*pb.SendEventsResponse).FailureIndexes = ack.FailureIndexes
+		setRejectedTrailer(ack.RejectedIndexes, opts)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setRejectedTrailer sets the rejected indexes of an ack on the trailer call options,
+// where the server sets them on unary SendEvents responses
+func setRejectedTrailer(indexes []int64, opts []grpc.CallOption) {
+	if len(indexes) == 0 {
+		return
+	}
+	values := make([]string, len(indexes))
+	for i, index := range indexes {
+		values[i] = strconv.FormatInt(index, 10)
+	}
+	for _, opt := range opts {
+		if trailer, ok := opt.(grpc.TrailerCallOption); ok {
+			*trailer.TrailerAddr = metadata.MD{rejectedIndexesMetadata: values}
+		}
+	}
+}
+
+// getStream returns the current stream, opening a new one if there's none; s.mu must be held
+func (s *streamForwarderClient) getStream() (*eventsStream, error) {
+	if s.stream != nil {
+		return s.stream, nil
+	}
+	// the stream outlives the requests sent on it, so it can't use their context
+	ctx, cancel := context.WithCancel(context.Background())
+	clientStream, err := s.conn.NewStream(ctx, sendEventsStreamDesc, sendEventsStreamMethod)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.stream = &eventsStream{
+		ClientStream: clientStream,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	go s.receiveRoutine(s.stream)
+	return s.stream, nil
+}
+
+// receiveRoutine routes acks to the requests waiting for them until the stream breaks
+func (s *streamForwarderClient) receiveRoutine(stream *eventsStream) {
+	for {
+		ack := &sendEventsAck{}
+		err := stream.RecvMsg(ack)
+		s.mu.Lock()
+		if err != nil {
+			if err == io.EOF {
+				err = errStreamClosed
+			}
+			// the server ends the stream of rate limited callers
+			err = withRetryAfter(err, stream.Trailer())
+			s.logger.WithError(err).Warn("events stream closed")
+			stream.cancel()
+			stream.err = err
+			if s.stream == stream {
+				s.stream = nil
+			}
+			for id, ackChannel := range s.pending {
+				close(ackChannel)
+				delete(s.pending, id)
+			}
+			close(stream.done)
+			s.mu.Unlock()
+			return
+		}
+		if ackChannel, ok := s.pending[ack.Id]; ok {
+			ackChannel <- ack
+			delete(s.pending, ack.Id)
+		}
+		s.mu.Unlock()
+	}
+}
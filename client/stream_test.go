@@ -0,0 +1,249 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	t "github.com/topfreegames/eventsgateway/v4/testing"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	mockpb "github.com/topfreegames/protos/eventsgateway/grpc/mock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var _ = Describe("Stream Client", func() {
+	var (
+		grpcServer     *grpc.Server
+		listener       *bufconn.Listener
+		conn           *grpc.ClientConn
+		mockGRPCClient *mockpb.MockGRPCForwarderClient
+		s              *streamForwarderClient
+	)
+
+	// ackAll acks every request, reporting the events named "fail" as failed and the
+	// ones named "invalid" as rejected
+	ackAll := func(_ interface{}, stream grpc.ServerStream) error {
+		for {
+			req := &pb.SendEventsRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			ack := &sendEventsAck{Id: req.Id}
+			for i, e := range req.Events {
+				switch e.Name {
+				case "fail":
+					ack.FailureIndexes = append(ack.FailureIndexes, int64(i))
+				case "invalid":
+					ack.RejectedIndexes = append(ack.RejectedIndexes, int64(i))
+				}
+			}
+			if err := stream.SendMsg(ack); err != nil {
+				return err
+			}
+		}
+	}
+
+	dialOptions := func() []grpc.DialOption {
+		return []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}
+	}
+
+	startServer := func(handler grpc.StreamHandler, opts ...grpc.ServerOption) {
+		listener = bufconn.Listen(1024 * 1024)
+		grpcServer = grpc.NewServer(opts...)
+		if handler != nil {
+			grpcServer.RegisterService(&grpc.ServiceDesc{
+				ServiceName: "eventsgateway.GRPCForwarderStream",
+				HandlerType: (*interface{})(nil),
+				Streams: []grpc.StreamDesc{{
+					StreamName:    sendEventsStreamDesc.StreamName,
+					Handler:       handler,
+					ServerStreams: true,
+					ClientStreams: true,
+				}},
+			}, struct{}{})
+		}
+		go grpcServer.Serve(listener)
+
+		var err error
+		conn, err = grpc.Dial("bufnet", dialOptions()...)
+		Expect(err).NotTo(HaveOccurred())
+
+		mockGRPCClient = mockpb.NewMockGRPCForwarderClient(gomock.NewController(GinkgoT()))
+		passthrough := func(
+			ctx context.Context,
+			method string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		s = newStreamForwarderClient(conn, mockGRPCClient, &logger.NullLogger{}, passthrough)
+	}
+
+	AfterEach(func() {
+		conn.Close()
+		grpcServer.Stop()
+	})
+
+	// neverRead keeps streams open without reading them, with small flow control
+	// windows so that sends block as soon as they're full
+	neverRead := func(_ interface{}, stream grpc.ServerStream) error {
+		<-stream.Context().Done()
+		return nil
+	}
+	smallWindows := []grpc.ServerOption{grpc.InitialWindowSize(64 * 1024), grpc.InitialConnWindowSize(64 * 1024)}
+	largeProps := map[string]string{"payload": strings.Repeat("x", 1024*1024)}
+
+	request := func(id string, names ...string) *pb.SendEventsRequest {
+		req := &pb.SendEventsRequest{Id: id}
+		for _, name := range names {
+			req.Events = append(req.Events, &pb.Event{Id: id, Name: name, Topic: "test-topic", Timestamp: 1})
+		}
+		return req
+	}
+
+	It("should send batches on a single stream and match acks by id", func() {
+		startServer(ackAll)
+		res, err := s.SendEvents(context.Background(), request("a", "ok", "fail"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(Equal([]int64{1}))
+		firstStream := s.stream
+
+		res, err = s.SendEvents(context.Background(), request("b", "ok"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(BeEmpty())
+		Expect(s.stream).To(BeIdenticalTo(firstStream))
+	})
+
+	It("should set the rejected indexes of acks on the trailer", func() {
+		startServer(ackAll)
+		var trailer metadata.MD
+		res, err := s.SendEvents(context.Background(), request("a", "invalid", "fail", "ok", "invalid"), grpc.Trailer(&trailer))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(Equal([]int64{1}))
+		Expect(rejectedIndexes(trailer)).To(Equal(map[int64]bool{0: true, 3: true}))
+	})
+
+	It("should reopen the stream after it breaks", func() {
+		calls := 0
+		startServer(func(srv interface{}, stream grpc.ServerStream) error {
+			calls++
+			if calls == 1 {
+				req := &pb.SendEventsRequest{}
+				stream.RecvMsg(req)
+				return io.ErrUnexpectedEOF
+			}
+			return ackAll(srv, stream)
+		})
+		_, err := s.SendEvents(context.Background(), request("a", "ok"))
+		Expect(err).To(HaveOccurred())
+
+		res, err := s.SendEvents(context.Background(), request("a", "ok"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(BeEmpty())
+	})
+
+	It("should return the retry-after of streams ended by the rate limit", func() {
+		startServer(func(_ interface{}, stream grpc.ServerStream) error {
+			stream.RecvMsg(&pb.SendEventsRequest{})
+			stream.SetTrailer(metadata.Pairs(retryAfterMetadata, "1.5"))
+			return status.Error(codes.ResourceExhausted, "caller rate limit exceeded")
+		})
+		_, err := s.SendEvents(context.Background(), request("a", "ok"))
+		var rateLimited *rateLimitedError
+		Expect(errors.As(err, &rateLimited)).To(BeTrue())
+		Expect(rateLimited.retryAfter).To(Equal(1500 * time.Millisecond))
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+	})
+
+	It("should fall back to unary requests if the server doesn't implement the stream", func() {
+		startServer(nil)
+		mockGRPCClient.EXPECT().SendEvents(gomock.Any(), gomock.Any()).
+			Return(&pb.SendEventsResponse{}, nil).Times(2)
+		_, err := s.SendEvents(context.Background(), request("a", "ok"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = s.SendEvents(context.Background(), request("b", "ok"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("should return when ctx is done while the server doesn't read the stream", func() {
+		startServer(neverRead, smallWindows...)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		// the first large request fills the stream, the second blocks sending it
+		errs := make(chan error, 2)
+		for _, id := range []string{"a", "b"} {
+			req := request(id, "ok")
+			req.Events[0].Props = largeProps
+			go func() {
+				_, err := s.SendEvents(ctx, req)
+				errs <- err
+			}()
+		}
+		for i := 0; i < 2; i++ {
+			Eventually(errs, time.Second).Should(Receive(HaveOccurred()))
+		}
+		Eventually(func() *eventsStream {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.stream
+		}).Should(BeNil())
+	})
+
+	It("should shut down by the deadline while the server doesn't read the stream", func() {
+		startServer(neverRead, smallWindows...)
+		config, _ := t.GetDefaultConfig()
+		config.Set("client.grpc.timeout", time.Minute)
+		config.Set("client.batchSize", 1)
+		a, err := newGRPCClientStream("", config, &logger.NullLogger{}, "bufnet", nil, dialOptions()...)
+		Expect(err).NotTo(HaveOccurred())
+		for _, id := range []string{"a", "b"} {
+			Expect(a.send(context.Background(), &pb.Event{
+				Id:        id,
+				Name:      "ok",
+				Topic:     "test-topic",
+				Props:     largeProps,
+				Timestamp: 1,
+			})).To(Succeed())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		report, err := a.Shutdown(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(report).To(Equal(&ShutdownReport{Abandoned: 2}))
+	})
+})
@@ -15,16 +15,16 @@ import (
 	"github.com/topfreegames/eventsgateway/v4/metrics"
 	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"time"
 )
 
 type gRPCClientSync struct {
-	client  pb.GRPCForwarderClient
-	config  *viper.Viper
-	conn    *grpc.ClientConn
-	logger  logger.Logger
-	timeout time.Duration
+	client     pb.GRPCForwarderClient
+	config     *viper.Viper
+	conn       *grpc.ClientConn
+	logger     logger.Logger
+	onDelivery DeliveryCallback
+	timeout    time.Duration
 }
 
 func newGRPCClientSync(
@@ -70,7 +70,6 @@ func (s *gRPCClientSync) configureGRPCForwarderClient(
 
 	dialOpts := append(
 		[]grpc.DialOption{
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
 			grpc.WithChainUnaryInterceptor(
 				s.metricsReporterInterceptor,
 			),
@@ -129,9 +128,21 @@ func (s *gRPCClientSync) send(ctx context.Context, event *pb.Event) error {
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 	_, err := s.client.SendEvent(ctxWithTimeout, event)
+	if s.onDelivery != nil {
+		s.onDelivery(event, err)
+	}
 	return err
 }
 
+func (s *gRPCClientSync) setDeliveryCallback(callback DeliveryCallback) {
+	s.onDelivery = callback
+}
+
+// Shutdown closes client connection, sync clients have no pending events to flush
+func (s *gRPCClientSync) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	return &ShutdownReport{}, s.GracefulStop()
+}
+
 // GracefulStop closes client connection
 func (s *gRPCClientSync) GracefulStop() error {
 	return s.conn.Close()
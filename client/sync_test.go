@@ -83,6 +83,22 @@ var _ = Describe("Sync Client", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(Equal("olar"))
 		})
+
+		It("should report the outcome to the delivery callback", func() {
+			mockGRPCClient.EXPECT().SendEvent(
+				gomock.Any(),
+				gomock.Any(),
+			).Return(nil, errors.New("olar"))
+
+			var reported error
+			c.OnDelivery(func(event *pb.Event, err error) {
+				Expect(event.Name).To(Equal(name))
+				reported = err
+			})
+			err := c.Send(context.Background(), name, props)
+			Expect(err).To(HaveOccurred())
+			Expect(reported).To(Equal(err))
+		})
 	})
 
 	Describe("SendToTopic", func() {
@@ -0,0 +1,67 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// transportCredentials returns the credentials of client.grpc.tls, connections are
+// plaintext unless client.grpc.tls.enabled is true
+func transportCredentials(configPrefix string, config *viper.Viper) (credentials.TransportCredentials, error) {
+	prefix := fmt.Sprintf("%sclient.grpc.tls", configPrefix)
+	key := func(name string) string {
+		return fmt.Sprintf("%s.%s", prefix, name)
+	}
+	caFile := config.GetString(key("caFile"))
+	certFile := config.GetString(key("certFile"))
+	keyFile := config.GetString(key("keyFile"))
+	serverName := config.GetString(key("serverName"))
+	skipVerify := config.GetBool(key("insecureSkipVerify"))
+
+	if !config.GetBool(key("enabled")) {
+		if caFile != "" || certFile != "" || keyFile != "" || serverName != "" || skipVerify {
+			return nil, fmt.Errorf("%s settings are set but %s is false", prefix, key("enabled"))
+		}
+		return insecure.NewCredentials(), nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s and %s should be set together", key("certFile"), key("keyFile"))
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key("caFile"), err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s %s has no PEM certificates", key("caFile"), caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s client certificate: %w", prefix, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
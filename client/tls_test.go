@@ -0,0 +1,136 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var _ = Describe("TLS", func() {
+	var (
+		config    *viper.Viper
+		directory string
+		caFile    string
+		cert      tls.Certificate
+	)
+
+	BeforeEach(func() {
+		config = viper.New()
+		directory = GinkgoT().TempDir()
+
+		// a self-signed certificate for localhost, used as its own CA
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "localhost"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			DNSNames:              []string{"localhost"},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).NotTo(HaveOccurred())
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		cert, err = tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+		Expect(err).NotTo(HaveOccurred())
+		caFile = filepath.Join(directory, "ca.crt")
+		Expect(os.WriteFile(caFile, certPEM, 0o600)).To(Succeed())
+	})
+
+	// sendEvent sends an event to a TLS server that doesn't implement the service, so
+	// the call fails as unimplemented once the handshake succeeds
+	sendEvent := func(creds credentials.TransportCredentials) error {
+		listener := bufconn.Listen(1024 * 1024)
+		grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+		go grpcServer.Serve(listener)
+		defer grpcServer.Stop()
+
+		conn, err := grpc.Dial(
+			"localhost",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(creds),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = pb.NewGRPCForwarderClient(conn).SendEvent(ctx, &pb.Event{Topic: "test-topic"})
+		return err
+	}
+
+	It("should be plaintext by default", func() {
+		creds, err := transportCredentials("", config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds.Info().SecurityProtocol).To(Equal("insecure"))
+	})
+
+	It("should connect to servers signed by caFile", func() {
+		config.Set("eventsgateway.client.grpc.tls.enabled", true)
+		config.Set("eventsgateway.client.grpc.tls.caFile", caFile)
+		creds, err := transportCredentials("eventsgateway.", config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(creds.Info().SecurityProtocol).To(Equal("tls"))
+		Expect(status.Code(sendEvent(creds))).To(Equal(codes.Unimplemented))
+	})
+
+	It("should fail to connect to servers it doesn't trust", func() {
+		config.Set("client.grpc.tls.enabled", true)
+		creds, err := transportCredentials("", config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Code(sendEvent(creds))).To(Equal(codes.Unavailable))
+	})
+
+	It("should fail with inconsistent settings", func() {
+		config.Set("client.grpc.tls.caFile", caFile)
+		_, err := transportCredentials("", config)
+		Expect(err).To(MatchError("client.grpc.tls settings are set but client.grpc.tls.enabled is false"))
+
+		config.Set("client.grpc.tls.enabled", true)
+		config.Set("client.grpc.tls.certFile", caFile)
+		_, err = transportCredentials("", config)
+		Expect(err).To(MatchError("client.grpc.tls.certFile and client.grpc.tls.keyFile should be set together"))
+
+		config.Set("client.grpc.tls.certFile", "")
+		config.Set("client.grpc.tls.caFile", filepath.Join(directory, "missing.crt"))
+		_, err = transportCredentials("", config)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,84 @@
+// MIT License
+//
+// Copyright (c) 2019 Top Free Games
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	logruswrapper "github.com/topfreegames/eventsgateway/v4/logger/logrus"
+	"github.com/topfreegames/eventsgateway/v4/tools"
+)
+
+var replayOpts tools.ReplayOptions
+var replayFrom string
+var replayTo string
+
+// replayCMD represents the replay command
+var replayCMD = &cobra.Command{
+	Use:   "replay",
+	Short: "re-sends events read from a kafka topic or a JSONL file",
+	Long: `re-sends avro events read from a kafka topic, or JSON encoded events read from
+a JSONL file such as the one written by the file dead letter sink, keeping their
+ids and timestamps`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := logrus.New()
+		if debug {
+			log.SetLevel(logrus.DebugLevel)
+		}
+		if json {
+			log.Formatter = new(logrus.JSONFormatter)
+		}
+		var err error
+		if replayFrom != "" {
+			if replayOpts.From, err = time.Parse(time.RFC3339, replayFrom); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if replayTo != "" {
+			if replayOpts.To, err = time.Parse(time.RFC3339, replayTo); err != nil {
+				log.Fatal(err)
+			}
+		}
+		r, err := tools.NewReplay(logruswrapper.NewWithLogger(log), config, replayOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := r.Run(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	replayCMD.Flags().StringVar(&replayOpts.File, "file", "", "JSONL file of events or dead letters to replay")
+	replayCMD.Flags().StringVar(&replayOpts.KafkaTopic, "kafka-topic", "", "full name of the kafka topic to replay, brokers are read from replay.kafka.brokers")
+	replayCMD.Flags().StringVar(&replayOpts.Topic, "topic", "", "only replay events of this topic")
+	replayCMD.Flags().StringVar(&replayOpts.Name, "name", "", "only replay events with this name")
+	replayCMD.Flags().StringVar(&replayFrom, "from", "", "only replay events sent at or after this RFC3339 time")
+	replayCMD.Flags().StringVar(&replayTo, "to", "", "only replay events sent at or before this RFC3339 time")
+	replayCMD.Flags().Float64Var(&replayOpts.Rate, "rate", 0, "max events sent per second, unlimited if 0")
+	replayCMD.Flags().BoolVar(&replayOpts.DryRun, "dry-run", false, "print the events that would be sent instead of sending them")
+	RootCmd.AddCommand(replayCMD)
+}
@@ -0,0 +1,141 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var _ = Describe("Load shedding", func() {
+	var (
+		grpcServer *grpc.Server
+		conn       *grpc.ClientConn
+		client     pb.GRPCForwarderClient
+		admission  *sender.AdmissionController
+	)
+
+	start := func(maxInFlight int, maxLatency, window time.Duration) {
+		admission = sender.NewAdmissionController(maxInFlight, maxLatency, window)
+		kafkaSender := newKafkaSender(initConfig())
+		kafkaSender.SetAdmissionController(admission)
+
+		listener := bufconn.Listen(1024 * 1024)
+		grpcServer = grpc.NewServer(
+			grpc.UnaryInterceptor(admission.UnaryInterceptor),
+			grpc.StreamInterceptor(admission.StreamInterceptor),
+		)
+		s := app.NewServer(kafkaSender, log)
+		pb.RegisterGRPCForwarderServer(grpcServer, s)
+		grpcServer.RegisterService(&app.StreamServiceDesc, s)
+		go grpcServer.Serve(listener)
+
+		var err error
+		conn, err = grpc.Dial(
+			"bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		client = pb.NewGRPCForwarderClient(conn)
+	}
+
+	AfterEach(func() {
+		// specs that don't start the server leave them nil
+		if conn != nil {
+			conn.Close()
+			grpcServer.Stop()
+			conn, grpcServer = nil, nil
+		}
+	})
+
+	newEvent := func(id string) *pb.Event {
+		return &pb.Event{Id: id, Name: "someName", Topic: "sometopic", Props: map[string]string{}, Timestamp: 1}
+	}
+
+	It("should reject requests while too many events are being produced", func() {
+		start(1, 0, time.Minute)
+		release := make(chan struct{})
+		mockForwarder.EXPECT().Produce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(string, string, map[string]string, []byte) (int32, int64, error) {
+				<-release
+				return 0, 0, nil
+			}).Times(2)
+
+		sent := make(chan error, 1)
+		go func() {
+			_, err := client.SendEvent(context.Background(), newEvent("1"))
+			sent <- err
+		}()
+		Eventually(admission.InFlight).Should(Equal(int64(1)))
+
+		_, err := client.SendEvent(context.Background(), newEvent("2"))
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+		stream, err := conn.NewStream(
+			context.Background(),
+			&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			app.SendEventsStreamMethod,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		err = stream.RecvMsg(&app.SendEventsAck{})
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+		Expect(testutil.ToFloat64(metrics.LoadShedding.WithLabelValues(sender.SheddingConcurrency))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(metrics.ShedRequestsCounter.WithLabelValues(
+			"/eventsgateway.GRPCForwarder/SendEvent", sender.SheddingConcurrency,
+		))).To(Equal(float64(1)))
+
+		close(release)
+		Expect(<-sent).NotTo(HaveOccurred())
+		_, err = client.SendEvent(context.Background(), newEvent("3"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testutil.ToFloat64(metrics.LoadShedding.WithLabelValues(sender.SheddingConcurrency))).To(Equal(float64(0)))
+	})
+
+	It("should reject requests while producing is slow and admit them again once it's not", func() {
+		window := 100 * time.Millisecond
+		start(0, 10*time.Millisecond, window)
+		mockForwarder.EXPECT().Produce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(string, string, map[string]string, []byte) (int32, int64, error) {
+				time.Sleep(20 * time.Millisecond)
+				return 0, 0, nil
+			}).Times(1)
+
+		_, err := client.SendEvent(context.Background(), newEvent("1"))
+		Expect(err).NotTo(HaveOccurred())
+		// the latency is only considered once its window ends
+		Eventually(admission.Shedding, window*2).Should(Equal(sender.SheddingLatency))
+		_, err = client.SendEvent(context.Background(), newEvent("2"))
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+		Expect(testutil.ToFloat64(metrics.LoadShedding.WithLabelValues(sender.SheddingLatency))).To(Equal(float64(1)))
+
+		// a window without produce calls doesn't keep requests rejected
+		Eventually(admission.Shedding, window*3).Should(BeEmpty())
+	})
+
+	It("should fail to create the app without a window", func() {
+		cfg := initConfig()
+		cfg.Set("forwarder.type", "stdout")
+		cfg.Set("loadShedding.enabled", true)
+		cfg.Set("loadShedding.window", "0s")
+		_, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(MatchError("loadShedding.window should be positive"))
+	})
+})
@@ -24,7 +24,9 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -54,6 +56,7 @@ import (
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 
 	"github.com/spf13/viper"
@@ -62,12 +65,18 @@ import (
 
 // App is the app structure
 type App struct {
-	Server     *Server // tests manipulate this field
-	config     *viper.Viper
-	grpcServer *grpc.Server
-	host       string
-	log        logger.Logger
-	port       int
+	Server        *Server // tests manipulate this field
+	authenticator *Authenticator
+	rateLimiter   *RateLimiter
+	admission     *sender.AdmissionController
+	health        *Health
+	forwarders    []forwarder.Forwarder
+	config        *viper.Viper
+	grpcServer    *grpc.Server
+	host          string
+	log           logger.Logger
+	port          int
+	tlsConfig     *tls.Config
 }
 
 // NewApp creates a new App object
@@ -89,6 +98,8 @@ func (a *App) configure() error {
 	a.config.SetDefault("kafka.producer.net.readTimeout", "250ms")
 	a.config.SetDefault("kafka.producer.net.writeTimeout", "250ms")
 	a.config.SetDefault("kafka.producer.idempotent", false)
+	a.config.SetDefault("kafka.producer.mode", forwarder.ProducerModeSync)
+	a.config.SetDefault("kafka.producer.partitioner", forwarder.PartitionerHash)
 	a.config.SetDefault("kafka.producer.net.keepAlive", "60s")
 	a.config.SetDefault("kafka.producer.brokers", "localhost:9192")
 	a.config.SetDefault("kafka.producer.maxMessageBytes", 1000000)
@@ -98,11 +109,54 @@ func (a *App) configure() error {
 	a.config.SetDefault("kafka.producer.retry.max", 0)
 	a.config.SetDefault("kafka.producer.clientId", "eventsgateway")
 	a.config.SetDefault("kafka.producer.topicPrefix", "sv-uploads-")
+	a.config.SetDefault("kafka.producer.secondary.brokers", "")
+	a.config.SetDefault("kafka.producer.failover.errorRate", 0.5)
+	a.config.SetDefault("kafka.producer.failover.window", "30s")
+	a.config.SetDefault("kafka.producer.failover.minRequests", 20)
+	a.config.SetDefault("kafka.producer.failover.unavailableFor", "10s")
+	a.config.SetDefault("kafka.producer.failover.checkInterval", "5s")
+	a.config.SetDefault("kafka.producer.failover.recoveryChecks", 3)
+	a.config.SetDefault("forwarder.type", forwarder.TypeKafka)
+	a.config.SetDefault("forwarder.file.directory", "events")
+	a.config.SetDefault("forwarder.file.format", forwarder.FileFormatJSONL)
+	a.config.SetDefault("forwarder.file.maxBytes", 100*1024*1024)
+	a.config.SetDefault("forwarder.file.maxAge", "1h")
+	a.config.SetDefault("forwarder.http.url", "")
+	a.config.SetDefault("forwarder.http.contentType", "application/octet-stream")
+	a.config.SetDefault("forwarder.http.timeout", "1s")
 	a.config.SetDefault("server.maxConnectionIdle", "20s")
 	a.config.SetDefault("server.maxConnectionAge", "20s")
 	a.config.SetDefault("server.maxConnectionAgeGrace", "5s")
 	a.config.SetDefault("server.Time", "10s")
 	a.config.SetDefault("server.Timeout", "500ms")
+	a.config.SetDefault("server.drainDelay", "5s")
+	a.config.SetDefault("server.stream.maxInFlight", DefaultStreamMaxInFlight)
+	a.config.SetDefault("server.stream.maxInFlightTotal", DefaultStreamMaxInFlightTotal)
+	a.config.SetDefault("server.tls.enabled", false)
+	a.config.SetDefault("server.tls.certFile", "")
+	a.config.SetDefault("server.tls.keyFile", "")
+	a.config.SetDefault("server.tls.clientCAFile", "")
+	a.config.SetDefault("server.tls.reloadInterval", "1m")
+	a.config.SetDefault("auth.enabled", false)
+	a.config.SetDefault("auth.jwt.secret", "")
+	a.config.SetDefault("auth.jwt.publicKeyFile", "")
+	a.config.SetDefault("auth.jwt.issuer", "")
+	a.config.SetDefault("auth.jwt.audience", "")
+	a.config.SetDefault("auth.jwt.leeway", "30s")
+	a.config.SetDefault("auth.jwt.tenantClaim", "sub")
+	a.config.SetDefault("auth.jwt.topicsClaim", "topics")
+	a.config.SetDefault("rateLimit.enabled", false)
+	a.config.SetDefault("rateLimit.topic.rate", 0)
+	a.config.SetDefault("rateLimit.topic.burst", 0)
+	a.config.SetDefault("rateLimit.caller.rate", 0)
+	a.config.SetDefault("rateLimit.caller.burst", 0)
+	a.config.SetDefault("rateLimit.idleTimeout", "10m")
+	a.config.SetDefault("loadShedding.enabled", false)
+	a.config.SetDefault("loadShedding.maxInFlight", 0)
+	a.config.SetDefault("loadShedding.maxLatency", 0)
+	a.config.SetDefault("loadShedding.window", "10s")
+	a.config.SetDefault("health.topics", []string{})
+	a.config.SetDefault("health.checkInterval", "5s")
 	a.config.SetDefault("prometheus.enabled", "true") // always true on the API side
 	a.config.SetDefault("prometheus.port", ":9091")
 
@@ -112,7 +166,24 @@ func (a *App) configure() error {
 		}
 	}
 
-	err := a.configureEventsForwarder()
+	tlsConfig, err := newServerTLSConfig(a.config, a.log)
+	if err != nil {
+		return err
+	}
+	a.tlsConfig = tlsConfig
+
+	if a.config.GetBool("auth.enabled") {
+		if a.authenticator, err = NewAuthenticator(a.config, a.log); err != nil {
+			return err
+		}
+	}
+	if a.config.GetBool("rateLimit.enabled") {
+		if a.rateLimiter, err = NewRateLimiter(a.config); err != nil {
+			return err
+		}
+	}
+
+	err = a.configureEventsForwarder()
 	if err != nil {
 		return err
 	}
@@ -164,15 +235,156 @@ func (a *App) configureOTel() error {
 
 func (a *App) configureEventsForwarder() error {
 	goMetrics.UseNilMetrics = true
-	k, err := forwarder.NewKafkaForwarder(a.config)
+	k, err := newForwarder(a.config)
 	if err != nil {
 		return err
 	}
-	kafkaSender := sender.NewKafkaSender(k, a.log, a.config)
+	a.forwarders = append(a.forwarders, k)
+	// the kafka sink produces JSON dead letters through the forwarder, other forwarders
+	// might expect avro messages
+	if a.config.GetString("deadLetter.sink") == sender.DeadLetterSinkKafka &&
+		a.config.GetString("forwarder.type") != forwarder.TypeKafka {
+		return fmt.Errorf("deadLetter.sink %s requires forwarder.type %s", sender.DeadLetterSinkKafka, forwarder.TypeKafka)
+	}
+	kafkaSender, err := sender.NewKafkaSender(k, a.log, a.config)
+	if err != nil {
+		return err
+	}
+	router, err := a.newRouter(k)
+	if err != nil {
+		return err
+	}
+	if router != nil {
+		kafkaSender.SetRouter(router)
+	}
+	if a.config.GetBool("loadShedding.enabled") {
+		if a.config.GetDuration("loadShedding.window") <= 0 {
+			return fmt.Errorf("loadShedding.window should be positive")
+		}
+		a.admission = sender.NewAdmissionController(
+			a.config.GetInt("loadShedding.maxInFlight"),
+			a.config.GetDuration("loadShedding.maxLatency"),
+			a.config.GetDuration("loadShedding.window"),
+		)
+		kafkaSender.SetAdmissionController(a.admission)
+	}
+	if a.config.GetDuration("health.checkInterval") <= 0 {
+		return fmt.Errorf("health.checkInterval should be positive")
+	}
+	a.health = NewHealth(
+		k,
+		a.config.GetStringSlice("health.topics"),
+		a.config.GetDuration("health.checkInterval"),
+		a.log,
+	)
 	a.Server = NewServer(kafkaSender, a.log)
+	maxInFlight := a.config.GetInt("server.stream.maxInFlight")
+	maxInFlightTotal := a.config.GetInt("server.stream.maxInFlightTotal")
+	if maxInFlight <= 0 || maxInFlightTotal <= 0 {
+		return fmt.Errorf("server.stream.maxInFlight and server.stream.maxInFlightTotal should be positive")
+	}
+	a.Server.SetStreamLimits(maxInFlight, maxInFlightTotal)
 	return nil
 }
 
+// newRouter returns the Router of the sinks and rules under routing, or nil if there
+// are none, so events are only produced to the forwarder of forwarder.type
+func (a *App) newRouter(defaultForwarder forwarder.Forwarder) (*sender.Router, error) {
+	var sinkConfigs []sender.SinkConfig
+	if err := a.config.UnmarshalKey("routing.sinks", &sinkConfigs); err != nil {
+		return nil, err
+	}
+	var rules []sender.RouteRule
+	if err := a.config.UnmarshalKey("routing.rules", &rules); err != nil {
+		return nil, err
+	}
+	if len(sinkConfigs) == 0 && len(rules) == 0 && !a.config.IsSet("routing.defaultSinks") {
+		return nil, nil
+	}
+
+	sinks := map[string]sender.Sink{
+		sender.DefaultSink: {Forwarder: defaultForwarder, Required: true},
+	}
+	for _, sinkConfig := range sinkConfigs {
+		if _, ok := sinks[sinkConfig.Name]; ok || sinkConfig.Name == "" {
+			return nil, fmt.Errorf("sinks should have unique names, got %q", sinkConfig.Name)
+		}
+		// sinks inherit the server config, so they only need to set what's different
+		config := viper.New()
+		for _, key := range a.config.AllKeys() {
+			config.SetDefault(key, a.config.Get(key))
+		}
+		if err := config.MergeConfigMap(sinkConfig.Config); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sinkConfig.Name, err)
+		}
+		config.Set("forwarder.type", sinkConfig.Type)
+		f, err := newForwarder(config)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sinkConfig.Name, err)
+		}
+		a.forwarders = append(a.forwarders, f)
+		sinks[sinkConfig.Name] = sender.Sink{Forwarder: f, Required: sinkConfig.Required}
+	}
+
+	defaultSinks := []string{sender.DefaultSink}
+	if a.config.IsSet("routing.defaultSinks") {
+		defaultSinks = a.config.GetStringSlice("routing.defaultSinks")
+	}
+	return sender.NewRouter(sinks, defaultSinks, rules)
+}
+
+// newForwarder returns the forwarder of forwarder.type
+func newForwarder(config *viper.Viper) (forwarder.Forwarder, error) {
+	switch forwarderType := config.GetString("forwarder.type"); forwarderType {
+	case forwarder.TypeKafka:
+		if config.GetString("kafka.producer.secondary.brokers") != "" {
+			return forwarder.NewFailoverKafkaForwarder(config)
+		}
+		return forwarder.NewKafkaForwarder(config)
+	case forwarder.TypeFile:
+		format := config.GetString("forwarder.file.format")
+		if format == forwarder.FileFormatAvro && !onlyAvroSerializers(config) {
+			return nil, fmt.Errorf("forwarder.file.format %s requires the %s serializer on all topics", format, sender.SerializerAvro)
+		}
+		return forwarder.NewFileForwarder(
+			config.GetString("forwarder.file.directory"),
+			format,
+			config.GetInt64("forwarder.file.maxBytes"),
+			config.GetDuration("forwarder.file.maxAge"),
+		)
+	case forwarder.TypeHTTP:
+		webhookURL := config.GetString("forwarder.http.url")
+		if webhookURL == "" {
+			return nil, fmt.Errorf("no webhook url informed at forwarder.http.url")
+		}
+		return forwarder.NewHTTPForwarder(
+			webhookURL,
+			config.GetString("forwarder.http.contentType"),
+			config.GetDuration("forwarder.http.timeout"),
+		), nil
+	case forwarder.TypeStdout:
+		return forwarder.NewStdoutForwarder(os.Stdout), nil
+	default:
+		return nil, fmt.Errorf(
+			"invalid forwarder.type %q, should be %s, %s, %s or %s",
+			forwarderType, forwarder.TypeKafka, forwarder.TypeFile, forwarder.TypeHTTP, forwarder.TypeStdout,
+		)
+	}
+}
+
+// onlyAvroSerializers returns whether all topics are serialized with the avro serializer
+func onlyAvroSerializers(config *viper.Viper) bool {
+	if s := config.GetString("kafka.producer.serializer.default"); s != "" && s != sender.SerializerAvro {
+		return false
+	}
+	for _, s := range config.GetStringMapString("kafka.producer.serializer.topics") {
+		if s != sender.SerializerAvro {
+			return false
+		}
+	}
+	return true
+}
+
 // metricsReporterInterceptor interceptor
 func (a *App) metricsReporterInterceptor(
 	ctx context.Context,
@@ -182,7 +394,7 @@ func (a *App) metricsReporterInterceptor(
 ) (interface{}, error) {
 	events := []*pb.Event{}
 	payloadSize := 0
-	switch t := req.(type) {
+	switch req.(type) {
 	case *pb.Event:
 		event := req.(*pb.Event)
 		events = append(events, event)
@@ -192,7 +404,11 @@ func (a *App) metricsReporterInterceptor(
 		events = append(events, request.Events...)
 		payloadSize = proto.Size(request)
 	default:
-		a.log.WithField("route", info.FullMethod).Infof("Unexpected request type %T", t)
+		// like the health checks
+		return handler(ctx, req)
+	}
+	if len(events) == 0 {
+		return handler(ctx, req)
 	}
 
 	topic := fmt.Sprintf("%s%s", a.config.GetString("kafka.producer.topicPrefix"), events[0].Topic)
@@ -223,24 +439,39 @@ func (a *App) metricsReporterInterceptor(
 	return res, nil
 }
 
-// Run runs the app
-func (a *App) Run() {
-
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", a.host, a.port))
-	if err != nil {
-		a.log.Panic(err.Error())
+// GRPCServer returns the grpc server Run serves, with the interceptors and services
+// of the app, it's created on the first call
+func (a *App) GRPCServer() *grpc.Server {
+	if a.grpcServer != nil {
+		return a.grpcServer
 	}
-	a.log.Infof("events gateway listening on %s:%d", a.host, a.port)
-
-	metrics.StartServer(a.config)
 	var opts []grpc.ServerOption
 
 	otelPropagator := otelgrpc.WithPropagators(otel.GetTextMapPropagator())
 	otelTracerProvider := otelgrpc.WithTracerProvider(otel.GetTracerProvider())
 
+	unaryInterceptors := []grpc.UnaryServerInterceptor{a.metricsReporterInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{a.streamMetricsReporterInterceptor}
+	// the health checks are exempt from the interceptors below, so probes don't need
+	// credentials and aren't rejected while shedding load
+	if a.authenticator != nil {
+		unaryInterceptors = append(unaryInterceptors, unaryExceptHealth(a.authenticator.UnaryInterceptor))
+		streamInterceptors = append(streamInterceptors, streamExceptHealth(a.authenticator.StreamInterceptor))
+	}
+	if a.rateLimiter != nil {
+		// after the authenticator, so callers are limited by their tenant
+		unaryInterceptors = append(unaryInterceptors, unaryExceptHealth(a.rateLimiter.UnaryInterceptor))
+		streamInterceptors = append(streamInterceptors, streamExceptHealth(a.rateLimiter.StreamInterceptor))
+	}
+	if a.admission != nil {
+		unaryInterceptors = append(unaryInterceptors, unaryExceptHealth(a.admission.UnaryInterceptor))
+		streamInterceptors = append(streamInterceptors, streamExceptHealth(a.admission.StreamInterceptor))
+	}
+
 	opts = append(
 		opts,
-		grpc.UnaryInterceptor(a.metricsReporterInterceptor),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
 		grpc.StatsHandler(otelgrpc.NewServerHandler(otelPropagator, otelTracerProvider)),
 		grpc.KeepaliveParams(keepalive.ServerParameters{
 			MaxConnectionIdle:     a.config.GetDuration("server.maxConnectionIdle"),
@@ -249,26 +480,71 @@ func (a *App) Run() {
 			Time:                  a.config.GetDuration("server.Time"),
 			Timeout:               a.config.GetDuration("server.Timeout"),
 		}))
+	if a.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(a.tlsConfig)))
+	}
 
 	a.grpcServer = grpc.NewServer(opts...)
 
 	pb.RegisterGRPCForwarderServer(a.grpcServer, a.Server)
+	a.grpcServer.RegisterService(&StreamServiceDesc, a.Server)
+	a.health.Register(a.grpcServer)
+	return a.grpcServer
+}
+
+// Health returns the health of the app, which Run starts checking
+func (a *App) Health() *Health {
+	return a.health
+}
+
+// GracefulStop reports NOT_SERVING and waits server.drainDelay, so load balancers
+// stop sending requests before the listeners are closed, then gracefully stops the
+// grpc server and closes the sender and the forwarders
+func (a *App) GracefulStop() {
+	a.health.Shutdown()
+	drainDelay := a.config.GetDuration("server.drainDelay")
+	a.log.Infof("Waiting %s for load balancers to drain...", drainDelay)
+	time.Sleep(drainDelay)
+	a.GRPCServer().GracefulStop()
+	if closer, ok := a.Server.sender.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			a.log.WithError(err).Error("failed to close sender")
+		}
+	}
+	for _, f := range a.forwarders {
+		if closer, ok := f.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				a.log.WithError(err).Error("failed to close forwarder")
+			}
+		}
+	}
+}
+
+// Run runs the app
+func (a *App) Run() {
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", a.host, a.port))
+	if err != nil {
+		a.log.Panic(err.Error())
+	}
+	a.log.Infof("events gateway listening on %s:%d", a.host, a.port)
+
+	metrics.StartServer(a.config, a.health.Routes()...)
+	grpcServer := a.GRPCServer()
+	a.health.Start()
 	var stopChan = make(chan os.Signal, 2)
 
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
 	var errChan = make(chan error)
 
 	go func() {
-		if err := a.grpcServer.Serve(listener); err != nil {
+		if err := grpcServer.Serve(listener); err != nil {
 			errChan <- err
 		}
 	}()
 
 	defer func() {
-		gracefulShutdowDuration := a.config.GetDuration("server.maxConnectionAge") + a.config.GetDuration("server.maxConnectionAgeGrace")
-		a.log.Infof("Waiting %s for graceful stop...", gracefulShutdowDuration)
-		a.grpcServer.GracefulStop()
-		time.Sleep(gracefulShutdowDuration)
+		a.GracefulStop()
 		a.log.Info("Finished GRPC graceful stop...")
 	}()
 	select {
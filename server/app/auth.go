@@ -0,0 +1,223 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/logger"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys of the credentials, the token goes as "Bearer <token>"
+const (
+	APIKeyMetadata        = "x-api-key"
+	AuthorizationMetadata = "authorization"
+)
+
+// AllTopics in the topics of a credential allows it to send events to any topic
+const AllTopics = "*"
+
+// APIKey is a key in auth.apiKeys
+type APIKey struct {
+	Key    string
+	Tenant string
+	Topics []string
+}
+
+// Caller is who sent a request, as authenticated by its credential
+type Caller struct {
+	Tenant string
+	Topics []string
+}
+
+// Allows returns whether the caller can send events to topic, topics are compared
+// ignoring case like the other per-topic settings
+func (c *Caller) Allows(topic string) bool {
+	for _, t := range c.Topics {
+		if t == AllTopics || strings.EqualFold(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+type callerKey struct{}
+
+// CallerFromContext returns the caller authenticated by the Authenticator, if any
+func CallerFromContext(ctx context.Context) (*Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(*Caller)
+	return caller, ok
+}
+
+// Authenticator authenticates requests by the API key or the JSON Web Token in their
+// metadata, rejecting events of topics the caller isn't allowed to send
+type Authenticator struct {
+	apiKeys     map[string]*Caller
+	jwt         *jwtVerifier
+	tenantClaim string
+	topicsClaim string
+	log         logger.Logger
+}
+
+// NewAuthenticator returns the Authenticator of the API keys and tokens accepted by auth
+func NewAuthenticator(config *viper.Viper, log logger.Logger) (*Authenticator, error) {
+	var apiKeys []APIKey
+	if err := config.UnmarshalKey("auth.apiKeys", &apiKeys); err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		apiKeys:     map[string]*Caller{},
+		tenantClaim: config.GetString("auth.jwt.tenantClaim"),
+		topicsClaim: config.GetString("auth.jwt.topicsClaim"),
+		log:         log.WithField("source", "app/auth"),
+	}
+	for _, apiKey := range apiKeys {
+		if apiKey.Key == "" || apiKey.Tenant == "" {
+			return nil, errors.New("auth.apiKeys should have a key and a tenant")
+		}
+		if _, ok := a.apiKeys[apiKey.Key]; ok {
+			return nil, fmt.Errorf("auth.apiKeys has a repeated key for tenant %s", apiKey.Tenant)
+		}
+		a.apiKeys[apiKey.Key] = &Caller{Tenant: apiKey.Tenant, Topics: apiKey.Topics}
+	}
+
+	secret := config.GetString("auth.jwt.secret")
+	publicKeyFile := config.GetString("auth.jwt.publicKeyFile")
+	if secret != "" || publicKeyFile != "" {
+		v, err := newJWTVerifier(
+			secret,
+			publicKeyFile,
+			config.GetString("auth.jwt.issuer"),
+			config.GetString("auth.jwt.audience"),
+			config.GetDuration("auth.jwt.leeway"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	if len(a.apiKeys) == 0 && a.jwt == nil {
+		return nil, errors.New("auth.enabled requires auth.apiKeys or auth.jwt")
+	}
+	return a, nil
+}
+
+// Authenticate returns the caller of the credential in the metadata of ctx
+func (a *Authenticator) Authenticate(ctx context.Context) (*Caller, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if keys := md.Get(APIKeyMetadata); len(keys) > 0 {
+		if caller, ok := a.apiKeys[keys[0]]; ok {
+			return caller, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid api key")
+	}
+	if authorization := md.Get(AuthorizationMetadata); len(authorization) > 0 && a.jwt != nil {
+		token, ok := strings.CutPrefix(authorization[0], "Bearer ")
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "authorization should be a bearer token")
+		}
+		claims, err := a.jwt.verify(token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		tenant, _ := claims[a.tenantClaim].(string)
+		if tenant == "" {
+			return nil, status.Errorf(codes.Unauthenticated, "token without the %s claim", a.tenantClaim)
+		}
+		return &Caller{Tenant: tenant, Topics: stringsClaim(claims, a.topicsClaim)}, nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "no credentials informed")
+}
+
+// authorize returns the PermissionDenied error of the first event caller can't send
+func (a *Authenticator) authorize(caller *Caller, events []*pb.Event) error {
+	for _, event := range events {
+		if !caller.Allows(event.GetTopic()) {
+			a.log.WithFields(map[string]interface{}{
+				"tenant": caller.Tenant,
+				"topic":  event.GetTopic(),
+			}).Warn("caller not allowed to send events to topic")
+			return status.Errorf(codes.PermissionDenied, "not allowed to send events to topic %s", event.GetTopic())
+		}
+	}
+	return nil
+}
+
+// UnaryInterceptor authenticates SendEvent and SendEvents requests
+func (a *Authenticator) UnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	caller, err := a.Authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var events []*pb.Event
+	switch r := req.(type) {
+	case *pb.Event:
+		events = []*pb.Event{r}
+	case *pb.SendEventsRequest:
+		events = r.Events
+	}
+	if err := a.authorize(caller, events); err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, callerKey{}, caller), req)
+}
+
+// StreamInterceptor authenticates streams when they're opened and checks the topics
+// of every batch received on them, ending the stream on the first one not allowed
+func (a *Authenticator) StreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	caller, err := a.Authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authServerStream{
+		ServerStream:  ss,
+		ctx:           context.WithValue(ss.Context(), callerKey{}, caller),
+		caller:        caller,
+		authenticator: a,
+	})
+}
+
+type authServerStream struct {
+	grpc.ServerStream
+	ctx           context.Context
+	caller        *Caller
+	authenticator *Authenticator
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authServerStream) RecvMsg(msg interface{}) error {
+	if err := s.ServerStream.RecvMsg(msg); err != nil {
+		return err
+	}
+	if req, ok := msg.(*pb.SendEventsRequest); ok {
+		return s.authenticator.authorize(s.caller, req.Events)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// signJWT returns a token with claims, signed with HS256 if key is a secret or with
+// ES256 if it's an ECDSA P-256 key
+func signJWT(claims map[string]interface{}, key interface{}) string {
+	method := jwt.SigningMethod(jwt.SigningMethodHS256)
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+	token, err := jwt.NewWithClaims(method, jwt.MapClaims(claims)).SignedString(key)
+	Expect(err).NotTo(HaveOccurred())
+	return token
+}
+
+var _ = Describe("Auth", func() {
+	var (
+		cfg        *viper.Viper
+		grpcServer *grpc.Server
+		conn       *grpc.ClientConn
+		client     pb.GRPCForwarderClient
+		secret     = []byte("some-secret")
+	)
+
+	start := func() {
+		authenticator, err := app.NewAuthenticator(cfg, log)
+		Expect(err).NotTo(HaveOccurred())
+
+		listener := bufconn.Listen(1024 * 1024)
+		s := app.NewServer(newKafkaSender(initConfig()), log)
+		grpcServer = grpc.NewServer(
+			grpc.UnaryInterceptor(authenticator.UnaryInterceptor),
+			grpc.StreamInterceptor(authenticator.StreamInterceptor),
+		)
+		pb.RegisterGRPCForwarderServer(grpcServer, s)
+		grpcServer.RegisterService(&app.StreamServiceDesc, s)
+		go grpcServer.Serve(listener)
+
+		conn, err = grpc.Dial(
+			"bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		client = pb.NewGRPCForwarderClient(conn)
+	}
+
+	BeforeEach(func() {
+		conn = nil
+		cfg = viper.New()
+		cfg.SetDefault("auth.jwt.tenantClaim", "sub")
+		cfg.SetDefault("auth.jwt.topicsClaim", "topics")
+		cfg.SetDefault("auth.jwt.leeway", "30s")
+		cfg.Set("auth.apiKeys", []map[string]interface{}{
+			{"key": "game-key", "tenant": "game", "topics": []string{"purchases", "Logins"}},
+			{"key": "admin-key", "tenant": "admin", "topics": []string{app.AllTopics}},
+		})
+		cfg.Set("auth.jwt.secret", string(secret))
+		cfg.Set("auth.jwt.issuer", "auth-server")
+	})
+
+	AfterEach(func() {
+		if conn != nil {
+			conn.Close()
+			grpcServer.Stop()
+		}
+	})
+
+	withAPIKey := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), app.APIKeyMetadata, key)
+	}
+
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), app.AuthorizationMetadata, "Bearer "+token)
+	}
+
+	newEvent := func(topic string) *pb.Event {
+		return &pb.Event{Id: "someid", Name: "someName", Topic: topic, Props: map[string]string{}, Timestamp: 1}
+	}
+
+	It("should only accept events of the topics allowed to the api key", func() {
+		start()
+		mockForwarder.EXPECT().Produce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(3)
+
+		_, err := client.SendEvent(withAPIKey("game-key"), newEvent("purchases"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.SendEvent(withAPIKey("game-key"), newEvent("logins"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.SendEvent(withAPIKey("admin-key"), newEvent("anything"))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.SendEvent(withAPIKey("game-key"), newEvent("anything"))
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+		_, err = client.SendEvents(withAPIKey("game-key"), &pb.SendEventsRequest{
+			Events: []*pb.Event{newEvent("purchases"), newEvent("anything")},
+		})
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+	})
+
+	It("should reject requests without valid credentials", func() {
+		start()
+
+		_, err := client.SendEvent(context.Background(), newEvent("purchases"))
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		_, err = client.SendEvent(withAPIKey("unknown-key"), newEvent("purchases"))
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		_, err = client.SendEvent(withToken("not.a.token"), newEvent("purchases"))
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+	})
+
+	It("should accept tokens signed with the secret", func() {
+		start()
+		mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+		claims := map[string]interface{}{
+			"sub":    "game",
+			"iss":    "auth-server",
+			"exp":    time.Now().Add(time.Minute).Unix(),
+			"topics": "purchases logins",
+		}
+
+		_, err := client.SendEvent(withToken(signJWT(claims, secret)), newEvent("purchases"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.SendEvent(withToken(signJWT(claims, secret)), newEvent("anything"))
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+		_, err = client.SendEvent(withToken(signJWT(claims, []byte("other-secret"))), newEvent("purchases"))
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+
+		claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		_, err = client.SendEvent(withToken(signJWT(claims, secret)), newEvent("purchases"))
+		Expect(err).To(MatchError(ContainSubstring("token is expired")))
+
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		claims["iss"] = "someone-else"
+		_, err = client.SendEvent(withToken(signJWT(claims, secret)), newEvent("purchases"))
+		Expect(err).To(MatchError(ContainSubstring("token has invalid issuer")))
+	})
+
+	It("should reject tokens without a numeric exp", func() {
+		start()
+		claims := map[string]interface{}{"sub": "game", "iss": "auth-server", "topics": "purchases"}
+		_, err := client.SendEvent(withToken(signJWT(claims, secret)), newEvent("purchases"))
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		Expect(err).To(MatchError(ContainSubstring("exp claim is required")))
+
+		claims["exp"] = "never"
+		_, err = client.SendEvent(withToken(signJWT(claims, secret)), newEvent("purchases"))
+		Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+		Expect(err).To(MatchError(ContainSubstring("exp is invalid")))
+	})
+
+	It("should accept tokens signed with the key of publicKeyFile", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		Expect(err).NotTo(HaveOccurred())
+		publicKeyFile := filepath.Join(GinkgoT().TempDir(), "public.pem")
+		Expect(os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)).To(Succeed())
+		cfg.Set("auth.jwt.secret", "")
+		cfg.Set("auth.jwt.publicKeyFile", publicKeyFile)
+		start()
+		mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+		claims := map[string]interface{}{
+			"sub":    "game",
+			"iss":    "auth-server",
+			"exp":    time.Now().Add(time.Minute).Unix(),
+			"topics": []string{"purchases"},
+		}
+
+		_, err = client.SendEvent(withToken(signJWT(claims, key)), newEvent("purchases"))
+		Expect(err).NotTo(HaveOccurred())
+		// a HMAC signature made with the public key mustn't be accepted
+		_, err = client.SendEvent(withToken(signJWT(claims, der)), newEvent("purchases"))
+		Expect(err).To(MatchError(ContainSubstring("signing method HS256 is invalid")))
+
+		// nor an ES384 signature made with the P-256 key, ES384 is for P-384 keys only
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodES384, jwt.MapClaims(claims)).SigningString()
+		Expect(err).NotTo(HaveOccurred())
+		digest := sha512.Sum384([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		Expect(err).NotTo(HaveOccurred())
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		_, err = client.SendEvent(withToken(signed+"."+base64.RawURLEncoding.EncodeToString(signature)), newEvent("purchases"))
+		Expect(err).To(MatchError(ContainSubstring("signing method ES384 is invalid")))
+	})
+
+	It("should fail with an ECDSA key of an unsupported curve", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		Expect(err).NotTo(HaveOccurred())
+		publicKeyFile := filepath.Join(GinkgoT().TempDir(), "public.pem")
+		Expect(os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)).To(Succeed())
+		cfg.Set("auth.jwt.secret", "")
+		cfg.Set("auth.jwt.publicKeyFile", publicKeyFile)
+		_, err = app.NewAuthenticator(cfg, log)
+		Expect(err).To(MatchError(ContainSubstring("unsupported curve P-224")))
+	})
+
+	It("should end streams on the first batch of a topic not allowed", func() {
+		start()
+		mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+
+		stream, err := conn.NewStream(
+			withAPIKey("game-key"),
+			&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			app.SendEventsStreamMethod,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.SendMsg(&pb.SendEventsRequest{Id: "batch-1", Events: []*pb.Event{newEvent("purchases")}})).To(Succeed())
+		ack := &app.SendEventsAck{}
+		Expect(stream.RecvMsg(ack)).To(Succeed())
+		Expect(ack.Id).To(Equal("batch-1"))
+
+		Expect(stream.SendMsg(&pb.SendEventsRequest{Id: "batch-2", Events: []*pb.Event{newEvent("anything")}})).To(Succeed())
+		Expect(status.Code(stream.RecvMsg(ack))).To(Equal(codes.PermissionDenied))
+	})
+
+	It("should reject streams without valid credentials", func() {
+		start()
+		stream, err := conn.NewStream(
+			context.Background(),
+			&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			app.SendEventsStreamMethod,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Code(stream.RecvMsg(&app.SendEventsAck{}))).To(Equal(codes.Unauthenticated))
+	})
+
+	It("should fail with invalid settings", func() {
+		cfg.Set("auth.jwt.secret", "")
+		cfg.Set("auth.apiKeys", []map[string]interface{}{})
+		_, err := app.NewAuthenticator(cfg, log)
+		Expect(err).To(MatchError("auth.enabled requires auth.apiKeys or auth.jwt"))
+
+		cfg.Set("auth.apiKeys", []map[string]interface{}{{"key": "some-key", "topics": []string{"purchases"}}})
+		_, err = app.NewAuthenticator(cfg, log)
+		Expect(err).To(MatchError("auth.apiKeys should have a key and a tenant"))
+
+		cfg.Set("auth.apiKeys", []map[string]interface{}{})
+		cfg.Set("auth.jwt.secret", string(secret))
+		cfg.Set("auth.jwt.publicKeyFile", "public.pem")
+		_, err = app.NewAuthenticator(cfg, log)
+		Expect(err).To(MatchError("auth.jwt requires exactly one of secret or publicKeyFile"))
+	})
+
+	It("should require credentials on the app with auth.enabled", func() {
+		cfg := initConfig()
+		cfg.Set("auth.enabled", true)
+		_, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(MatchError("auth.enabled requires auth.apiKeys or auth.jwt"))
+	})
+})
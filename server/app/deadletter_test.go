@@ -0,0 +1,22 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+)
+
+var _ = Describe("Dead letters", func() {
+	It("should fail to start the kafka sink on forwarders other than kafka", func() {
+		cfg := initConfig()
+		cfg.Set("deadLetter.sink", sender.DeadLetterSinkKafka)
+		cfg.Set("deadLetter.topic", "dead-letters")
+		cfg.Set("forwarder.type", "stdout")
+		_, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(MatchError("deadLetter.sink kafka requires forwarder.type kafka"))
+	})
+})
@@ -0,0 +1,205 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"github.com/topfreegames/eventsgateway/v4/server/logger"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Paths of the health checks served by the metrics server
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// healthMethodPrefix is the prefix of the methods of the grpc.health.v1 service
+var healthMethodPrefix = "/" + healthpb.Health_ServiceDesc.ServiceName + "/"
+
+var (
+	errNotChecked   = errors.New("forwarder not checked yet")
+	errShuttingDown = errors.New("shutting down")
+)
+
+// Health reports whether the server is ready through the grpc.health.v1 service and
+// the readiness route, it's ready while the forwarder can produce to topics and
+// until the graceful shutdown starts
+type Health struct {
+	server   *health.Server
+	checker  forwarder.Checker
+	topics   []string
+	interval time.Duration
+	log      logger.Logger
+
+	mu       sync.Mutex
+	services []string
+	err      error
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewHealth ctor, forwarders that aren't a forwarder.Checker are always ready
+func NewHealth(f forwarder.Forwarder, topics []string, interval time.Duration, log logger.Logger) *Health {
+	h := &Health{
+		server:   health.NewServer(),
+		topics:   topics,
+		interval: interval,
+		log:      log.WithField("source", "health"),
+		services: []string{""},
+		err:      errNotChecked,
+		stop:     make(chan struct{}),
+	}
+	h.checker, _ = f.(forwarder.Checker)
+	h.setStatusLocked(healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// Register registers the health service on s, it must be called after the other
+// services are registered so their status is reported too
+func (h *Health) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, h.server)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for service := range s.GetServiceInfo() {
+		if service != healthpb.Health_ServiceDesc.ServiceName {
+			h.services = append(h.services, service)
+		}
+	}
+	h.setStatusLocked(h.status())
+}
+
+// Start checks the forwarder now and then every interval, until Shutdown
+func (h *Health) Start() {
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			h.Check()
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check checks whether the forwarder can produce, updating the status
+func (h *Health) Check() error {
+	var err error
+	if h.checker != nil {
+		err = h.checker.Check(h.topics)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err == errShuttingDown {
+		return h.err
+	}
+	if err != nil && h.err == nil {
+		h.log.WithError(err).Warn("forwarder can't produce, not ready")
+	} else if err == nil && h.err != nil {
+		h.log.Info("forwarder can produce, ready")
+	}
+	h.err = err
+	h.setStatusLocked(h.status())
+	return err
+}
+
+// Ready returns why the server isn't ready, or nil if it is
+func (h *Health) Ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Shutdown reports NOT_SERVING from now on and stops checking the forwarder, it's
+// called at the start of the graceful shutdown, so load balancers stop sending
+// requests before the connections are closed
+func (h *Health) Shutdown() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = errShuttingDown
+	// every service is NOT_SERVING and stays so
+	h.server.Shutdown()
+}
+
+// Routes returns the liveness and readiness routes of the metrics server
+func (h *Health) Routes() []metrics.Route {
+	return []metrics.Route{
+		{Path: LivenessPath, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})},
+		{Path: ReadinessPath, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := h.Ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})},
+	}
+}
+
+// status must be called holding mu
+func (h *Health) status() healthpb.HealthCheckResponse_ServingStatus {
+	if h.err != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+// setStatusLocked sets the status of the server and of every service, it must be
+// called holding mu, except on the ctor
+func (h *Health) setStatusLocked(status healthpb.HealthCheckResponse_ServingStatus) {
+	for _, service := range h.services {
+		h.server.SetServingStatus(service, status)
+	}
+}
+
+// unaryExceptHealth runs interceptor on every method but the health checks
+func unaryExceptHealth(interceptor grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// streamExceptHealth runs interceptor on every stream but the health watches
+func streamExceptHealth(interceptor grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(srv, ss)
+		}
+		return interceptor(srv, ss, info, handler)
+	}
+}
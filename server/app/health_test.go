@@ -0,0 +1,207 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// checkedForwarder is a forwarder whose Check fails with err
+type checkedForwarder struct {
+	forwarder.Forwarder
+	mu  sync.Mutex
+	err error
+}
+
+func (c *checkedForwarder) Check(topics []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *checkedForwarder) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+var _ = Describe("Health", func() {
+	var (
+		f      *checkedForwarder
+		health *app.Health
+	)
+
+	BeforeEach(func() {
+		f = &checkedForwarder{Forwarder: mockForwarder, err: errors.New("no brokers")}
+		health = app.NewHealth(f, []string{"sometopic"}, time.Hour, log)
+	})
+
+	get := func(path string) int {
+		mux := http.NewServeMux()
+		for _, route := range health.Routes() {
+			mux.Handle(route.Path, route.Handler)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	It("should be ready while the forwarder can produce", func() {
+		Expect(health.Ready()).To(HaveOccurred())
+		Expect(get(app.ReadinessPath)).To(Equal(http.StatusServiceUnavailable))
+		Expect(get(app.LivenessPath)).To(Equal(http.StatusOK))
+
+		f.setErr(nil)
+		Expect(health.Check()).To(Succeed())
+		Expect(get(app.ReadinessPath)).To(Equal(http.StatusOK))
+
+		f.setErr(errors.New("no metadata of topic sometopic"))
+		Expect(health.Check()).To(MatchError("no metadata of topic sometopic"))
+		Expect(get(app.ReadinessPath)).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should check the forwarder every interval once started", func() {
+		health = app.NewHealth(f, nil, 10*time.Millisecond, log)
+		health.Start()
+		defer health.Shutdown()
+		Expect(health.Ready()).To(HaveOccurred())
+		f.setErr(nil)
+		Eventually(health.Ready).Should(Succeed())
+	})
+
+	It("should not be ready once shutting down", func() {
+		f.setErr(nil)
+		Expect(health.Check()).To(Succeed())
+		health.Shutdown()
+		Expect(health.Check()).To(HaveOccurred())
+		Expect(get(app.ReadinessPath)).To(Equal(http.StatusServiceUnavailable))
+		Expect(get(app.LivenessPath)).To(Equal(http.StatusOK))
+	})
+
+	It("should always be ready with forwarders that can't be checked", func() {
+		health = app.NewHealth(mockForwarder, nil, time.Hour, log)
+		Expect(health.Check()).To(Succeed())
+		Expect(health.Ready()).To(Succeed())
+	})
+
+	It("should fail to create the app without a check interval", func() {
+		cfg := initConfig()
+		cfg.Set("forwarder.type", "stdout")
+		cfg.Set("health.checkInterval", "0s")
+		_, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(MatchError("health.checkInterval should be positive"))
+	})
+
+	Describe("on the app server", func() {
+		var (
+			a      *app.App
+			served chan error
+			conn   *grpc.ClientConn
+			client healthpb.HealthClient
+		)
+
+		BeforeEach(func() {
+			cfg := initConfig()
+			cfg.Set("forwarder.type", "stdout")
+			cfg.Set("server.drainDelay", "300ms")
+			cfg.Set("auth.enabled", true)
+			cfg.Set("auth.apiKeys", []map[string]interface{}{
+				{"key": "some-key", "tenant": "some-game", "topics": []string{"*"}},
+			})
+			cfg.Set("rateLimit.enabled", true)
+			cfg.Set("rateLimit.caller.rate", 1)
+			cfg.Set("loadShedding.enabled", true)
+			cfg.Set("loadShedding.maxInFlight", 1)
+			var err error
+			a, err = app.NewApp("localhost", 0, log, cfg)
+			Expect(err).NotTo(HaveOccurred())
+
+			listener := bufconn.Listen(1024 * 1024)
+			served = make(chan error, 1)
+			grpcServer, serveResult := a.GRPCServer(), served
+			go func() { serveResult <- grpcServer.Serve(listener) }()
+
+			conn, err = grpc.Dial(
+				"bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return listener.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			client = healthpb.NewHealthClient(conn)
+		})
+
+		AfterEach(func() {
+			conn.Close()
+			a.GRPCServer().Stop()
+		})
+
+		status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+			res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+			Expect(err).NotTo(HaveOccurred())
+			return res.GetStatus()
+		}
+
+		It("should answer probes without credentials", func() {
+			Expect(status("")).To(Equal(healthpb.HealthCheckResponse_NOT_SERVING))
+			Expect(a.Health().Check()).To(Succeed())
+			Expect(status("")).To(Equal(healthpb.HealthCheckResponse_SERVING))
+			Expect(status("eventsgateway.GRPCForwarder")).To(Equal(healthpb.HealthCheckResponse_SERVING))
+			Expect(status("eventsgateway.GRPCForwarderStream")).To(Equal(healthpb.HealthCheckResponse_SERVING))
+
+			watch, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			res, err := watch.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.GetStatus()).To(Equal(healthpb.HealthCheckResponse_SERVING))
+
+			// the events still require credentials
+			_, err = pb.NewGRPCForwarderClient(conn).SendEvent(context.Background(), &pb.Event{
+				Id: "1", Name: "someName", Topic: "sometopic", Timestamp: 1,
+			})
+			Expect(grpcstatus.Code(err)).To(Equal(codes.Unauthenticated))
+		})
+
+		It("should report NOT_SERVING for the drain delay before stopping", func() {
+			Expect(a.Health().Check()).To(Succeed())
+			start := time.Now()
+			stopped := make(chan struct{})
+			go func() {
+				a.GracefulStop()
+				close(stopped)
+			}()
+
+			Eventually(func() healthpb.HealthCheckResponse_ServingStatus {
+				return status("")
+			}).Should(Equal(healthpb.HealthCheckResponse_NOT_SERVING))
+			// the server still takes requests while load balancers notice
+			Consistently(func() healthpb.HealthCheckResponse_ServingStatus {
+				return status("")
+			}, 200*time.Millisecond).Should(Equal(healthpb.HealthCheckResponse_NOT_SERVING))
+
+			Eventually(stopped).Should(BeClosed())
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+			Eventually(served).Should(Receive(BeNil()))
+		})
+	})
+})
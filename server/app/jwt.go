@@ -0,0 +1,138 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ecdsaAlgorithms are the ES algorithms accepted for each curve, tokens are only
+// verified with the hash and signature size of the curve of the key
+var ecdsaAlgorithms = map[elliptic.Curve]string{
+	elliptic.P256(): jwt.SigningMethodES256.Alg(),
+	elliptic.P384(): jwt.SigningMethodES384.Alg(),
+	elliptic.P521(): jwt.SigningMethodES512.Alg(),
+}
+
+// jwtVerifier checks the signature and the registered claims of JSON Web Tokens, it
+// only accepts the algorithms of its key: HS* for a secret, RS* for a RSA public key
+// or the ES algorithm of the curve of an ECDSA public key. Tokens must expire.
+type jwtVerifier struct {
+	key    interface{}
+	parser *jwt.Parser
+}
+
+func newJWTVerifier(secret, publicKeyFile, issuer, audience string, leeway time.Duration) (*jwtVerifier, error) {
+	if (secret == "") == (publicKeyFile == "") {
+		return nil, errors.New("auth.jwt requires exactly one of secret or publicKeyFile")
+	}
+	v := &jwtVerifier{}
+	var methods []string
+	if secret != "" {
+		v.key = []byte(secret)
+		methods = []string{
+			jwt.SigningMethodHS256.Alg(),
+			jwt.SigningMethodHS384.Alg(),
+			jwt.SigningMethodHS512.Alg(),
+		}
+	} else {
+		key, err := readPublicKey(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			methods = []string{
+				jwt.SigningMethodRS256.Alg(),
+				jwt.SigningMethodRS384.Alg(),
+				jwt.SigningMethodRS512.Alg(),
+			}
+		case *ecdsa.PublicKey:
+			alg, ok := ecdsaAlgorithms[k.Curve]
+			if !ok {
+				return nil, fmt.Errorf("auth.jwt.publicKeyFile %s has an ECDSA key of unsupported curve %s", publicKeyFile, k.Curve.Params().Name)
+			}
+			methods = []string{alg}
+		default:
+			return nil, fmt.Errorf("auth.jwt.publicKeyFile %s should have a RSA or ECDSA key, got %T", publicKeyFile, key)
+		}
+		v.key = key
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	}
+	if issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	v.parser = jwt.NewParser(options...)
+	return v, nil
+}
+
+func readPublicKey(publicKeyFile string) (interface{}, error) {
+	content, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("auth.jwt.publicKeyFile: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("auth.jwt.publicKeyFile %s has no PEM block", publicKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("auth.jwt.publicKeyFile: %w", err)
+	}
+	return key, nil
+}
+
+// verify returns the claims of token if it's valid
+func (v *jwtVerifier) verify(token string) (map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// stringsClaim returns claim name as a list, either it's a list of strings or a
+// string with space separated values like the OAuth 2 scope claim
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
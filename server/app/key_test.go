@@ -0,0 +1,81 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("Message keys", func() {
+	var (
+		s     *app.Server
+		nowMs int64
+	)
+
+	newEvent := func(topic string, props map[string]string) *pb.Event {
+		return &pb.Event{
+			Id:        "someid",
+			Name:      "someName",
+			Topic:     topic,
+			Props:     props,
+			Timestamp: nowMs,
+		}
+	}
+
+	BeforeEach(func() {
+		nowMs = time.Now().UnixNano() / 1000000
+		cfg := initConfig()
+		cfg.Set("kafka.producer.key.prop", "userId")
+		cfg.Set("kafka.producer.key.topicProps", map[string]string{"matches": "matchId"})
+		s = app.NewServer(newKafkaSender(cfg), log)
+	})
+
+	It("should use the default key prop", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Eq("user-1"), gomock.Any(), gomock.Any())
+		_, err := s.SendEvent(context.Background(), newEvent("sometopic", map[string]string{
+			"userId":  "user-1",
+			"matchId": "match-1",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should use the key prop of the topic", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("matches"), gomock.Eq("match-1"), gomock.Any(), gomock.Any())
+		_, err := s.SendEvent(context.Background(), newEvent("matches", map[string]string{
+			"userId":  "user-1",
+			"matchId": "match-1",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should send events without the key prop unkeyed", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Eq(""), gomock.Any(), gomock.Any())
+		_, err := s.SendEvent(context.Background(), newEvent("sometopic", map[string]string{}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should prefer the key set by the client and remove it from the props", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Eq("explicit"), gomock.Any(), gomock.Any()).Do(
+			func(topic, key string, headers map[string]string, aevent []byte) {
+				ev, err := avro.DeserializeEvent(bytes.NewReader(aevent))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ev.Props).To(Equal(map[string]string{"userId": "user-1"}))
+			})
+		_, err := s.SendEvent(context.Background(), newEvent("sometopic", map[string]string{
+			"userId":       "user-1",
+			sender.KeyProp: "explicit",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
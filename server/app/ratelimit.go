@@ -0,0 +1,310 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RetryAfterMetadata is the trailer of rate limited requests with how many seconds the
+// caller should wait before retrying, it must match the one at client/async.go
+const RetryAfterMetadata = "retry-after"
+
+// Kinds of rate limits, they're the limit label of metrics.RateLimitedEventsCounter
+const (
+	RateLimitTopic  = "topic"
+	RateLimitCaller = "caller"
+)
+
+// RateLimit is a limit of events per second, allowing bursts of up to Burst events
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// RateLimitOverride is a limit in rateLimit.topic.overrides, which set Topic, or in
+// rateLimit.caller.overrides, which set Caller
+type RateLimitOverride struct {
+	Topic  string
+	Caller string
+	Rate   float64
+	Burst  float64
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second
+type tokenBucket struct {
+	limit    RateLimit
+	tokens   float64
+	lastSeen time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.Burst, lastSeen: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.limit.Burst, b.tokens+now.Sub(b.lastSeen).Seconds()*b.limit.Rate)
+	b.lastSeen = now
+}
+
+// wait returns how long until n tokens can be taken, batches larger than the burst only
+// wait for a full bucket and leave it in debt
+func (b *tokenBucket) wait(n float64) time.Duration {
+	needed := math.Min(n, b.limit.Burst)
+	if b.tokens >= needed {
+		return 0
+	}
+	return time.Duration((needed - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// RateLimiter limits the events per second of each topic and of each caller, callers
+// are the tenant of their credential or their address if auth is disabled
+type RateLimiter struct {
+	topicLimit      RateLimit
+	topicOverrides  map[string]RateLimit
+	callerLimit     RateLimit
+	callerOverrides map[string]RateLimit
+	idleTimeout     time.Duration
+
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+// NewRateLimiter returns the RateLimiter of rateLimit, a zero rate doesn't limit
+func NewRateLimiter(config *viper.Viper) (*RateLimiter, error) {
+	r := &RateLimiter{
+		topicOverrides:  map[string]RateLimit{},
+		callerOverrides: map[string]RateLimit{},
+		idleTimeout:     config.GetDuration("rateLimit.idleTimeout"),
+		buckets:         map[string]*tokenBucket{},
+		lastCleanup:     time.Now(),
+	}
+	var err error
+	if r.topicLimit, err = newRateLimit(config, "rateLimit.topic"); err != nil {
+		return nil, err
+	}
+	if r.callerLimit, err = newRateLimit(config, "rateLimit.caller"); err != nil {
+		return nil, err
+	}
+
+	var topicOverrides, callerOverrides []RateLimitOverride
+	if err := config.UnmarshalKey("rateLimit.topic.overrides", &topicOverrides); err != nil {
+		return nil, err
+	}
+	for _, o := range topicOverrides {
+		if o.Topic == "" {
+			return nil, fmt.Errorf("rateLimit.topic.overrides should have a topic")
+		}
+		limit, err := validRateLimit(o.Rate, o.Burst, fmt.Sprintf("rateLimit.topic.overrides of %s", o.Topic))
+		if err != nil {
+			return nil, err
+		}
+		r.topicOverrides[strings.ToLower(o.Topic)] = limit
+	}
+	if err := config.UnmarshalKey("rateLimit.caller.overrides", &callerOverrides); err != nil {
+		return nil, err
+	}
+	for _, o := range callerOverrides {
+		if o.Caller == "" {
+			return nil, fmt.Errorf("rateLimit.caller.overrides should have a caller")
+		}
+		limit, err := validRateLimit(o.Rate, o.Burst, fmt.Sprintf("rateLimit.caller.overrides of %s", o.Caller))
+		if err != nil {
+			return nil, err
+		}
+		r.callerOverrides[o.Caller] = limit
+	}
+	return r, nil
+}
+
+func newRateLimit(config *viper.Viper, key string) (RateLimit, error) {
+	return validRateLimit(config.GetFloat64(key+".rate"), config.GetFloat64(key+".burst"), key)
+}
+
+// validRateLimit returns the limit of rate and burst, which defaults to a second of events
+func validRateLimit(rate, burst float64, name string) (RateLimit, error) {
+	if rate < 0 || burst < 0 {
+		return RateLimit{}, fmt.Errorf("%s rate and burst can't be negative", name)
+	}
+	if burst == 0 {
+		burst = math.Max(rate, 1)
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// Allow takes the tokens of events from the buckets of caller and of their topics,
+// returning how long the caller should wait if any of them doesn't have enough
+func (r *RateLimiter) Allow(caller string, events []*pb.Event) (time.Duration, string) {
+	eventsPerTopic := map[string]float64{}
+	for _, event := range events {
+		eventsPerTopic[strings.ToLower(event.GetTopic())]++
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cleanup(now)
+
+	var taken []*tokenBucket
+	var costs []float64
+	check := func(key string, limit RateLimit, n float64) time.Duration {
+		if limit.Rate == 0 {
+			return 0
+		}
+		b, ok := r.buckets[key]
+		if !ok || b.limit != limit {
+			b = newTokenBucket(limit, now)
+			r.buckets[key] = b
+		}
+		b.refill(now)
+		taken = append(taken, b)
+		costs = append(costs, n)
+		return b.wait(n)
+	}
+
+	if wait := check(RateLimitCaller+"/"+caller, limitOf(r.callerOverrides, caller, r.callerLimit), float64(len(events))); wait > 0 {
+		return wait, RateLimitCaller
+	}
+	for topic, n := range eventsPerTopic {
+		if wait := check(RateLimitTopic+"/"+topic, limitOf(r.topicOverrides, topic, r.topicLimit), n); wait > 0 {
+			return wait, RateLimitTopic
+		}
+	}
+	// the tokens are only taken once every bucket has enough of them
+	for i, b := range taken {
+		b.tokens -= costs[i]
+	}
+	return 0, ""
+}
+
+func limitOf(overrides map[string]RateLimit, key string, limit RateLimit) RateLimit {
+	if override, ok := overrides[key]; ok {
+		return override
+	}
+	return limit
+}
+
+// cleanup removes the buckets that weren't used within idleTimeout, it must be
+// called holding mu
+func (r *RateLimiter) cleanup(now time.Time) {
+	if r.idleTimeout <= 0 || now.Sub(r.lastCleanup) < r.idleTimeout {
+		return
+	}
+	r.lastCleanup = now
+	for key, b := range r.buckets {
+		if now.Sub(b.lastSeen) >= r.idleTimeout {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// callerOf returns the tenant of the request's credential, or the address it came from
+func callerOf(ctx context.Context) string {
+	if caller, ok := CallerFromContext(ctx); ok {
+		return caller.Tenant
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		// the port changes on every connection
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// check returns the ResourceExhausted error of events over the limits, with the
+// retry-after trailer to set on the response
+func (r *RateLimiter) check(ctx context.Context, events []*pb.Event) (metadata.MD, error) {
+	wait, limit := r.Allow(callerOf(ctx), events)
+	if wait == 0 {
+		return nil, nil
+	}
+	for _, event := range events {
+		metrics.RateLimitedEventsCounter.WithLabelValues(event.GetTopic(), limit).Inc()
+	}
+	// rounded up to milliseconds, so callers don't retry a bit too early
+	retryAfter := math.Ceil(wait.Seconds()*1000) / 1000
+	trailer := metadata.Pairs(RetryAfterMetadata, strconv.FormatFloat(retryAfter, 'f', -1, 64))
+	return trailer, status.Errorf(codes.ResourceExhausted, "%s rate limit exceeded, retry after %s", limit, wait)
+}
+
+// UnaryInterceptor rejects SendEvent and SendEvents requests over the limits with
+// ResourceExhausted and the seconds to wait in the retry-after trailer
+func (r *RateLimiter) UnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	var events []*pb.Event
+	switch t := req.(type) {
+	case *pb.Event:
+		events = []*pb.Event{t}
+	case *pb.SendEventsRequest:
+		events = t.Events
+	}
+	if len(events) == 0 {
+		return handler(ctx, req)
+	}
+	trailer, err := r.check(ctx, events)
+	if err != nil {
+		_ = grpc.SetTrailer(ctx, trailer)
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor applies the limits to every batch received on a stream, ending
+// it like UnaryInterceptor on the first one over them, after the batches received
+// before it are acked
+func (r *RateLimiter) StreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &rateLimitedServerStream{ServerStream: ss, limiter: r})
+}
+
+type rateLimitedServerStream struct {
+	grpc.ServerStream
+	limiter *RateLimiter
+}
+
+func (s *rateLimitedServerStream) RecvMsg(msg interface{}) error {
+	if err := s.ServerStream.RecvMsg(msg); err != nil {
+		return err
+	}
+	req, ok := msg.(*pb.SendEventsRequest)
+	if !ok || len(req.Events) == 0 {
+		return nil
+	}
+	trailer, err := s.limiter.check(s.Context(), req.Events)
+	if err != nil {
+		s.SetTrailer(trailer)
+	}
+	return err
+}
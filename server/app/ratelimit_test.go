@@ -0,0 +1,193 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var _ = Describe("Rate limits", func() {
+	var cfg *viper.Viper
+
+	events := func(topic string, n int) []*pb.Event {
+		var events []*pb.Event
+		for i := 0; i < n; i++ {
+			events = append(events, &pb.Event{Id: strconv.Itoa(i), Name: "someName", Topic: topic, Timestamp: 1})
+		}
+		return events
+	}
+
+	BeforeEach(func() {
+		cfg = viper.New()
+		cfg.Set("rateLimit.idleTimeout", "10m")
+	})
+
+	It("should limit the events of each topic", func() {
+		cfg.Set("rateLimit.topic.rate", 10)
+		cfg.Set("rateLimit.topic.burst", 20)
+		cfg.Set("rateLimit.topic.overrides", []map[string]interface{}{{"topic": "Purchases", "rate": 1, "burst": 1}})
+		r, err := app.NewRateLimiter(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		wait, _ := r.Allow("game", events("logins", 20))
+		Expect(wait).To(BeZero())
+		wait, limit := r.Allow("game", events("logins", 5))
+		Expect(limit).To(Equal(app.RateLimitTopic))
+		Expect(wait).To(BeNumerically("~", 500*time.Millisecond, 50*time.Millisecond))
+
+		wait, _ = r.Allow("game", events("purchases", 1))
+		Expect(wait).To(BeZero())
+		wait, _ = r.Allow("game", events("purchases", 1))
+		Expect(wait).To(BeNumerically("~", time.Second, 50*time.Millisecond))
+	})
+
+	It("should limit the events of each caller across topics", func() {
+		cfg.Set("rateLimit.caller.rate", 100)
+		cfg.Set("rateLimit.caller.overrides", []map[string]interface{}{{"caller": "big-game", "rate": 1000}})
+		r, err := app.NewRateLimiter(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		wait, _ := r.Allow("game", append(events("logins", 60), events("purchases", 40)...))
+		Expect(wait).To(BeZero())
+		wait, limit := r.Allow("game", events("logins", 1))
+		Expect(limit).To(Equal(app.RateLimitCaller))
+		Expect(wait).To(BeNumerically(">", 0))
+
+		wait, _ = r.Allow("other-game", events("logins", 100))
+		Expect(wait).To(BeZero())
+		wait, _ = r.Allow("big-game", events("logins", 1000))
+		Expect(wait).To(BeZero())
+	})
+
+	It("should only take tokens when every limit allows the events", func() {
+		cfg.Set("rateLimit.caller.rate", 10)
+		cfg.Set("rateLimit.topic.rate", 5)
+		r, err := app.NewRateLimiter(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		wait, _ := r.Allow("game", events("logins", 5))
+		Expect(wait).To(BeZero())
+		_, limit := r.Allow("game", events("logins", 5))
+		Expect(limit).To(Equal(app.RateLimitTopic))
+		// the caller tokens weren't taken by the rejected events
+		wait, _ = r.Allow("game", events("purchases", 5))
+		Expect(wait).To(BeZero())
+	})
+
+	It("should let batches larger than the burst through a full bucket", func() {
+		cfg.Set("rateLimit.topic.rate", 10)
+		r, err := app.NewRateLimiter(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		wait, _ := r.Allow("game", events("logins", 30))
+		Expect(wait).To(BeZero())
+		wait, _ = r.Allow("game", events("logins", 1))
+		Expect(wait).To(BeNumerically("~", 2100*time.Millisecond, 50*time.Millisecond))
+	})
+
+	It("should fail with invalid settings", func() {
+		cfg.Set("rateLimit.topic.rate", -1)
+		_, err := app.NewRateLimiter(cfg)
+		Expect(err).To(MatchError("rateLimit.topic rate and burst can't be negative"))
+
+		cfg.Set("rateLimit.topic.rate", 1)
+		cfg.Set("rateLimit.caller.overrides", []map[string]interface{}{{"rate": 1}})
+		_, err = app.NewRateLimiter(cfg)
+		Expect(err).To(MatchError("rateLimit.caller.overrides should have a caller"))
+	})
+
+	Describe("Interceptors", func() {
+		var (
+			grpcServer *grpc.Server
+			conn       *grpc.ClientConn
+			client     pb.GRPCForwarderClient
+		)
+
+		BeforeEach(func() {
+			cfg.Set("rateLimit.caller.rate", 1)
+			cfg.Set("rateLimit.caller.burst", 2)
+			r, err := app.NewRateLimiter(cfg)
+			Expect(err).NotTo(HaveOccurred())
+
+			listener := bufconn.Listen(1024 * 1024)
+			grpcServer = grpc.NewServer(
+				grpc.UnaryInterceptor(r.UnaryInterceptor),
+				grpc.StreamInterceptor(r.StreamInterceptor),
+			)
+			s := app.NewServer(newKafkaSender(initConfig()), log)
+			pb.RegisterGRPCForwarderServer(grpcServer, s)
+			grpcServer.RegisterService(&app.StreamServiceDesc, s)
+			go grpcServer.Serve(listener)
+
+			conn, err = grpc.Dial(
+				"bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return listener.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			client = pb.NewGRPCForwarderClient(conn)
+		})
+
+		AfterEach(func() {
+			conn.Close()
+			grpcServer.Stop()
+		})
+
+		It("should reject requests over the limit with the retry-after trailer", func() {
+			mockForwarder.EXPECT().Produce(gomock.Eq("logins"), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+
+			_, err := client.SendEvents(context.Background(), &pb.SendEventsRequest{Events: events("logins", 2)})
+			Expect(err).NotTo(HaveOccurred())
+
+			var trailer metadata.MD
+			_, err = client.SendEvent(context.Background(), events("logins", 1)[0], grpc.Trailer(&trailer))
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			retryAfter, err := strconv.ParseFloat(trailer.Get(app.RetryAfterMetadata)[0], 64)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retryAfter).To(BeNumerically("~", 1, 0.05))
+			Expect(testutil.ToFloat64(metrics.RateLimitedEventsCounter.WithLabelValues("logins", app.RateLimitCaller))).To(Equal(float64(1)))
+		})
+
+		It("should end streams on the first batch over the limit with the retry-after trailer", func() {
+			mockForwarder.EXPECT().Produce(gomock.Eq("logins"), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+
+			stream, err := conn.NewStream(
+				context.Background(),
+				&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+				app.SendEventsStreamMethod,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.SendMsg(&pb.SendEventsRequest{Id: "batch-1", Events: events("logins", 2)})).To(Succeed())
+			ack := &app.SendEventsAck{}
+			Expect(stream.RecvMsg(ack)).To(Succeed())
+			Expect(ack.Id).To(Equal("batch-1"))
+
+			Expect(stream.SendMsg(&pb.SendEventsRequest{Id: "batch-2", Events: events("logins", 1)})).To(Succeed())
+			Expect(status.Code(stream.RecvMsg(ack))).To(Equal(codes.ResourceExhausted))
+			retryAfter, err := strconv.ParseFloat(stream.Trailer().Get(app.RetryAfterMetadata)[0], 64)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retryAfter).To(BeNumerically("~", 1, 0.05))
+		})
+	})
+})
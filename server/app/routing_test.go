@@ -0,0 +1,156 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"github.com/topfreegames/eventsgateway/v4/server/mocks"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("Routing", func() {
+	var (
+		s              *app.Server
+		nowMs          int64
+		purchasesSink  *mocks.MockForwarder
+		backupSink     *mocks.MockForwarder
+		newKafkaRouter func(defaultSinks []string, rules []sender.RouteRule)
+	)
+
+	newEvent := func(id, name string, props map[string]string) *pb.Event {
+		return &pb.Event{
+			Id:        id,
+			Name:      name,
+			Topic:     "sometopic",
+			Props:     props,
+			Timestamp: nowMs,
+		}
+	}
+
+	BeforeEach(func() {
+		nowMs = time.Now().UnixNano() / 1000000
+		purchasesSink = mocks.NewMockForwarder(mockCtrl)
+		backupSink = mocks.NewMockForwarder(mockCtrl)
+		newKafkaRouter = func(defaultSinks []string, rules []sender.RouteRule) {
+			kafkaSender := newKafkaSender(initConfig())
+			router, err := sender.NewRouter(map[string]sender.Sink{
+				sender.DefaultSink: {Forwarder: mockForwarder, Required: true},
+				"purchases":        {Forwarder: purchasesSink, Required: true},
+				"backup":           {Forwarder: backupSink},
+			}, defaultSinks, rules)
+			Expect(err).NotTo(HaveOccurred())
+			kafkaSender.SetRouter(router)
+			s = app.NewServer(kafkaSender, log)
+		}
+	})
+
+	It("should send events to the default sinks and the sinks of the rules they match", func() {
+		newKafkaRouter([]string{sender.DefaultSink}, []sender.RouteRule{
+			{Name: "purchase", Sinks: []string{"purchases"}},
+			{Topic: "SomeTopic", Props: []sender.PropMatch{{Name: "store", Values: []string{"apple", "google"}}}, Sinks: []string{"backup", "purchases"}},
+		})
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
+		purchasesSink.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+		backupSink.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+
+		for _, event := range []*pb.Event{
+			newEvent("1", "login", map[string]string{}),
+			newEvent("2", "purchase", map[string]string{}),
+			newEvent("3", "purchase", map[string]string{"store": "apple"}),
+			newEvent("4", "login", map[string]string{"store": "steam"}),
+		} {
+			_, err := s.SendEvent(context.Background(), event)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(testutil.ToFloat64(metrics.SinkEventsCounter.WithLabelValues("purchases", "sometopic", "ok"))).To(Equal(float64(2)))
+	})
+
+	It("should only route events by rules without default sinks", func() {
+		newKafkaRouter([]string{}, []sender.RouteRule{
+			{Name: "purchase", Sinks: []string{"purchases"}},
+		})
+		purchasesSink.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+
+		_, err := s.SendEvent(context.Background(), newEvent("1", "login", map[string]string{}))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = s.SendEvent(context.Background(), newEvent("2", "purchase", map[string]string{}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should only report the failures of required sinks", func() {
+		newKafkaRouter([]string{sender.DefaultSink, "backup"}, []sender.RouteRule{
+			{Name: "purchase", Sinks: []string{"purchases"}},
+		})
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(3)
+		backupSink.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(int32(0), int64(0), errors.New("backup is down")).Times(3)
+		purchasesSink.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(int32(0), int64(0), errors.New("purchases is down"))
+
+		res, err := s.SendEvents(context.Background(), &pb.SendEventsRequest{
+			Id: "batch",
+			Events: []*pb.Event{
+				newEvent("1", "login", map[string]string{}),
+				newEvent("2", "purchase", map[string]string{}),
+				newEvent("3", "login", map[string]string{}),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(Equal([]int64{1}))
+		Expect(testutil.ToFloat64(metrics.SinkEventsCounter.WithLabelValues("backup", "sometopic", "error"))).To(Equal(float64(3)))
+	})
+
+	It("should fail for rules with unknown sinks", func() {
+		_, err := sender.NewRouter(map[string]sender.Sink{
+			sender.DefaultSink: {Forwarder: mockForwarder, Required: true},
+		}, []string{sender.DefaultSink}, []sender.RouteRule{{Name: "purchase", Sinks: []string{"purchases"}}})
+		Expect(err).To(MatchError("unknown sink purchases in routing rule"))
+	})
+
+	It("should build the sinks of routing.sinks from the server config", func() {
+		directory := GinkgoT().TempDir()
+		cfg := initConfig()
+		cfg.Set("forwarder.type", forwarder.TypeFile)
+		cfg.Set("forwarder.file.directory", filepath.Join(directory, "all"))
+		cfg.Set("routing.sinks", []map[string]interface{}{{
+			"name":     "purchases",
+			"type":     forwarder.TypeFile,
+			"required": true,
+			"config": map[string]interface{}{
+				"forwarder": map[string]interface{}{"file": map[string]interface{}{"directory": filepath.Join(directory, "purchases")}},
+			},
+		}})
+		cfg.Set("routing.rules", []map[string]interface{}{{"name": "purchase", "sinks": []string{"purchases"}}})
+		a, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = a.Server.SendEvent(context.Background(), newEvent("1", "purchase", map[string]string{}))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = a.Server.SendEvent(context.Background(), newEvent("2", "login", map[string]string{}))
+		Expect(err).NotTo(HaveOccurred())
+
+		for dir, lines := range map[string]int{"all": 2, "purchases": 1} {
+			files, err := filepath.Glob(filepath.Join(directory, dir, "sometopic-*.jsonl"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			content, err := os.ReadFile(files[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Count(string(content), "\n")).To(Equal(lines))
+		}
+	})
+})
@@ -0,0 +1,140 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+// schemaRegistryStandIn registers schemas like a Confluent Schema Registry, giving
+// each subject its own id
+type schemaRegistryStandIn struct {
+	mu       sync.Mutex
+	subjects map[string]int32
+	requests int
+}
+
+func (r *schemaRegistryStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if req.Method == http.MethodGet && req.URL.Path == "/subjects" {
+		json.NewEncoder(w).Encode([]string{})
+		return
+	}
+	body := map[string]string{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body["schema"] != avro.NewEvent().Schema() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/subjects/") || !strings.HasSuffix(req.URL.Path, "/versions") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	subject := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/subjects/"), "/versions")
+	id, ok := r.subjects[subject]
+	if !ok {
+		id = int32(len(r.subjects) + 1)
+		r.subjects[subject] = id
+	}
+	json.NewEncoder(w).Encode(map[string]int32{"id": id})
+}
+
+var _ = Describe("Schema Registry", func() {
+	var (
+		registry   *schemaRegistryStandIn
+		httpServer *httptest.Server
+		cfg        *viper.Viper
+		nowMs      int64
+	)
+
+	newEvent := func(topic string) *pb.Event {
+		return &pb.Event{
+			Id:        "someid",
+			Name:      "someName",
+			Topic:     topic,
+			Props:     map[string]string{},
+			Timestamp: nowMs,
+		}
+	}
+
+	// schemaIDOf returns the schema id prefixed to the next message produced to topic
+	schemaIDOf := func(s *app.Server, topic string) uint32 {
+		var message []byte
+		mockForwarder.EXPECT().Produce(gomock.Eq(topic), gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(topic, key string, headers map[string]string, m []byte) {
+				message = m
+			})
+		_, err := s.SendEvent(context.Background(), newEvent(topic))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(message[0]).To(Equal(byte(0)))
+		return binary.BigEndian.Uint32(message[1:5])
+	}
+
+	BeforeEach(func() {
+		nowMs = time.Now().UnixNano() / 1000000
+		registry = &schemaRegistryStandIn{subjects: map[string]int32{}}
+		httpServer = httptest.NewServer(registry)
+		cfg = initConfig()
+		cfg.Set("kafka.producer.topicPrefix", "sv-uploads-")
+		cfg.Set("kafka.producer.serializer.default", sender.SerializerConfluentAvro)
+		cfg.Set("kafka.producer.serializer.topics", map[string]string{"warm-topic": sender.SerializerConfluentAvro})
+		cfg.Set("kafka.producer.serializer.schemaRegistry.url", httpServer.URL)
+	})
+
+	AfterEach(func() {
+		httpServer.Close()
+	})
+
+	It("should register the schema of each topic once and prefix messages with its id", func() {
+		s := app.NewServer(newKafkaSender(cfg), log)
+		Expect(registry.subjects).To(HaveKeyWithValue("sv-uploads-warm-topic-value", int32(1)))
+
+		Expect(schemaIDOf(s, "warm-topic")).To(Equal(uint32(1)))
+		Expect(schemaIDOf(s, "other-topic")).To(Equal(uint32(2)))
+		Expect(schemaIDOf(s, "other-topic")).To(Equal(uint32(2)))
+		// ping, warm-topic and other-topic
+		Expect(registry.requests).To(Equal(3))
+	})
+
+	It("should keep using cached ids when the registry goes away", func() {
+		s := app.NewServer(newKafkaSender(cfg), log)
+		httpServer.Close()
+
+		Expect(schemaIDOf(s, "warm-topic")).To(Equal(uint32(1)))
+
+		_, err := s.SendEvent(context.Background(), newEvent("other-topic"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail to start if the registry is unreachable", func() {
+		httpServer.Close()
+		_, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+		Expect(err).To(MatchError(ContainSubstring("schema registry is unreachable")))
+	})
+
+	It("should start without the registry if failOnStartup is disabled", func() {
+		cfg.Set("kafka.producer.serializer.schemaRegistry.failOnStartup", false)
+		httpServer.Close()
+		_, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
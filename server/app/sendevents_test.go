@@ -0,0 +1,96 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("SendEvents", func() {
+	var nowMs int64
+
+	newServer := func(concurrency int) *app.Server {
+		cfg := initConfig()
+		cfg.Set("sender.concurrency", concurrency)
+		return app.NewServer(newKafkaSender(cfg), log)
+	}
+
+	// newEvents returns n events, the ones with odd indexes go to failing-topic
+	newEvents := func(n int) []*pb.Event {
+		events := make([]*pb.Event, n)
+		for i := range events {
+			topic := "ok-topic"
+			if i%2 == 1 {
+				topic = "failing-topic"
+			}
+			events[i] = &pb.Event{
+				Id:        fmt.Sprintf("id-%d", i),
+				Name:      "someName",
+				Topic:     topic,
+				Props:     map[string]string{},
+				Timestamp: nowMs,
+			}
+		}
+		return events
+	}
+
+	BeforeEach(func() {
+		nowMs = time.Now().UnixNano() / 1000000
+	})
+
+	It("should report every failed index", func() {
+		s := newServer(8)
+		mockForwarder.EXPECT().Produce(gomock.Eq("ok-topic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(500)
+		mockForwarder.EXPECT().Produce(gomock.Eq("failing-topic"), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(int32(0), int64(0), errors.New("kafka is down")).Times(500)
+
+		res, err := s.SendEvents(context.Background(), &pb.SendEventsRequest{
+			Id:     "batch",
+			Events: newEvents(1000),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		expected := make([]int64, 0, 500)
+		for i := int64(1); i < 1000; i += 2 {
+			expected = append(expected, i)
+		}
+		Expect(res.FailureIndexes).To(Equal(expected))
+	})
+
+	It("should not send more events at once than the configured concurrency", func() {
+		s := newServer(4)
+		var inFlight, maxInFlight atomic.Int64
+		mockForwarder.EXPECT().Produce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(topic, key string, headers map[string]string, message []byte) {
+				current := inFlight.Add(1)
+				for {
+					max := maxInFlight.Load()
+					if current <= max || maxInFlight.CompareAndSwap(max, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				inFlight.Add(-1)
+			}).Times(40)
+
+		res, err := s.SendEvents(context.Background(), &pb.SendEventsRequest{
+			Id:     "batch",
+			Events: newEvents(40),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(BeEmpty())
+		Expect(maxInFlight.Load()).To(BeNumerically("<=", 4))
+		Expect(maxInFlight.Load()).To(BeNumerically(">", 1))
+	})
+})
@@ -0,0 +1,115 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("Serializers", func() {
+	var (
+		s     *app.Server
+		nowMs int64
+		event *pb.Event
+	)
+
+	// expectMessage returns a pointer to the message produced to topic
+	expectMessage := func(topic string) *[]byte {
+		var message []byte
+		mockForwarder.EXPECT().Produce(gomock.Eq(topic), gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(topic, key string, headers map[string]string, m []byte) {
+				message = m
+			})
+		return &message
+	}
+
+	BeforeEach(func() {
+		nowMs = time.Now().UnixNano() / 1000000
+		cfg := initConfig()
+		cfg.Set("kafka.producer.serializer.topics", map[string]string{
+			"json-topic":      sender.SerializerJSON,
+			"proto-topic":     sender.SerializerProtobuf,
+			"confluent-topic": sender.SerializerConfluentAvro,
+		})
+		cfg.Set("kafka.producer.serializer.confluentAvro.schemaId", 42)
+		s = app.NewServer(newKafkaSender(cfg), log)
+		event = &pb.Event{
+			Id:        "someid",
+			Name:      "someName",
+			Props:     map[string]string{"some": "prop"},
+			Timestamp: nowMs,
+		}
+	})
+
+	It("should serialize with avro by default", func() {
+		event.Topic = "sometopic"
+		message := expectMessage("sometopic")
+		_, err := s.SendEvent(context.Background(), event)
+		Expect(err).NotTo(HaveOccurred())
+
+		ev, err := avro.DeserializeEvent(bytes.NewReader(*message))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ev.Id).To(Equal("someid"))
+		Expect(ev.Props).To(Equal(map[string]string{"some": "prop"}))
+	})
+
+	It("should serialize with json", func() {
+		event.Topic = "json-topic"
+		message := expectMessage("json-topic")
+		_, err := s.SendEvent(context.Background(), event)
+		Expect(err).NotTo(HaveOccurred())
+
+		ev := sender.JSONEvent{}
+		Expect(json.Unmarshal(*message, &ev)).To(Succeed())
+		Expect(ev.Id).To(Equal("someid"))
+		Expect(ev.Name).To(Equal("someName"))
+		Expect(ev.Props).To(Equal(map[string]string{"some": "prop"}))
+		Expect(ev.ClientTimestamp).To(Equal(nowMs))
+		Expect(ev.ServerTimestamp).To(BeNumerically("~", nowMs, 10))
+	})
+
+	It("should serialize with protobuf", func() {
+		event.Topic = "proto-topic"
+		message := expectMessage("proto-topic")
+		_, err := s.SendEvent(context.Background(), event)
+		Expect(err).NotTo(HaveOccurred())
+
+		ev := &pb.Event{}
+		Expect(proto.Unmarshal(*message, ev)).To(Succeed())
+		Expect(proto.Equal(ev, event)).To(BeTrue())
+	})
+
+	It("should serialize with avro prefixed with the schema id", func() {
+		event.Topic = "confluent-topic"
+		message := expectMessage("confluent-topic")
+		_, err := s.SendEvent(context.Background(), event)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect((*message)[0]).To(Equal(byte(0)))
+		Expect(binary.BigEndian.Uint32((*message)[1:5])).To(Equal(uint32(42)))
+		ev, err := avro.DeserializeEvent(bytes.NewReader((*message)[5:]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ev.Id).To(Equal("someid"))
+	})
+
+	It("should fail to start with an unknown serializer", func() {
+		cfg := initConfig()
+		cfg.Set("kafka.producer.serializer.default", "xml")
+		_, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+		Expect(err).To(MatchError(ContainSubstring(`invalid serializer "xml"`)))
+	})
+})
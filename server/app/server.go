@@ -24,15 +24,34 @@ package app
 
 import (
 	"context"
+	"strconv"
+	"strings"
+
 	"github.com/topfreegames/eventsgateway/v4/server/logger"
 	"github.com/topfreegames/eventsgateway/v4/server/sender"
 	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RejectedIndexesMetadata is the trailer of SendEvents responses with the indexes of
+// the events rejected for good, separated by commas
+const RejectedIndexesMetadata = "rejected-indexes"
+
+// Default limits of the batches produced at once from streams, see SetStreamLimits
+const (
+	DefaultStreamMaxInFlight      = 16
+	DefaultStreamMaxInFlightTotal = 1024
 )
 
 // Server struct
 type Server struct {
 	logger logger.Logger
 	sender sender.Sender
+	// streamMaxInFlight is the limit of batches of each stream produced at once and
+	// streamSlots the slots of the batches of all streams
+	streamMaxInFlight int
+	streamSlots       chan struct{}
 }
 
 // NewServer returns a new grpc server
@@ -41,9 +60,17 @@ func NewServer(sender sender.Sender, logger logger.Logger) *Server {
 		logger: logger,
 		sender: sender,
 	}
+	s.SetStreamLimits(DefaultStreamMaxInFlight, DefaultStreamMaxInFlightTotal)
 	return s
 }
 
+// SetStreamLimits sets how many batches of each stream and of all streams are
+// produced at once, batches aren't read from streams while they're reached
+func (s *Server) SetStreamLimits(maxInFlight, maxInFlightTotal int) {
+	s.streamMaxInFlight = maxInFlight
+	s.streamSlots = make(chan struct{}, maxInFlightTotal)
+}
+
 func (s *Server) SendEvent(
 	ctx context.Context,
 	req *pb.Event,
@@ -55,11 +82,24 @@ func (s *Server) SendEvent(
 }
 
 // SendEvents response might include FailureIndexes in case producer fails
-// to send all events
+// to send all events, events rejected for good aren't in them but in the
+// RejectedIndexesMetadata trailer, as they shouldn't be retried
 func (s *Server) SendEvents(
 	ctx context.Context,
 	req *pb.SendEventsRequest,
 ) (*pb.SendEventsResponse, error) {
-	failureIndexes := s.sender.SendEvents(ctx, req.Events)
+	failureIndexes, rejectedIndexes := s.sender.SendEvents(ctx, req.Events)
+	if len(rejectedIndexes) > 0 {
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(RejectedIndexesMetadata, formatIndexes(rejectedIndexes)))
+	}
 	return &pb.SendEventsResponse{FailureIndexes: failureIndexes}, nil
 }
+
+// formatIndexes returns indexes separated by commas
+func formatIndexes(indexes []int64) string {
+	formatted := make([]string, len(indexes))
+	for i, index := range indexes {
+		formatted[i] = strconv.FormatInt(index, 10)
+	}
+	return strings.Join(formatted, ",")
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/topfreegames/eventsgateway/v4/server/logger"
 	"github.com/topfreegames/eventsgateway/v4/server/metrics"
 	"github.com/topfreegames/eventsgateway/v4/server/mocks"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
 	mockpb "github.com/topfreegames/protos/eventsgateway/grpc/mock"
 	"strings"
 	"testing"
@@ -60,6 +61,13 @@ func GetDefaultConfig() (*viper.Viper, error) {
 	return cfg, nil
 }
 
+// newKafkaSender returns a KafkaSender producing to mockForwarder
+func newKafkaSender(cfg *viper.Viper) *sender.KafkaSender {
+	kafkaSender, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+	Expect(err).NotTo(HaveOccurred())
+	return kafkaSender
+}
+
 func TestClient(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "App suite")
@@ -16,7 +16,7 @@ import (
 	. "github.com/onsi/gomega"
 	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
 	"github.com/topfreegames/eventsgateway/v4/server/app"
-	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
 	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
 )
 
@@ -43,7 +43,7 @@ var _ = Describe("Client", func() {
 
 	BeforeEach(func() {
 		nowMs = time.Now().UnixNano() / 1000000
-		sender := sender.NewKafkaSender(mockForwarder, log, initConfig())
+		sender := newKafkaSender(initConfig())
 		s = app.NewServer(sender, log)
 		Expect(s).NotTo(BeNil())
 	})
@@ -117,8 +117,8 @@ var _ = Describe("Client", func() {
 				Timestamp: nowMs,
 			}
 
-			mockForwarder.EXPECT().Produce(gomock.Eq("sv-uploads-sometopic"), gomock.Any()).Do(
-				func(topic string, aevent []byte) {
+			mockForwarder.EXPECT().Produce(gomock.Eq("sv-uploads-sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Do(
+				func(topic, key string, headers map[string]string, aevent []byte) {
 					r := bytes.NewReader(aevent)
 					ev, err := avro.DeserializeEvent(r)
 					Expect(err).NotTo(HaveOccurred())
@@ -126,6 +126,11 @@ var _ = Describe("Client", func() {
 					Expect(ev.Name).To(Equal(e.GetName()))
 					Expect(ev.ClientTimestamp).To(Equal(e.GetTimestamp()))
 					Expect(ev.ServerTimestamp).To(BeNumerically("~", nowMs, 10))
+					Expect(headers).To(Equal(map[string]string{
+						forwarder.HeaderEventID:              e.GetId(),
+						forwarder.HeaderEventName:            e.GetName(),
+						forwarder.HeaderEventClientTimestamp: fmt.Sprint(nowMs),
+					}))
 				})
 
 			res, err := s.SendEvent(ctx, e)
@@ -146,8 +151,8 @@ var _ = Describe("Client", func() {
 				Timestamp: nowMs,
 			}
 
-			mockForwarder.EXPECT().Produce(gomock.Eq("sv-uploads-sometopic"), gomock.Any()).Do(
-				func(topic string, aevent []byte) {
+			mockForwarder.EXPECT().Produce(gomock.Eq("sv-uploads-sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Do(
+				func(topic, key string, headers map[string]string, aevent []byte) {
 					r := bytes.NewReader(aevent)
 					ev, err := avro.DeserializeEvent(r)
 					Expect(err).NotTo(HaveOccurred())
@@ -182,8 +187,8 @@ var _ = Describe("Client", func() {
 				Timestamp: nowMs,
 			}
 
-			mockForwarder.EXPECT().Produce(gomock.Eq("sv-uploads-sometopic"), gomock.Any()).Do(
-				func(topic string, aevent []byte) {
+			mockForwarder.EXPECT().Produce(gomock.Eq("sv-uploads-sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Do(
+				func(topic, key string, headers map[string]string, aevent []byte) {
 					r := bytes.NewReader(aevent)
 					ev, err := avro.DeserializeEvent(r)
 					Expect(err).NotTo(HaveOccurred())
@@ -0,0 +1,192 @@
+// MIT License
+//
+// Copyright (c) 2018 Top Free Games
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// SendEventsStreamMethod is the full name of the bidirectional stream clients
+// use to send batches of events over a single long-lived call
+const SendEventsStreamMethod = "/eventsgateway.GRPCForwarderStream/SendEventsStream"
+
+// SendEventsAck is sent back for each SendEventsRequest received on the stream,
+// RejectedIndexes are the events rejected for good, which aren't in FailureIndexes
+type SendEventsAck struct {
+	Id              string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	FailureIndexes  []int64 `protobuf:"varint,2,rep,packed,name=failureIndexes,proto3" json:"failureIndexes,omitempty"`
+	RejectedIndexes []int64 `protobuf:"varint,3,rep,packed,name=rejectedIndexes,proto3" json:"rejectedIndexes,omitempty"`
+}
+
+func (m *SendEventsAck) Reset()         { *m = SendEventsAck{} }
+func (m *SendEventsAck) String() string { return proto.CompactTextString(m) }
+func (*SendEventsAck) ProtoMessage()    {}
+
+// StreamServiceDesc describes the stream service, which isn't part of the
+// generated GRPCForwarder service
+var StreamServiceDesc = grpc.ServiceDesc{
+	ServiceName: "eventsgateway.GRPCForwarderStream",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendEventsStream",
+			Handler:       sendEventsStreamHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "eventsgateway/stream",
+}
+
+func sendEventsStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*Server).SendEventsStream(stream)
+}
+
+// SendEventsStream receives batches of events until the client closes the stream,
+// producing them concurrently and acking each batch by its id with the indexes
+// of the events that failed and that were rejected. It stops reading batches while
+// the stream or all streams have as many being produced as their limits.
+func (s *Server) SendEventsStream(stream grpc.ServerStream) error {
+	var (
+		wg        sync.WaitGroup
+		sendMutex sync.Mutex
+	)
+	defer wg.Wait()
+	inFlight := make(chan struct{}, s.streamMaxInFlight)
+
+	for {
+		inFlight <- struct{}{}
+		req := &pb.SendEventsRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			<-inFlight
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// the slot is taken after the batch arrives, so idle streams don't hold any
+		select {
+		case s.streamSlots <- struct{}{}:
+		case <-stream.Context().Done():
+			<-inFlight
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-s.streamSlots
+				<-inFlight
+				wg.Done()
+			}()
+			failureIndexes, rejectedIndexes := s.sender.SendEvents(stream.Context(), req.Events)
+			sendMutex.Lock()
+			defer sendMutex.Unlock()
+			if err := stream.SendMsg(&SendEventsAck{
+				Id:              req.Id,
+				FailureIndexes:  failureIndexes,
+				RejectedIndexes: rejectedIndexes,
+			}); err != nil {
+				s.logger.WithError(err).WithField("requestId", req.Id).Error("failed to ack events")
+			}
+		}()
+	}
+}
+
+// streamMetricsReporterInterceptor reports the same metrics as metricsReporterInterceptor
+// for each batch received on a stream, timing it from its arrival to its ack
+func (a *App) streamMetricsReporterInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &metricsServerStream{
+		ServerStream: ss,
+		route:        info.FullMethod,
+		topicPrefix:  a.config.GetString("kafka.producer.topicPrefix"),
+		requests:     map[string]streamRequest{},
+	})
+}
+
+type streamRequest struct {
+	topic     string
+	startTime time.Time
+}
+
+type metricsServerStream struct {
+	grpc.ServerStream
+	route       string
+	topicPrefix string
+	mu          sync.Mutex
+	requests    map[string]streamRequest
+}
+
+func (m *metricsServerStream) RecvMsg(msg interface{}) error {
+	if err := m.ServerStream.RecvMsg(msg); err != nil {
+		return err
+	}
+	req, ok := msg.(*pb.SendEventsRequest)
+	if !ok || len(req.Events) == 0 {
+		return nil
+	}
+	topic := fmt.Sprintf("%s%s", m.topicPrefix, req.Events[0].Topic)
+	metrics.APIPayloadSize.WithLabelValues(topic).Observe(float64(proto.Size(req)))
+	m.mu.Lock()
+	m.requests[req.Id] = streamRequest{topic: topic, startTime: time.Now()}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *metricsServerStream) SendMsg(msg interface{}) error {
+	err := m.ServerStream.SendMsg(msg)
+	ack, ok := msg.(*SendEventsAck)
+	if !ok {
+		return err
+	}
+	m.mu.Lock()
+	req, ok := m.requests[ack.Id]
+	delete(m.requests, ack.Id)
+	m.mu.Unlock()
+	if !ok {
+		return err
+	}
+	responseStatus := "ok"
+	if err != nil {
+		responseStatus = "error"
+	}
+	metrics.APIResponseTime.WithLabelValues(
+		m.route,
+		responseStatus,
+		req.topic,
+	).Observe(float64(time.Since(req.startTime).Milliseconds()))
+	return err
+}
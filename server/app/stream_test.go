@@ -0,0 +1,152 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var _ = Describe("SendEventsStream", func() {
+	var (
+		server     *app.Server
+		grpcServer *grpc.Server
+		conn       *grpc.ClientConn
+	)
+
+	BeforeEach(func() {
+		listener := bufconn.Listen(1024 * 1024)
+		server = app.NewServer(newKafkaSender(initConfig()), log)
+		grpcServer = grpc.NewServer()
+		grpcServer.RegisterService(&app.StreamServiceDesc, server)
+		go grpcServer.Serve(listener)
+
+		var err error
+		conn, err = grpc.Dial(
+			"bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		grpcServer.Stop()
+	})
+
+	newEvent := func(topic string) *pb.Event {
+		return &pb.Event{
+			Id:        "someid",
+			Name:      "someName",
+			Topic:     topic,
+			Props:     map[string]string{},
+			Timestamp: 1,
+		}
+	}
+
+	newStream := func() grpc.ClientStream {
+		stream, err := conn.NewStream(
+			context.Background(),
+			&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			app.SendEventsStreamMethod,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		return stream
+	}
+
+	// blockProduce makes produces wait for release, sending their topics to produced
+	blockProduce := func() (produced chan string, release chan struct{}) {
+		produced = make(chan string, 10)
+		release = make(chan struct{})
+		mockForwarder.EXPECT().Produce(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(topic, _ string, _ map[string]string, _ []byte) (int32, int64, error) {
+				produced <- topic
+				<-release
+				return 0, 0, nil
+			}).AnyTimes()
+		return produced, release
+	}
+
+	It("should ack each batch by id with its failure indexes", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("ok-topic"), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		mockForwarder.EXPECT().Produce(gomock.Eq("failing-topic"), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(int32(0), int64(0), errors.New("kafka is down")).AnyTimes()
+
+		stream, err := conn.NewStream(
+			context.Background(),
+			&grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			app.SendEventsStreamMethod,
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(stream.SendMsg(&pb.SendEventsRequest{
+			Id:     "batch-1",
+			Events: []*pb.Event{newEvent("ok-topic"), newEvent("ok-topic")},
+		})).To(Succeed())
+		Expect(stream.SendMsg(&pb.SendEventsRequest{
+			Id:     "batch-2",
+			Events: []*pb.Event{newEvent("ok-topic"), newEvent("failing-topic")},
+		})).To(Succeed())
+		Expect(stream.CloseSend()).To(Succeed())
+
+		acks := map[string][]int64{}
+		for i := 0; i < 2; i++ {
+			ack := &app.SendEventsAck{}
+			Expect(stream.RecvMsg(ack)).To(Succeed())
+			acks[ack.Id] = ack.FailureIndexes
+		}
+		Expect(acks).To(HaveKeyWithValue("batch-1", BeEmpty()))
+		Expect(acks).To(HaveKeyWithValue("batch-2", Equal([]int64{1})))
+	})
+	It("should not read more batches of a stream while its limit is produced", func() {
+		server.SetStreamLimits(1, 10)
+		produced, release := blockProduce()
+
+		stream := newStream()
+		Expect(stream.SendMsg(&pb.SendEventsRequest{Id: "batch-1", Events: []*pb.Event{newEvent("topic-1")}})).To(Succeed())
+		Expect(stream.SendMsg(&pb.SendEventsRequest{Id: "batch-2", Events: []*pb.Event{newEvent("topic-2")}})).To(Succeed())
+		Expect(stream.CloseSend()).To(Succeed())
+
+		Eventually(produced).Should(Receive(Equal("topic-1")))
+		Consistently(produced, "200ms").ShouldNot(Receive())
+		close(release)
+		Eventually(produced).Should(Receive(Equal("topic-2")))
+
+		for i := 0; i < 2; i++ {
+			Expect(stream.RecvMsg(&app.SendEventsAck{})).To(Succeed())
+		}
+	})
+
+	It("should not read more batches of any stream while the limit of all streams is produced", func() {
+		server.SetStreamLimits(10, 1)
+		produced, release := blockProduce()
+
+		streams := []grpc.ClientStream{newStream(), newStream()}
+		Expect(streams[0].SendMsg(&pb.SendEventsRequest{Id: "batch-1", Events: []*pb.Event{newEvent("topic-1")}})).To(Succeed())
+		Eventually(produced).Should(Receive(Equal("topic-1")))
+		Expect(streams[1].SendMsg(&pb.SendEventsRequest{Id: "batch-2", Events: []*pb.Event{newEvent("topic-2")}})).To(Succeed())
+
+		Consistently(produced, "200ms").ShouldNot(Receive())
+		close(release)
+		Eventually(produced).Should(Receive(Equal("topic-2")))
+
+		for _, stream := range streams {
+			Expect(stream.CloseSend()).To(Succeed())
+			Expect(stream.RecvMsg(&app.SendEventsAck{})).To(Succeed())
+		}
+	})
+})
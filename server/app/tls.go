@@ -0,0 +1,172 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/logger"
+)
+
+// CertReloader serves the certificate and client CA files of server.tls, reloading
+// them when they change so rotated certificates are used without a restart
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	interval     time.Duration
+	log          logger.Logger
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+// NewCertReloader ctor, the files are checked for changes on handshakes at most once
+// every interval and requests keep the loaded files if the new ones are invalid
+func NewCertReloader(
+	certFile, keyFile, clientCAFile string,
+	interval time.Duration,
+	log logger.Logger,
+) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		interval:     interval,
+		log: log.WithFields(map[string]interface{}{
+			"source":   "app/tls",
+			"certFile": certFile,
+		}),
+	}
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newServerTLSConfig returns the TLS config of server.tls, or nil if it's disabled
+func newServerTLSConfig(config *viper.Viper, log logger.Logger) (*tls.Config, error) {
+	certFile := config.GetString("server.tls.certFile")
+	keyFile := config.GetString("server.tls.keyFile")
+	clientCAFile := config.GetString("server.tls.clientCAFile")
+
+	if !config.GetBool("server.tls.enabled") {
+		if certFile != "" || keyFile != "" || clientCAFile != "" {
+			return nil, errors.New("server.tls settings are set but server.tls.enabled is false")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("server.tls.certFile and server.tls.keyFile are required by server.tls.enabled")
+	}
+	r, err := NewCertReloader(certFile, keyFile, clientCAFile, config.GetDuration("server.tls.reloadInterval"), log)
+	if err != nil {
+		return nil, err
+	}
+	return r.TLSConfig(), nil
+}
+
+// TLSConfig returns a config that gets the current certificates on every handshake
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+func (r *CertReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < r.interval {
+		return r.config
+	}
+	r.checkedAt = time.Now()
+	modTimes, err := r.statFiles()
+	if err != nil {
+		r.log.WithError(err).Error("failed to check tls files, keeping the loaded ones")
+		return r.config
+	}
+	if !changed(modTimes, r.modTimes) {
+		return r.config
+	}
+	if err := r.load(modTimes); err != nil {
+		r.log.WithError(err).Error("failed to reload tls files, keeping the loaded ones")
+		return r.config
+	}
+	r.log.Info("reloaded tls files")
+	return r.config
+}
+
+// load must be called holding mu, except on the ctor
+func (r *CertReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("server.tls certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// grpc only sets it on the base config, not on the one of GetConfigForClient,
+		// and clients enforce it
+		NextProtos: []string{"h2"},
+	}
+	if r.clientCAFile != "" {
+		ca, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("server.tls.clientCAFile: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("server.tls.clientCAFile %s has no PEM certificates", r.clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.config = config
+	r.modTimes = modTimes
+	r.checkedAt = time.Now()
+	return nil
+}
+
+func (r *CertReloader) statFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func changed(a, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// testCA signs the certificates of the tls tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "eventsgateway test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of commonName, valid for localhost
+func (ca *testCA) issue(commonName string, serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		ca           *testCA
+		directory    string
+		certFile     string
+		keyFile      string
+		clientCAFile string
+		modTime      time.Time
+	)
+
+	// writeFile writes content to file, moving its modification time forward so
+	// changes are noticed on file systems with coarse timestamps
+	writeFile := func(file string, content []byte) {
+		Expect(os.WriteFile(file, content, 0o600)).To(Succeed())
+		modTime = modTime.Add(time.Second)
+		Expect(os.Chtimes(file, modTime, modTime)).To(Succeed())
+	}
+
+	writeServerCert := func(commonName string, serial int64) {
+		cert, key := ca.issue(commonName, serial)
+		writeFile(certFile, cert)
+		writeFile(keyFile, key)
+	}
+
+	// serve serves the health service over tlsConfig
+	serve := func(tlsConfig *tls.Config) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+		healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+		go grpcServer.Serve(listener)
+		DeferCleanup(grpcServer.Stop)
+		return listener.Addr().String()
+	}
+
+	// call makes a health check on a new connection to address, returning the state
+	// of its tls connection
+	call := func(address string, certificates ...tls.Certificate) (*tls.ConnectionState, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certificates,
+		})))
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		var p peer.Peer
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p))
+		if err != nil {
+			return nil, err
+		}
+		state := p.AuthInfo.(credentials.TLSInfo).State
+		return &state, nil
+	}
+
+	servedCommonName := func(address string) string {
+		state, err := call(address)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.NegotiatedProtocol).To(Equal("h2"))
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+
+	BeforeEach(func() {
+		ca = newTestCA()
+		modTime = time.Now()
+		directory = GinkgoT().TempDir()
+		certFile = filepath.Join(directory, "server.crt")
+		keyFile = filepath.Join(directory, "server.key")
+		clientCAFile = filepath.Join(directory, "ca.crt")
+		writeServerCert("first", 2)
+		writeFile(clientCAFile, ca.pem)
+	})
+
+	It("should serve rotated certificates without a restart", func() {
+		r, err := app.NewCertReloader(certFile, keyFile, "", 0, log)
+		Expect(err).NotTo(HaveOccurred())
+		tlsConfig := r.TLSConfig()
+		Expect(servedCommonName(serve(tlsConfig))).To(Equal("first"))
+
+		writeServerCert("second", 3)
+		Expect(servedCommonName(serve(tlsConfig))).To(Equal("second"))
+	})
+
+	It("should keep the loaded certificate if the new one is invalid", func() {
+		r, err := app.NewCertReloader(certFile, keyFile, "", 0, log)
+		Expect(err).NotTo(HaveOccurred())
+		tlsConfig := r.TLSConfig()
+
+		writeFile(keyFile, []byte("not a key"))
+		Expect(servedCommonName(serve(tlsConfig))).To(Equal("first"))
+	})
+
+	It("should only check the files once every interval", func() {
+		r, err := app.NewCertReloader(certFile, keyFile, "", time.Hour, log)
+		Expect(err).NotTo(HaveOccurred())
+		tlsConfig := r.TLSConfig()
+
+		writeServerCert("second", 3)
+		Expect(servedCommonName(serve(tlsConfig))).To(Equal("first"))
+	})
+
+	It("should require client certificates signed by the client CA", func() {
+		r, err := app.NewCertReloader(certFile, keyFile, clientCAFile, 0, log)
+		Expect(err).NotTo(HaveOccurred())
+		address := serve(r.TLSConfig())
+
+		_, err = call(address)
+		Expect(err).To(HaveOccurred())
+
+		certPEM, keyPEM := ca.issue("game-server", 4)
+		clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = call(address, clientCert)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should serve grpc over mutual TLS on the app server", func() {
+		cfg := initConfig()
+		cfg.Set("forwarder.type", forwarder.TypeStdout)
+		cfg.Set("server.tls.enabled", true)
+		cfg.Set("server.tls.certFile", certFile)
+		cfg.Set("server.tls.keyFile", keyFile)
+		cfg.Set("server.tls.clientCAFile", clientCAFile)
+		a, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).NotTo(HaveOccurred())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go a.GRPCServer().Serve(listener)
+		DeferCleanup(a.GRPCServer().Stop)
+		address := listener.Addr().String()
+
+		_, err = call(address)
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+
+		certPEM, keyPEM := ca.issue("game-server", 4)
+		clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		state, err := call(address, clientCert)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.NegotiatedProtocol).To(Equal("h2"))
+		Expect(state.PeerCertificates[0].Subject.CommonName).To(Equal("first"))
+	})
+
+	It("should fail to create the app with inconsistent settings", func() {
+		cfg := initConfig()
+		cfg.Set("forwarder.type", forwarder.TypeStdout)
+		cfg.Set("server.tls.certFile", certFile)
+		_, err := app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(MatchError("server.tls settings are set but server.tls.enabled is false"))
+
+		cfg.Set("server.tls.enabled", true)
+		_, err = app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(MatchError("server.tls.certFile and server.tls.keyFile are required by server.tls.enabled"))
+
+		cfg.Set("server.tls.keyFile", filepath.Join(directory, "missing.key"))
+		_, err = app.NewApp("localhost", 0, log, cfg)
+		Expect(err).To(HaveOccurred())
+
+		cfg.Set("server.tls.keyFile", keyFile)
+		_, err = app.NewApp("localhost", 0, log, cfg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
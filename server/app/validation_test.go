@@ -0,0 +1,57 @@
+//go:build unit
+// +build unit
+
+package app_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/app"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// methodStream tells grpc.Method which method a context belongs to, keeping the
+// trailer set by the handler
+type methodStream struct {
+	method  string
+	trailer metadata.MD
+}
+
+func (m *methodStream) Method() string               { return m.method }
+func (m *methodStream) SetHeader(metadata.MD) error  { return nil }
+func (m *methodStream) SendHeader(metadata.MD) error { return nil }
+func (m *methodStream) SetTrailer(md metadata.MD) error {
+	m.trailer = metadata.Join(m.trailer, md)
+	return nil
+}
+
+var _ = Describe("Validation", func() {
+	It("should report invalid events of a batch in the rejected indexes trailer", func() {
+		cfg := initConfig()
+		cfg.Set("validation.rules", []map[string]interface{}{
+			{"topic": "purchases", "required": []string{"userId"}},
+		})
+		s := app.NewServer(newKafkaSender(cfg), log)
+		mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any())
+
+		nowMs := time.Now().UnixNano() / 1000000
+		transportStream := &methodStream{method: "/eventsgateway.GRPCForwarder/SendEvents"}
+		ctx := grpc.NewContextWithServerTransportStream(context.Background(), transportStream)
+		res, err := s.SendEvents(ctx, &pb.SendEventsRequest{
+			Id: "batch",
+			Events: []*pb.Event{
+				{Id: "valid", Name: "purchase", Topic: "purchases", Props: map[string]string{"userId": "u-1"}, Timestamp: nowMs},
+				{Id: "invalid", Name: "purchase", Topic: "purchases", Props: map[string]string{}, Timestamp: nowMs},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.FailureIndexes).To(BeEmpty())
+		Expect(transportStream.trailer.Get(app.RejectedIndexesMetadata)).To(Equal([]string{"1"}))
+	})
+})
@@ -0,0 +1,429 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+)
+
+// Clusters reported by FailoverForwarder.Active
+const (
+	ClusterPrimary   = "primary"
+	ClusterSecondary = "secondary"
+)
+
+// unavailableErrors are the kafka errors of brokers that can't be reached
+var unavailableErrors = []error{
+	sarama.ErrOutOfBrokers,
+	sarama.ErrNotConnected,
+	sarama.ErrBrokerNotAvailable,
+	sarama.ErrLeaderNotAvailable,
+	sarama.ErrRequestTimedOut,
+}
+
+func isUnavailableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, unavailable := range unavailableErrors {
+		if errors.Is(err, unavailable) {
+			return true
+		}
+	}
+	return false
+}
+
+// FailoverPolicy decides when FailoverForwarder switches clusters
+type FailoverPolicy struct {
+	// ErrorRate of the messages sent to the primary within Window that triggers the
+	// failover, once at least MinRequests were sent in the window
+	ErrorRate   float64
+	Window      time.Duration
+	MinRequests int
+	// UnavailableFor is how long the primary brokers can fail as unreachable before
+	// the failover, it's disabled if zero
+	UnavailableFor time.Duration
+	// CheckInterval is the interval the primary is checked at while failed over, it
+	// fails back after RecoveryChecks successful checks in a row
+	CheckInterval  time.Duration
+	RecoveryChecks int
+}
+
+// FailoverForwarder produces to a primary forwarder and switches to a secondary one
+// while the primary is failing
+type FailoverForwarder struct {
+	primary      Forwarder
+	secondary    Forwarder
+	checkPrimary func() error
+	policy       FailoverPolicy
+
+	mu               sync.Mutex
+	active           string
+	windowStart      time.Time
+	requests         int
+	failures         int
+	unavailableSince time.Time
+	closed           chan struct{}
+	closeOnce        sync.Once
+}
+
+// NewFailoverForwarder ctor, checkPrimary returns nil when the primary can take
+// messages again
+func NewFailoverForwarder(
+	primary, secondary Forwarder,
+	checkPrimary func() error,
+	policy FailoverPolicy,
+) (*FailoverForwarder, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	f := &FailoverForwarder{
+		primary:      primary,
+		secondary:    secondary,
+		checkPrimary: checkPrimary,
+		policy:       policy,
+		windowStart:  time.Now(),
+		closed:       make(chan struct{}),
+	}
+	f.setActive(ClusterPrimary)
+	return f, nil
+}
+
+func (p FailoverPolicy) validate() error {
+	switch {
+	case p.ErrorRate < 0 || p.ErrorRate > 1:
+		return errors.New("errorRate should be between 0 and 1")
+	case p.Window <= 0:
+		return errors.New("window should be positive")
+	case p.MinRequests <= 0:
+		return errors.New("minRequests should be positive")
+	case p.UnavailableFor < 0:
+		return errors.New("unavailableFor can't be negative")
+	case p.CheckInterval <= 0:
+		return errors.New("checkInterval should be positive")
+	case p.RecoveryChecks <= 0:
+		return errors.New("recoveryChecks should be positive")
+	}
+	return nil
+}
+
+// NewFailoverKafkaForwarder returns a FailoverForwarder from the cluster in
+// kafka.producer.brokers to the one in kafka.producer.secondary.brokers, it starts
+// while either of them is up, failed over if it's the secondary
+func NewFailoverKafkaForwarder(config *viper.Viper) (*FailoverForwarder, error) {
+	policy := FailoverPolicy{
+		ErrorRate:      config.GetFloat64("kafka.producer.failover.errorRate"),
+		Window:         config.GetDuration("kafka.producer.failover.window"),
+		MinRequests:    config.GetInt("kafka.producer.failover.minRequests"),
+		UnavailableFor: config.GetDuration("kafka.producer.failover.unavailableFor"),
+		CheckInterval:  config.GetDuration("kafka.producer.failover.checkInterval"),
+		RecoveryChecks: config.GetInt("kafka.producer.failover.recoveryChecks"),
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("kafka.producer.failover: %w", err)
+	}
+	kafkaConf, err := newSaramaConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	primaryBrokers := config.GetString("kafka.producer.brokers")
+	// a cluster that's down is dialed again at most once per checkInterval
+	primary, primaryErr := newDialingKafkaForwarder(config, primaryBrokers, policy.CheckInterval)
+	secondary, secondaryErr := newDialingKafkaForwarder(
+		config,
+		config.GetString("kafka.producer.secondary.brokers"),
+		policy.CheckInterval,
+	)
+	if primaryErr != nil && secondaryErr != nil {
+		return nil, fmt.Errorf("primary: %w, secondary: %v", primaryErr, secondaryErr)
+	}
+	checkPrimary := func() error {
+		// creating a client fetches the cluster metadata from the brokers
+		client, err := sarama.NewClient(strings.Split(primaryBrokers, ","), kafkaConf)
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+	f, err := NewFailoverForwarder(primary, secondary, checkPrimary, policy)
+	if err != nil {
+		return nil, err
+	}
+	if primaryErr != nil {
+		f.mu.Lock()
+		f.failOver()
+		f.mu.Unlock()
+	}
+	return f, nil
+}
+
+// Active returns the cluster messages are being produced to
+func (f *FailoverForwarder) Active() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// Produce sends message to the active cluster, messages that fail on the primary and
+// make it fail over are sent again to the secondary
+func (f *FailoverForwarder) Produce(
+	ctx context.Context,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) (int32, int64, error) {
+	if f.Active() == ClusterSecondary {
+		return f.secondary.Produce(ctx, topic, key, headers, message)
+	}
+	partition, offset, err := f.primary.Produce(ctx, topic, key, headers, message)
+	if ctx.Err() != nil {
+		// the caller gave up, which says nothing about the cluster
+		return partition, offset, err
+	}
+	if f.record(err) {
+		return f.secondary.Produce(ctx, topic, key, headers, message)
+	}
+	return partition, offset, err
+}
+
+// record accounts the result of a message sent to the primary, returning whether it
+// made the forwarder fail over
+func (f *FailoverForwarder) record(err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active != ClusterPrimary {
+		// another message already failed over
+		return err != nil
+	}
+
+	now := time.Now()
+	if now.Sub(f.windowStart) >= f.policy.Window {
+		f.windowStart = now
+		f.requests = 0
+		f.failures = 0
+	}
+	f.requests++
+	if err == nil {
+		f.unavailableSince = time.Time{}
+		return false
+	}
+	if IsPermanentError(err) {
+		// the message is the problem, not the cluster
+		return false
+	}
+	f.failures++
+	if isUnavailableError(err) && f.unavailableSince.IsZero() {
+		f.unavailableSince = now
+	}
+
+	tooManyErrors := f.requests >= f.policy.MinRequests &&
+		float64(f.failures)/float64(f.requests) >= f.policy.ErrorRate
+	unavailable := f.policy.UnavailableFor > 0 && !f.unavailableSince.IsZero() &&
+		now.Sub(f.unavailableSince) >= f.policy.UnavailableFor
+	if !tooManyErrors && !unavailable {
+		return false
+	}
+	f.failOver()
+	return true
+}
+
+// failOver switches to the secondary until the primary recovers, it must be called
+// holding mu
+func (f *FailoverForwarder) failOver() {
+	f.setActive(ClusterSecondary)
+	go f.recoveryRoutine()
+}
+
+// recoveryRoutine checks the primary until it recovers, then fails back
+func (f *FailoverForwarder) recoveryRoutine() {
+	ticker := time.NewTicker(f.policy.CheckInterval)
+	defer ticker.Stop()
+	healthyChecks := 0
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-ticker.C:
+			if err := f.checkPrimary(); err != nil {
+				healthyChecks = 0
+				continue
+			}
+			healthyChecks++
+			if healthyChecks < f.policy.RecoveryChecks {
+				continue
+			}
+			f.mu.Lock()
+			f.windowStart = time.Now()
+			f.requests = 0
+			f.failures = 0
+			f.unavailableSince = time.Time{}
+			f.setActive(ClusterPrimary)
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// setActive must be called holding mu, except on the ctor
+func (f *FailoverForwarder) setActive(cluster string) {
+	f.active = cluster
+	for _, c := range []string{ClusterPrimary, ClusterSecondary} {
+		value := 0.0
+		if c == cluster {
+			value = 1
+		}
+		metrics.KafkaActiveCluster.WithLabelValues(c).Set(value)
+	}
+}
+
+// Check returns an error if messages to topics can't be produced to any of the
+// clusters, since the secondary takes them while the primary is failing
+func (f *FailoverForwarder) Check(topics []string) error {
+	err := check(f.primary, topics)
+	if err == nil {
+		return nil
+	}
+	if secondaryErr := check(f.secondary, topics); secondaryErr != nil {
+		return fmt.Errorf("primary: %w, secondary: %v", err, secondaryErr)
+	}
+	return nil
+}
+
+// check returns the error of forwarder's Check, forwarders that aren't a Checker
+// can always produce
+func check(forwarder Forwarder, topics []string) error {
+	if checker, ok := forwarder.(Checker); ok {
+		return checker.Check(topics)
+	}
+	return nil
+}
+
+// Close stops checking the primary and closes both clusters
+func (f *FailoverForwarder) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	var errs []error
+	for _, forwarder := range []Forwarder{f.primary, f.secondary} {
+		if closer, ok := forwarder.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dialingKafkaForwarder is a KafkaForwarder of a cluster that may be down, it's
+// connected on the first message or check after the cluster is back. It's dialed
+// once at a time and at most once per backoff, returning the last dial error
+// meanwhile
+type dialingKafkaForwarder struct {
+	dial    func() (*KafkaForwarder, error)
+	backoff time.Duration
+
+	mu        sync.Mutex
+	forwarder *KafkaForwarder
+	closed    bool
+	dialing   bool
+	dialErr   error
+	retryAt   time.Time
+}
+
+// newDialingKafkaForwarder returns the forwarder of brokers, with the error of
+// connecting to them if they're down
+func newDialingKafkaForwarder(
+	config *viper.Viper,
+	brokers string,
+	backoff time.Duration,
+) (*dialingKafkaForwarder, error) {
+	d := &dialingKafkaForwarder{
+		dial: func() (*KafkaForwarder, error) {
+			return newKafkaForwarder(config, brokers)
+		},
+		backoff: backoff,
+	}
+	_, err := d.get()
+	return d, err
+}
+
+func (d *dialingKafkaForwarder) get() (*KafkaForwarder, error) {
+	d.mu.Lock()
+	switch {
+	case d.closed:
+		d.mu.Unlock()
+		return nil, sarama.ErrClosedClient
+	case d.forwarder != nil:
+		forwarder := d.forwarder
+		d.mu.Unlock()
+		return forwarder, nil
+	case d.dialing || time.Now().Before(d.retryAt):
+		err := d.dialErr
+		d.mu.Unlock()
+		return nil, err
+	}
+	d.dialing = true
+	d.mu.Unlock()
+
+	forwarder, err := d.dial()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialing = false
+	if err != nil {
+		d.dialErr = err
+		d.retryAt = time.Now().Add(d.backoff)
+		return nil, err
+	}
+	if d.closed {
+		// closed while dialing
+		forwarder.Close()
+		return nil, sarama.ErrClosedClient
+	}
+	d.forwarder = forwarder
+	return forwarder, nil
+}
+
+func (d *dialingKafkaForwarder) Produce(
+	ctx context.Context,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) (int32, int64, error) {
+	forwarder, err := d.get()
+	if err != nil {
+		return 0, 0, err
+	}
+	return forwarder.Produce(ctx, topic, key, headers, message)
+}
+
+func (d *dialingKafkaForwarder) Check(topics []string) error {
+	forwarder, err := d.get()
+	if err != nil {
+		return err
+	}
+	return forwarder.Check(topics)
+}
+
+func (d *dialingKafkaForwarder) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.forwarder == nil {
+		return nil
+	}
+	return d.forwarder.Close()
+}
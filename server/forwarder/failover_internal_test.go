@@ -0,0 +1,82 @@
+//go:build unit
+// +build unit
+
+package forwarder
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dialingKafkaForwarder", func() {
+	var (
+		dials   atomic.Int32
+		release chan struct{}
+		d       *dialingKafkaForwarder
+	)
+
+	downErr := errors.New("cluster is down")
+
+	BeforeEach(func() {
+		dials.Store(0)
+		release = make(chan struct{})
+		close(release)
+		d = &dialingKafkaForwarder{
+			dial: func() (*KafkaForwarder, error) {
+				dials.Add(1)
+				<-release
+				return nil, downErr
+			},
+			backoff: 50 * time.Millisecond,
+		}
+	})
+
+	It("should return the last dial error while backing off", func() {
+		_, err := d.get()
+		Expect(err).To(MatchError(downErr))
+		for i := 0; i < 10; i++ {
+			_, err = d.get()
+			Expect(err).To(MatchError(downErr))
+		}
+		Expect(dials.Load()).To(Equal(int32(1)))
+
+		Eventually(func() int32 {
+			d.get()
+			return dials.Load()
+		}).Should(Equal(int32(2)))
+	})
+
+	It("should not wait for the dial in flight", func() {
+		d.get()
+		time.Sleep(d.backoff)
+		release = make(chan struct{})
+		dialed := make(chan error)
+		go func() {
+			_, err := d.get()
+			dialed <- err
+		}()
+		Eventually(dials.Load).Should(Equal(int32(2)))
+
+		done := make(chan error)
+		go func() {
+			_, err := d.get()
+			done <- err
+		}()
+		Eventually(done).Should(Receive(MatchError(downErr)))
+		Expect(dials.Load()).To(Equal(int32(2)))
+		close(release)
+		Eventually(dialed).Should(Receive(MatchError(downErr)))
+	})
+
+	It("should not dial once closed", func() {
+		Expect(d.Close()).To(Succeed())
+		_, err := d.get()
+		Expect(err).To(MatchError(sarama.ErrClosedClient))
+		Expect(dials.Load()).To(BeZero())
+	})
+})
@@ -0,0 +1,310 @@
+//go:build unit
+// +build unit
+
+package forwarder_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+)
+
+// stubForwarder fails with err, if it's set, and counts its messages, its Check
+// fails with checkErr
+type stubForwarder struct {
+	mu       sync.Mutex
+	err      error
+	checkErr error
+	messages int
+	closed   bool
+}
+
+func (s *stubForwarder) Produce(ctx context.Context, topic, key string, headers map[string]string, message []byte) (int32, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages++
+	return 0, int64(s.messages - 1), s.err
+}
+
+func (s *stubForwarder) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *stubForwarder) Check(topics []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkErr
+}
+
+func (s *stubForwarder) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *stubForwarder) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *stubForwarder) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages
+}
+
+var _ = Describe("FailoverForwarder", func() {
+	var (
+		primary   *stubForwarder
+		secondary *stubForwarder
+		primaryUp atomic.Bool
+		policy    forwarder.FailoverPolicy
+		f         *forwarder.FailoverForwarder
+	)
+
+	produce := func() error {
+		_, _, err := f.Produce(context.Background(), "topic", "", nil, []byte("message"))
+		return err
+	}
+
+	BeforeEach(func() {
+		primary = &stubForwarder{}
+		secondary = &stubForwarder{}
+		primaryUp.Store(false)
+		policy = forwarder.FailoverPolicy{
+			ErrorRate:      0.5,
+			Window:         time.Minute,
+			MinRequests:    4,
+			CheckInterval:  5 * time.Millisecond,
+			RecoveryChecks: 3,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		f, err = forwarder.NewFailoverForwarder(primary, secondary, func() error {
+			if !primaryUp.Load() {
+				return errors.New("primary is down")
+			}
+			return nil
+		}, policy)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		f.Close()
+	})
+
+	It("should fail over once the error rate of the primary is reached", func() {
+		Expect(produce()).To(Succeed())
+		Expect(produce()).To(Succeed())
+		primary.setErr(sarama.ErrNotEnoughReplicas)
+		Expect(produce()).To(MatchError(sarama.ErrNotEnoughReplicas))
+		Expect(f.Active()).To(Equal(forwarder.ClusterPrimary))
+
+		// the message that reaches the error rate is sent again to the secondary
+		Expect(produce()).To(Succeed())
+		Expect(f.Active()).To(Equal(forwarder.ClusterSecondary))
+		Expect(secondary.count()).To(Equal(1))
+		Expect(testutil.ToFloat64(metrics.KafkaActiveCluster.WithLabelValues(forwarder.ClusterSecondary))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(metrics.KafkaActiveCluster.WithLabelValues(forwarder.ClusterPrimary))).To(Equal(float64(0)))
+
+		Expect(produce()).To(Succeed())
+		Expect(primary.count()).To(Equal(4))
+		Expect(secondary.count()).To(Equal(2))
+	})
+
+	It("should not fail over for errors of the messages", func() {
+		primary.setErr(sarama.ErrMessageSizeTooLarge)
+		for i := 0; i < 10; i++ {
+			Expect(produce()).To(MatchError(sarama.ErrMessageSizeTooLarge))
+		}
+		Expect(f.Active()).To(Equal(forwarder.ClusterPrimary))
+		Expect(secondary.count()).To(BeZero())
+	})
+
+	It("should not count messages whose context is done", func() {
+		primary.setErr(context.Canceled)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for i := 0; i < 10; i++ {
+			_, _, err := f.Produce(ctx, "topic", "", nil, []byte("message"))
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(f.Active()).To(Equal(forwarder.ClusterPrimary))
+	})
+
+	Describe("with an unavailable window", func() {
+		BeforeEach(func() {
+			policy.MinRequests = 1000
+			policy.UnavailableFor = 20 * time.Millisecond
+		})
+
+		It("should fail over once the primary brokers are unreachable for the window", func() {
+			primary.setErr(sarama.ErrOutOfBrokers)
+			Expect(produce()).To(MatchError(sarama.ErrOutOfBrokers))
+			time.Sleep(policy.UnavailableFor)
+			Expect(produce()).To(Succeed())
+			Expect(f.Active()).To(Equal(forwarder.ClusterSecondary))
+		})
+
+		It("should restart the window when the primary succeeds", func() {
+			primary.setErr(sarama.ErrOutOfBrokers)
+			Expect(produce()).To(HaveOccurred())
+			time.Sleep(policy.UnavailableFor)
+			primary.setErr(nil)
+			Expect(produce()).To(Succeed())
+			primary.setErr(sarama.ErrOutOfBrokers)
+			Expect(produce()).To(HaveOccurred())
+			Expect(f.Active()).To(Equal(forwarder.ClusterPrimary))
+		})
+	})
+
+	It("should fail back once the primary passes the recovery checks", func() {
+		primary.setErr(sarama.ErrOutOfBrokers)
+		for i := 0; i < policy.MinRequests; i++ {
+			produce()
+		}
+		Expect(f.Active()).To(Equal(forwarder.ClusterSecondary))
+
+		Consistently(f.Active, 50*time.Millisecond).Should(Equal(forwarder.ClusterSecondary))
+		primary.setErr(nil)
+		primaryUp.Store(true)
+		Eventually(f.Active).Should(Equal(forwarder.ClusterPrimary))
+		Expect(testutil.ToFloat64(metrics.KafkaActiveCluster.WithLabelValues(forwarder.ClusterPrimary))).To(Equal(float64(1)))
+
+		sent := primary.count()
+		Expect(produce()).To(Succeed())
+		Expect(primary.count()).To(Equal(sent + 1))
+	})
+
+	It("should be ready while any of the clusters can produce", func() {
+		Expect(f.Check([]string{"topic"})).To(Succeed())
+		primary.checkErr = sarama.ErrOutOfBrokers
+		Expect(f.Check([]string{"topic"})).To(Succeed())
+		secondary.checkErr = sarama.ErrUnknownTopicOrPartition
+		err := f.Check([]string{"topic"})
+		Expect(err).To(MatchError(sarama.ErrOutOfBrokers))
+		Expect(err).To(MatchError(ContainSubstring(sarama.ErrUnknownTopicOrPartition.Error())))
+	})
+
+	It("should close both clusters", func() {
+		// the app closes the forwarders that are an io.Closer on shutdown
+		var closer io.Closer = f
+		Expect(closer.Close()).To(Succeed())
+		Expect(primary.isClosed()).To(BeTrue())
+		Expect(secondary.isClosed()).To(BeTrue())
+	})
+
+	It("should fail with an invalid policy", func() {
+		policy.CheckInterval = 0
+		_, err := forwarder.NewFailoverForwarder(primary, secondary, nil, policy)
+		Expect(err).To(MatchError("checkInterval should be positive"))
+
+		policy.CheckInterval = time.Second
+		policy.ErrorRate = 2
+		_, err = forwarder.NewFailoverForwarder(primary, secondary, nil, policy)
+		Expect(err).To(MatchError("errorRate should be between 0 and 1"))
+	})
+
+	Describe("of kafka clusters", func() {
+		var (
+			broker *sarama.MockBroker
+			config *viper.Viper
+			k      *forwarder.FailoverForwarder
+		)
+
+		// unreachable is the address of a closed broker
+		var unreachable string
+
+		BeforeEach(func() {
+			broker = sarama.NewMockBroker(GinkgoT(), 1)
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(GinkgoT()),
+				"MetadataRequest": sarama.NewMockMetadataResponse(GinkgoT()).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("sometopic", 0, broker.BrokerID()),
+			})
+			closed := sarama.NewMockBroker(GinkgoT(), 2)
+			unreachable = closed.Addr()
+			closed.Close()
+
+			config = viper.New()
+			config.Set("kafka.producer.net.dialTimeout", "100ms")
+			config.Set("kafka.producer.net.readTimeout", "100ms")
+			config.Set("kafka.producer.net.writeTimeout", "100ms")
+			config.Set("kafka.producer.net.maxOpenRequests", 1)
+			config.Set("kafka.producer.maxMessageBytes", 1000000)
+			config.Set("kafka.producer.timeout", "100ms")
+			config.Set("kafka.producer.batch.size", 1000000)
+			config.Set("kafka.producer.failover.errorRate", 0.5)
+			config.Set("kafka.producer.failover.window", "30s")
+			config.Set("kafka.producer.failover.minRequests", 20)
+			config.Set("kafka.producer.failover.checkInterval", "1h")
+			config.Set("kafka.producer.failover.recoveryChecks", 3)
+		})
+
+		AfterEach(func() {
+			if k != nil {
+				k.Close()
+				k = nil
+			}
+			broker.Close()
+		})
+
+		It("should start on the primary while the secondary is down", func() {
+			config.Set("kafka.producer.brokers", broker.Addr())
+			config.Set("kafka.producer.secondary.brokers", unreachable)
+			var err error
+			k, err = forwarder.NewFailoverKafkaForwarder(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k.Active()).To(Equal(forwarder.ClusterPrimary))
+			Expect(k.Check([]string{"sometopic"})).To(Succeed())
+		})
+
+		It("should start failed over while the primary is down", func() {
+			config.Set("kafka.producer.brokers", unreachable)
+			config.Set("kafka.producer.secondary.brokers", broker.Addr())
+			var err error
+			k, err = forwarder.NewFailoverKafkaForwarder(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k.Active()).To(Equal(forwarder.ClusterSecondary))
+			Expect(k.Check([]string{"sometopic"})).To(Succeed())
+
+			Expect(k.Close()).To(Succeed())
+			err = k.Check([]string{"sometopic"})
+			Expect(err).To(MatchError(sarama.ErrClosedClient))
+			k = nil
+		})
+
+		It("should fail to start while both clusters are down", func() {
+			config.Set("kafka.producer.brokers", unreachable)
+			config.Set("kafka.producer.secondary.brokers", unreachable)
+			_, err := forwarder.NewFailoverKafkaForwarder(config)
+			Expect(err).To(MatchError(ContainSubstring("primary: ")))
+		})
+
+		It("should fail to start with an invalid policy", func() {
+			config.Set("kafka.producer.brokers", broker.Addr())
+			config.Set("kafka.producer.secondary.brokers", broker.Addr())
+			config.Set("kafka.producer.failover.checkInterval", "0s")
+			_, err := forwarder.NewFailoverKafkaForwarder(config)
+			Expect(err).To(MatchError("kafka.producer.failover: checkInterval should be positive"))
+		})
+	})
+})
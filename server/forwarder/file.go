@@ -0,0 +1,226 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+)
+
+// Formats of the files written by FileForwarder
+const (
+	// FileFormatJSONL writes a Record per line
+	FileFormatJSONL = "jsonl"
+	// FileFormatAvro writes avro object container files with the Event schema, so it
+	// only works with the avro serializer
+	FileFormatAvro = "avro"
+)
+
+// avroMagic starts every avro object container file
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// Record is a message written by the file and stdout forwarders. Message holds messages
+// that are valid JSON, like the ones of the json serializer, and MessageBase64 the others.
+type Record struct {
+	Topic         string            `json:"topic"`
+	Key           string            `json:"key,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Message       json.RawMessage   `json:"message,omitempty"`
+	MessageBase64 []byte            `json:"messageBase64,omitempty"`
+}
+
+func encodeRecord(topic, key string, headers map[string]string, message []byte) ([]byte, error) {
+	record := Record{Topic: topic, Key: key, Headers: headers}
+	if json.Valid(message) {
+		record.Message = message
+	} else {
+		record.MessageBase64 = message
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// FileForwarder writes the messages of each topic to local files in directory, starting
+// a new file when the current one reaches maxBytes or maxAge, if they're set. Files are
+// named <topic>-<creation time>.<format>.
+type FileForwarder struct {
+	directory string
+	format    string
+	maxBytes  int64
+	maxAge    time.Duration
+	mu        sync.Mutex
+	files     map[string]*rollingFile
+}
+
+type rollingFile struct {
+	file      *os.File
+	size      int64
+	messages  int64
+	createdAt time.Time
+	// sync is the marker written after each block of avro files
+	sync []byte
+}
+
+// NewFileForwarder ctor
+func NewFileForwarder(directory, format string, maxBytes int64, maxAge time.Duration) (*FileForwarder, error) {
+	if format != FileFormatJSONL && format != FileFormatAvro {
+		return nil, fmt.Errorf("invalid file format %q, should be %s or %s", format, FileFormatJSONL, FileFormatAvro)
+	}
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileForwarder{
+		directory: directory,
+		format:    format,
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		files:     map[string]*rollingFile{},
+	}, nil
+}
+
+// Produce appends message to the current file of topic, the offset returned is the
+// position of the message in that file
+func (f *FileForwarder) Produce(
+	ctx context.Context,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) (int32, int64, error) {
+	if topic == "" || strings.ContainsAny(topic, `/\`) || topic == "." || topic == ".." {
+		return -1, -1, fmt.Errorf("invalid topic %q for a file name", topic)
+	}
+
+	var data []byte
+	if f.format == FileFormatJSONL {
+		var err error
+		if data, err = encodeRecord(topic, key, headers, message); err != nil {
+			return -1, -1, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, err := f.currentFile(topic)
+	if err != nil {
+		return -1, -1, err
+	}
+	if f.format == FileFormatAvro {
+		data = avroBlock(message, current.sync)
+	}
+	n, err := current.file.Write(data)
+	current.size += int64(n)
+	if err != nil {
+		return -1, -1, err
+	}
+	current.messages++
+	return 0, current.messages - 1, nil
+}
+
+// currentFile returns the file messages of topic are written to, rolling it if needed
+func (f *FileForwarder) currentFile(topic string) (*rollingFile, error) {
+	current := f.files[topic]
+	if current != nil &&
+		(f.maxBytes <= 0 || current.size < f.maxBytes) &&
+		(f.maxAge <= 0 || time.Since(current.createdAt) < f.maxAge) {
+		return current, nil
+	}
+	if current != nil {
+		if err := current.file.Close(); err != nil {
+			return nil, err
+		}
+		delete(f.files, topic)
+	}
+
+	createdAt := time.Now()
+	name := fmt.Sprintf("%s-%s.%s", topic, createdAt.UTC().Format("20060102T150405.000000000"), f.format)
+	file, err := os.OpenFile(filepath.Join(f.directory, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	next := &rollingFile{file: file, createdAt: createdAt}
+	if f.format == FileFormatAvro {
+		next.sync = make([]byte, 16)
+		if _, err := rand.Read(next.sync); err != nil {
+			file.Close()
+			return nil, err
+		}
+		header := avroHeader(next.sync)
+		if _, err := file.Write(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+		next.size = int64(len(header))
+	}
+	f.files[topic] = next
+	return next, nil
+}
+
+// Close closes the current files
+func (f *FileForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var firstErr error
+	for topic, current := range f.files {
+		if err := current.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(f.files, topic)
+	}
+	return firstErr
+}
+
+// avroHeader is the header of an uncompressed container file of Events
+func avroHeader(sync []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(avroMagic)
+	metadata := [][2]string{
+		{"avro.schema", avro.NewEvent().Schema()},
+		{"avro.codec", "null"},
+	}
+	writeAvroLong(&buf, int64(len(metadata)))
+	for _, entry := range metadata {
+		for _, s := range entry {
+			writeAvroLong(&buf, int64(len(s)))
+			buf.WriteString(s)
+		}
+	}
+	writeAvroLong(&buf, 0)
+	buf.Write(sync)
+	return buf.Bytes()
+}
+
+// avroBlock is a container file block with the single avro encoded Event in message
+func avroBlock(message, sync []byte) []byte {
+	var buf bytes.Buffer
+	writeAvroLong(&buf, 1)
+	writeAvroLong(&buf, int64(len(message)))
+	buf.Write(message)
+	buf.Write(sync)
+	return buf.Bytes()
+}
+
+// writeAvroLong writes n zig-zag encoded, like avro longs
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutVarint(b, n)])
+}
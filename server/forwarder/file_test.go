@@ -0,0 +1,152 @@
+//go:build unit
+// +build unit
+
+package forwarder_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+)
+
+func readRecords(path string) []forwarder.Record {
+	file, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer file.Close()
+	var records []forwarder.Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record forwarder.Record
+		Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+		records = append(records, record)
+	}
+	return records
+}
+
+var _ = Describe("FileForwarder", func() {
+	var directory string
+
+	BeforeEach(func() {
+		directory = GinkgoT().TempDir()
+	})
+
+	It("should write a record per message to a file per topic", func() {
+		f, err := forwarder.NewFileForwarder(directory, forwarder.FileFormatJSONL, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, offset, err := f.Produce(context.Background(), "topic-a", "key-1", map[string]string{"event-id": "1"}, []byte(`{"id":"1"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(offset).To(Equal(int64(0)))
+		_, offset, err = f.Produce(context.Background(), "topic-a", "", nil, []byte{0, 1, 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(offset).To(Equal(int64(1)))
+		_, _, err = f.Produce(context.Background(), "topic-b", "", nil, []byte(`{"id":"3"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		files, err := filepath.Glob(filepath.Join(directory, "topic-a-*.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+		records := readRecords(files[0])
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Topic).To(Equal("topic-a"))
+		Expect(records[0].Key).To(Equal("key-1"))
+		Expect(records[0].Headers).To(Equal(map[string]string{"event-id": "1"}))
+		Expect(string(records[0].Message)).To(Equal(`{"id":"1"}`))
+		Expect(records[1].Message).To(BeEmpty())
+		Expect(records[1].MessageBase64).To(Equal([]byte{0, 1, 2}))
+
+		files, err = filepath.Glob(filepath.Join(directory, "topic-b-*.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("should roll files when they reach maxBytes", func() {
+		f, err := forwarder.NewFileForwarder(directory, forwarder.FileFormatJSONL, 10, 0)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			_, offset, err := f.Produce(context.Background(), "topic", "", nil, []byte(`{"id":"1"}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(offset).To(Equal(int64(0)))
+		}
+		Expect(f.Close()).To(Succeed())
+
+		files, err := filepath.Glob(filepath.Join(directory, "topic-*.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(3))
+	})
+
+	It("should roll files when they reach maxAge", func() {
+		f, err := forwarder.NewFileForwarder(directory, forwarder.FileFormatJSONL, 0, 10*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = f.Produce(context.Background(), "topic", "", nil, []byte(`{}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = f.Produce(context.Background(), "topic", "", nil, []byte(`{}`))
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(20 * time.Millisecond)
+		_, _, err = f.Produce(context.Background(), "topic", "", nil, []byte(`{}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		files, err := filepath.Glob(filepath.Join(directory, "topic-*.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(2))
+	})
+
+	It("should write avro events to an object container file", func() {
+		f, err := forwarder.NewFileForwarder(directory, forwarder.FileFormatAvro, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		event := avro.NewEvent()
+		event.Id = "some-id"
+		event.Name = "some-event"
+		event.Props = map[string]string{"prop": "value"}
+		var message bytes.Buffer
+		Expect(event.Serialize(&message)).To(Succeed())
+		_, _, err = f.Produce(context.Background(), "topic", "", nil, message.Bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		files, err := filepath.Glob(filepath.Join(directory, "topic-*.avro"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+		content, err := os.ReadFile(files[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(content[:4]).To(Equal([]byte{'O', 'b', 'j', 1}))
+		Expect(string(content)).To(ContainSubstring("avro.schema"))
+
+		// the header ends with the sync marker that ends every block
+		sync := content[len(content)-16:]
+		block := bytes.NewReader(content[bytes.Index(content, sync)+16:])
+		count, err := binary.ReadVarint(block)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(1)))
+		size, err := binary.ReadVarint(block)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(int64(message.Len())))
+		decoded, err := avro.DeserializeEvent(block)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(event))
+	})
+
+	It("should fail for topics that aren't valid file names", func() {
+		f, err := forwarder.NewFileForwarder(directory, forwarder.FileFormatJSONL, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = f.Produce(context.Background(), "../topic", "", nil, []byte(`{}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail for unknown formats", func() {
+		_, err := forwarder.NewFileForwarder(directory, "csv", 0, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -24,7 +24,33 @@ package forwarder
 
 import "context"
 
+// Forwarders accepted in forwarder.type
+const (
+	TypeKafka  = "kafka"
+	TypeFile   = "file"
+	TypeHTTP   = "http"
+	TypeStdout = "stdout"
+)
+
+// Headers set on every message, besides the trace context
+const (
+	HeaderEventID              = "event-id"
+	HeaderEventName            = "event-name"
+	HeaderEventClientTimestamp = "event-client-timestamp"
+	HeaderHostname             = "eventsgateway-hostname"
+	HeaderVersion              = "eventsgateway-version"
+)
+
 // Forwarder is the forwarder of the events
 type Forwarder interface {
-	Produce(ctx context.Context, topic string, message []byte) (int32, int64, error)
+	// Produce sends message to topic, key decides its partition and can be empty,
+	// headers describe the event so consumers don't need to deserialize message
+	Produce(ctx context.Context, topic, key string, headers map[string]string, message []byte) (int32, int64, error)
+}
+
+// Checker is implemented by the forwarders that can tell whether they're able to
+// produce, like the kafka ones
+type Checker interface {
+	// Check returns an error if messages to topics can't be produced
+	Check(topics []string) error
 }
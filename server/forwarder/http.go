@@ -0,0 +1,110 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Request headers set by HTTPForwarder besides the message headers
+const (
+	HTTPHeaderTopic = "eventsgateway-topic"
+	HTTPHeaderKey   = "eventsgateway-key"
+)
+
+// HTTPError is returned when the webhook answers with a non 2xx status
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("webhook returned %d: %s", e.StatusCode, e.Body)
+}
+
+// Permanent returns whether sending the message again would fail the same way
+func (e *HTTPError) Permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+// HTTPForwarder posts each message to a webhook, with the topic, key and headers as
+// request headers. A {topic} in the url is replaced by the topic of the message.
+type HTTPForwarder struct {
+	url         string
+	contentType string
+	client      *http.Client
+	headers     map[string]string
+}
+
+// NewHTTPForwarder ctor
+func NewHTTPForwarder(webhookURL, contentType string, timeout time.Duration) *HTTPForwarder {
+	headers := map[string]string{}
+	for _, h := range serverHeaders() {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	return &HTTPForwarder{
+		url:         webhookURL,
+		contentType: contentType,
+		client:      &http.Client{Timeout: timeout},
+		headers:     headers,
+	}
+}
+
+// Produce posts message to the webhook, it returns no partition nor offset
+func (h *HTTPForwarder) Produce(
+	ctx context.Context,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) (int32, int64, error) {
+	ctx, span := otel.Tracer("forwarder.http").Start(ctx, "forwarder.http.Produce")
+	span.SetAttributes(attribute.Key("topic").String(topic))
+	defer span.End()
+
+	webhookURL := strings.ReplaceAll(h.url, "{topic}", url.PathEscape(topic))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(message))
+	if err != nil {
+		return -1, -1, err
+	}
+	for _, hs := range []map[string]string{headers, h.headers} {
+		for name, value := range hs {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	req.Header.Set(HTTPHeaderTopic, topic)
+	if key != "" {
+		req.Header.Set(HTTPHeaderKey, key)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return -1, -1, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return -1, -1, &HTTPError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+	// drained so the connection is reused
+	_, _ = io.Copy(io.Discard, res.Body)
+	return -1, -1, nil
+}
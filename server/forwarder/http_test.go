@@ -0,0 +1,79 @@
+//go:build unit
+// +build unit
+
+package forwarder_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"github.com/topfreegames/eventsgateway/v4/server/version"
+)
+
+var _ = Describe("HTTPForwarder", func() {
+	var (
+		server   *httptest.Server
+		requests chan *http.Request
+		bodies   chan []byte
+		status   int
+	)
+
+	BeforeEach(func() {
+		requests = make(chan *http.Request, 1)
+		bodies = make(chan []byte, 1)
+		status = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			requests <- r
+			bodies <- body
+			w.WriteHeader(status)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should post the message with its topic, key and headers", func() {
+		h := forwarder.NewHTTPForwarder(server.URL+"/events/{topic}", "application/json", time.Second)
+		_, _, err := h.Produce(context.Background(), "some-topic", "some-key", map[string]string{
+			forwarder.HeaderEventID: "some-id",
+		}, []byte(`{"id":"some-id"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		req := <-requests
+		Expect(req.Method).To(Equal(http.MethodPost))
+		Expect(req.URL.Path).To(Equal("/events/some-topic"))
+		Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(req.Header.Get(forwarder.HTTPHeaderTopic)).To(Equal("some-topic"))
+		Expect(req.Header.Get(forwarder.HTTPHeaderKey)).To(Equal("some-key"))
+		Expect(req.Header.Get(forwarder.HeaderEventID)).To(Equal("some-id"))
+		Expect(req.Header.Get(forwarder.HeaderVersion)).To(Equal(version.Version))
+		Expect(string(<-bodies)).To(Equal(`{"id":"some-id"}`))
+	})
+
+	It("should return client errors as permanent", func() {
+		status = http.StatusBadRequest
+		h := forwarder.NewHTTPForwarder(server.URL, "application/json", time.Second)
+		_, _, err := h.Produce(context.Background(), "some-topic", "", nil, []byte(`{}`))
+		Expect(err).To(HaveOccurred())
+		Expect(forwarder.IsPermanentError(err)).To(BeTrue())
+	})
+
+	It("should return server errors and throttling as retryable", func() {
+		for _, status = range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+			h := forwarder.NewHTTPForwarder(server.URL, "application/json", time.Second)
+			_, _, err := h.Produce(context.Background(), "some-topic", "", nil, []byte(`{}`))
+			Expect(err).To(HaveOccurred())
+			Expect(forwarder.IsPermanentError(err)).To(BeFalse())
+			<-requests
+			<-bodies
+		}
+	})
+})
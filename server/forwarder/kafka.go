@@ -2,24 +2,126 @@ package forwarder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/version"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// ProducerModeSync waits for the broker response to each message before sending the next
+	ProducerModeSync = "sync"
+	// ProducerModeAsync lets sarama batch the messages of concurrent Produce calls
+	ProducerModeAsync = "async"
+
+	// PartitionerHash uses the FNV-1a hash of the key, sarama's default
+	PartitionerHash = "hash"
+	// PartitionerMurmur2 uses the murmur2 hash of the key, like the Java client
+	PartitionerMurmur2 = "murmur2"
+	// PartitionerRoundRobin ignores the key and spreads messages evenly
+	PartitionerRoundRobin = "round-robin"
 )
 
 type KafkaForwarder struct {
-	producer    sarama.SyncProducer
+	producer      sarama.SyncProducer
+	asyncProducer sarama.AsyncProducer
+	// client is the one of the producer, it's nil if the producer was given
+	client      sarama.Client
 	topicPrefix string
+	// headers are added to the headers of every message
+	headers []sarama.RecordHeader
+	// dispatched is closed once dispatchRoutine has returned every async result
+	dispatched chan struct{}
+}
+
+// permanentErrors are the kafka errors that fail again if the message is retried
+var permanentErrors = []error{
+	sarama.ErrMessageSizeTooLarge,
+	sarama.ErrInvalidMessage,
+	sarama.ErrInvalidTopic,
+	sarama.ErrInvalidRecord,
+	sarama.ErrTopicAuthorizationFailed,
+}
+
+// IsPermanentError returns whether err is a kafka or webhook error that retrying the
+// message won't fix
+func IsPermanentError(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Permanent()
+	}
+	for _, permanent := range permanentErrors {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
+
+// produceResult is sent back to the Produce call waiting for an async message
+type produceResult struct {
+	partition int32
+	offset    int64
+	err       error
 }
 
 func NewKafkaForwarder(config *viper.Viper) (*KafkaForwarder, error) {
+	return newKafkaForwarder(config, config.GetString("kafka.producer.brokers"))
+}
+
+// newKafkaForwarder returns a KafkaForwarder producing to the comma separated brokers
+func newKafkaForwarder(config *viper.Viper, brokers string) (*KafkaForwarder, error) {
+	kafkaConf, err := newSaramaConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	brokerList := strings.Split(brokers, ",")
+	topicPrefix := config.GetString("kafka.producer.topicPrefix")
+
+	mode := config.GetString("kafka.producer.mode")
+	if mode != ProducerModeSync && mode != ProducerModeAsync && mode != "" {
+		return nil, fmt.Errorf("invalid kafka.producer.mode %q, should be %s or %s", mode, ProducerModeSync, ProducerModeAsync)
+	}
+	// the producer's client is kept to check the brokers
+	client, err := sarama.NewClient(brokerList, kafkaConf)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == ProducerModeAsync {
+		producer, err := sarama.NewAsyncProducerFromClient(client)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		k := NewAsyncKafkaForwarder(producer, topicPrefix)
+		k.client = client
+		return k, nil
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &KafkaForwarder{
+		producer:    producer,
+		client:      client,
+		topicPrefix: topicPrefix,
+		headers:     serverHeaders(),
+	}, nil
+}
+
+func newSaramaConfig(config *viper.Viper) (*sarama.Config, error) {
 	if config.GetBool("kafka.logger.enabled") {
 		sarama.Logger = log.New(os.Stdout, "sarama", log.Llongfile)
 	}
@@ -41,33 +143,221 @@ func NewKafkaForwarder(config *viper.Viper) (*KafkaForwarder, error) {
 	kafkaConf.Producer.RequiredAcks = sarama.WaitForLocal
 	kafkaConf.Producer.Compression = sarama.CompressionSnappy
 	kafkaConf.ClientID = config.GetString("kafka.producer.clientId")
-	kafkaConf.Version = sarama.V3_7_1_0
-
-	brokers := strings.Split(config.GetString("kafka.producer.brokers"), ",")
-	producer, err := sarama.NewSyncProducer(brokers, kafkaConf)
+	partitioner, err := newPartitioner(config.GetString("kafka.producer.partitioner"))
 	if err != nil {
 		return nil, err
 	}
+	kafkaConf.Producer.Partitioner = partitioner
+	kafkaConf.Version = sarama.V3_7_1_0
+	if err := configureSecurity(kafkaConf, config); err != nil {
+		return nil, err
+	}
+	if err := kafkaConf.Validate(); err != nil {
+		return nil, err
+	}
+	return kafkaConf, nil
+}
 
-	topicPrefix := config.GetString("kafka.producer.topicPrefix")
+func newPartitioner(name string) (sarama.PartitionerConstructor, error) {
+	switch name {
+	case PartitionerHash, "":
+		return sarama.NewHashPartitioner, nil
+	case PartitionerMurmur2:
+		return sarama.NewCustomPartitioner(
+			sarama.WithAbsFirst(),
+			sarama.WithCustomHashFunction(newMurmur2),
+		), nil
+	case PartitionerRoundRobin:
+		return sarama.NewRoundRobinPartitioner, nil
+	default:
+		return nil, fmt.Errorf(
+			"invalid kafka.producer.partitioner %q, should be %s, %s or %s",
+			name, PartitionerHash, PartitionerMurmur2, PartitionerRoundRobin,
+		)
+	}
+}
 
-	return &KafkaForwarder{
-		producer:    producer,
-		topicPrefix: topicPrefix,
-	}, nil
+// NewAsyncKafkaForwarder returns a KafkaForwarder that sends its messages through producer,
+// which must return both successes and errors
+func NewAsyncKafkaForwarder(producer sarama.AsyncProducer, topicPrefix string) *KafkaForwarder {
+	k := &KafkaForwarder{
+		asyncProducer: producer,
+		topicPrefix:   topicPrefix,
+		headers:       serverHeaders(),
+		dispatched:    make(chan struct{}),
+	}
+	go k.dispatchRoutine()
+	return k
+}
+
+// serverHeaders identifies the server that produced a message
+func serverHeaders() []sarama.RecordHeader {
+	hostname, _ := os.Hostname()
+	return []sarama.RecordHeader{
+		{Key: []byte(HeaderHostname), Value: []byte(hostname)},
+		{Key: []byte(HeaderVersion), Value: []byte(version.Version)},
+	}
+}
+
+// dispatchRoutine sends the result of each async message to the Produce call waiting for it
+func (k KafkaForwarder) dispatchRoutine() {
+	defer close(k.dispatched)
+	successes := k.asyncProducer.Successes()
+	failures := k.asyncProducer.Errors()
+	for successes != nil || failures != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			msg.Metadata.(chan produceResult) <- produceResult{partition: msg.Partition, offset: msg.Offset}
+		case perr, ok := <-failures:
+			if !ok {
+				failures = nil
+				continue
+			}
+			perr.Msg.Metadata.(chan produceResult) <- produceResult{
+				partition: perr.Msg.Partition,
+				offset:    perr.Msg.Offset,
+				err:       perr.Err,
+			}
+		}
+	}
+}
+
+// Check returns an error if the brokers can't be reached or don't have the metadata
+// of topics, only the metadata of topics is refreshed, since refreshing it without
+// topics fetches the one of every topic in the cluster
+func (k KafkaForwarder) Check(topics []string) error {
+	if k.client == nil {
+		return nil
+	}
+	if len(topics) == 0 {
+		return k.checkBroker()
+	}
+	prefixedTopics := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		prefixedTopics = append(prefixedTopics, fmt.Sprintf("%s%s", k.topicPrefix, topic))
+	}
+	if err := k.client.RefreshMetadata(prefixedTopics...); err != nil {
+		return fmt.Errorf("can't refresh the metadata of topics %v: %w", prefixedTopics, err)
+	}
+	for _, topic := range prefixedTopics {
+		partitions, err := k.client.Partitions(topic)
+		if err != nil {
+			return fmt.Errorf("no metadata of topic %s: %w", topic, err)
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("no partitions of topic %s", topic)
+		}
+	}
+	return nil
+}
+
+// checkBroker asks a broker for its api versions, the cheapest request there is, on
+// a connection of its own so a failed check doesn't close the one of the producer
+func (k KafkaForwarder) checkBroker() error {
+	leastLoaded := k.client.LeastLoadedBroker()
+	if leastLoaded == nil {
+		return sarama.ErrOutOfBrokers
+	}
+	broker := sarama.NewBroker(leastLoaded.Addr())
+	if err := broker.Open(k.client.Config()); err != nil {
+		return err
+	}
+	defer broker.Close()
+	if _, err := broker.ApiVersions(&sarama.ApiVersionsRequest{}); err != nil {
+		return fmt.Errorf("can't reach broker %s: %w", broker.Addr(), err)
+	}
+	return nil
 }
 
-func (k KafkaForwarder) Produce(ctx context.Context, topic string, message []byte) (int32, int64, error) {
-	_, span := otel.Tracer("forwarder.kafka").Start(ctx, "forwarder.kafka.Produce")
+// Close closes the producer and its client, the results of the async messages in
+// flight are still returned to their Produce calls
+func (k KafkaForwarder) Close() error {
+	var err error
+	if k.producer != nil {
+		err = k.producer.Close()
+	}
+	if k.asyncProducer != nil {
+		// Close would read the results dispatchRoutine is waiting for, AsyncClose
+		// closes Successes and Errors once they're all returned
+		k.asyncProducer.AsyncClose()
+		<-k.dispatched
+	}
+	if k.client != nil {
+		// producers created from a client don't close it
+		if clientErr := k.client.Close(); clientErr != nil && err == nil {
+			err = clientErr
+		}
+	}
+	return err
+}
+
+func (k KafkaForwarder) Produce(
+	ctx context.Context,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) (int32, int64, error) {
+	ctx, span := otel.Tracer("forwarder.kafka").Start(ctx, "forwarder.kafka.Produce")
 	span.SetAttributes(attribute.Key("kafkaTopic").String(topic))
 	defer span.End()
 
 	prefixedTopic := fmt.Sprintf("%s%s", k.topicPrefix, topic)
 	kafkaMsg := &sarama.ProducerMessage{
-		Topic: prefixedTopic,
-		Value: sarama.ByteEncoder(message),
+		Topic:   prefixedTopic,
+		Value:   sarama.ByteEncoder(message),
+		Headers: k.recordHeaders(ctx, headers),
+	}
+	if key != "" {
+		kafkaMsg.Key = sarama.StringEncoder(key)
+	}
+
+	if k.asyncProducer != nil {
+		return k.produceAsync(ctx, kafkaMsg)
 	}
 
 	partition, offset, err := k.producer.SendMessage(kafkaMsg)
 	return partition, offset, err
 }
+
+// recordHeaders merges the event headers, the server headers and the context of the
+// Produce span, so consumers can continue the trace
+func (k KafkaForwarder) recordHeaders(ctx context.Context, headers map[string]string) []sarama.RecordHeader {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	recordHeaders := make([]sarama.RecordHeader, 0, len(headers)+len(k.headers)+len(carrier))
+	for _, h := range []map[string]string{headers, carrier} {
+		names := make([]string, 0, len(h))
+		for name := range h {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			recordHeaders = append(recordHeaders, sarama.RecordHeader{Key: []byte(name), Value: []byte(h[name])})
+		}
+	}
+	return append(recordHeaders, k.headers...)
+}
+
+func (k KafkaForwarder) produceAsync(ctx context.Context, kafkaMsg *sarama.ProducerMessage) (int32, int64, error) {
+	// buffered, so dispatchRoutine never blocks on a Produce call that gave up waiting
+	resultChannel := make(chan produceResult, 1)
+	kafkaMsg.Metadata = resultChannel
+
+	select {
+	case k.asyncProducer.Input() <- kafkaMsg:
+	case <-ctx.Done():
+		return -1, -1, ctx.Err()
+	}
+
+	select {
+	case res := <-resultChannel:
+		return res.partition, res.offset, res.err
+	case <-ctx.Done():
+		return -1, -1, ctx.Err()
+	}
+}
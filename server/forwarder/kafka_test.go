@@ -0,0 +1,265 @@
+//go:build unit
+// +build unit
+
+package forwarder_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"github.com/topfreegames/eventsgateway/v4/server/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// stalledProducer never takes messages from its input
+type stalledProducer struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func (s *stalledProducer) Input() chan<- *sarama.ProducerMessage     { return s.input }
+func (s *stalledProducer) Successes() <-chan *sarama.ProducerMessage { return s.successes }
+func (s *stalledProducer) Errors() <-chan *sarama.ProducerError      { return s.errors }
+func (s *stalledProducer) AsyncClose()                               {}
+
+var _ = Describe("KafkaForwarder", func() {
+	var producer *mocks.AsyncProducer
+
+	BeforeEach(func() {
+		conf := mocks.NewTestConfig()
+		conf.Producer.Return.Successes = true
+		producer = mocks.NewAsyncProducer(GinkgoT(), conf)
+	})
+
+	AfterEach(func() {
+		Expect(producer.Close()).To(Succeed())
+	})
+
+	Describe("async mode", func() {
+		It("should return the result of each message to its Produce call", func() {
+			producer.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+				if string(val) != "ok" {
+					return errors.New("unexpected message")
+				}
+				return nil
+			})
+			producer.ExpectInputAndFail(sarama.ErrNotEnoughReplicas)
+			producer.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+				if string(val) != "ok" {
+					return errors.New("unexpected message")
+				}
+				return nil
+			})
+			k := forwarder.NewAsyncKafkaForwarder(producer, "sv-uploads-")
+
+			_, offset, err := k.Produce(context.Background(), "sometopic", "", nil, []byte("ok"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(offset).To(Equal(int64(1)))
+
+			_, _, err = k.Produce(context.Background(), "sometopic", "", nil, []byte("fail"))
+			Expect(err).To(MatchError(sarama.ErrNotEnoughReplicas))
+
+			_, offset, err = k.Produce(context.Background(), "sometopic", "", nil, []byte("ok"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(offset).To(Equal(int64(2)))
+		})
+
+		It("should correlate results of concurrent Produce calls", func() {
+			for i := 0; i < 50; i++ {
+				producer.ExpectInputAndSucceed()
+			}
+			k := forwarder.NewAsyncKafkaForwarder(producer, "sv-uploads-")
+
+			var (
+				wg      sync.WaitGroup
+				mu      sync.Mutex
+				offsets = map[int64]bool{}
+			)
+			wg.Add(50)
+			for i := 0; i < 50; i++ {
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					_, offset, err := k.Produce(context.Background(), "sometopic", "", nil, []byte("ok"))
+					Expect(err).NotTo(HaveOccurred())
+					mu.Lock()
+					offsets[offset] = true
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			Expect(offsets).To(HaveLen(50))
+		})
+
+		It("should attach the event, server and trace headers", func() {
+			otel.SetTextMapPropagator(propagation.TraceContext{})
+			otel.SetTracerProvider(tracesdk.NewTracerProvider())
+			defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+			p := &stalledProducer{
+				input:     make(chan *sarama.ProducerMessage),
+				successes: make(chan *sarama.ProducerMessage),
+				errors:    make(chan *sarama.ProducerError),
+			}
+			sent := make(chan *sarama.ProducerMessage, 1)
+			go func() {
+				msg := <-p.input
+				sent <- msg
+				p.successes <- msg
+			}()
+			k := forwarder.NewAsyncKafkaForwarder(p, "sv-uploads-")
+
+			_, _, err := k.Produce(context.Background(), "sometopic", "", map[string]string{
+				forwarder.HeaderEventID: "someid",
+			}, []byte("ok"))
+			Expect(err).NotTo(HaveOccurred())
+
+			headers := map[string]string{}
+			for _, h := range (<-sent).Headers {
+				headers[string(h.Key)] = string(h.Value)
+			}
+			Expect(headers).To(HaveKeyWithValue(forwarder.HeaderEventID, "someid"))
+			Expect(headers).To(HaveKeyWithValue(forwarder.HeaderVersion, version.Version))
+			Expect(headers).To(HaveKey(forwarder.HeaderHostname))
+			Expect(headers).To(HaveKeyWithValue("traceparent", MatchRegexp("^00-[0-9a-f]{32}-[0-9a-f]{16}-01$")))
+		})
+
+		It("should return the results of the messages in flight when closed", func() {
+			p := &stalledProducer{
+				input:     make(chan *sarama.ProducerMessage),
+				successes: make(chan *sarama.ProducerMessage),
+				errors:    make(chan *sarama.ProducerError),
+			}
+			k := forwarder.NewAsyncKafkaForwarder(p, "sv-uploads-")
+			produced := make(chan error)
+			go func() {
+				_, _, err := k.Produce(context.Background(), "sometopic", "", nil, []byte("ok"))
+				produced <- err
+			}()
+			msg := <-p.input
+
+			closed := make(chan error)
+			go func() {
+				closed <- k.Close()
+			}()
+			Consistently(closed).ShouldNot(Receive())
+
+			// the producer returns its results, then closes the channels
+			p.successes <- msg
+			close(p.successes)
+			close(p.errors)
+			Eventually(produced).Should(Receive(BeNil()))
+			Eventually(closed).Should(Receive(BeNil()))
+		})
+
+		It("should stop waiting when the context is done", func() {
+			k := forwarder.NewAsyncKafkaForwarder(&stalledProducer{
+				input:     make(chan *sarama.ProducerMessage),
+				successes: make(chan *sarama.ProducerMessage),
+				errors:    make(chan *sarama.ProducerError),
+			}, "sv-uploads-")
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, _, err := k.Produce(ctx, "sometopic", "", nil, []byte("ok"))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+
+	Describe("Check", func() {
+		var (
+			broker *sarama.MockBroker
+			k      *forwarder.KafkaForwarder
+		)
+
+		BeforeEach(func() {
+			broker = sarama.NewMockBroker(GinkgoT(), 1)
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(GinkgoT()),
+				"MetadataRequest": sarama.NewMockMetadataResponse(GinkgoT()).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("sv-uploads-sometopic", 0, broker.BrokerID()),
+			})
+
+			config := viper.New()
+			config.Set("kafka.producer.brokers", broker.Addr())
+			config.Set("kafka.producer.topicPrefix", "sv-uploads-")
+			config.Set("kafka.producer.partitioner", forwarder.PartitionerHash)
+			config.Set("kafka.producer.net.maxOpenRequests", 1)
+			config.Set("kafka.producer.net.dialTimeout", "100ms")
+			config.Set("kafka.producer.net.readTimeout", "100ms")
+			config.Set("kafka.producer.net.writeTimeout", "100ms")
+			config.Set("kafka.producer.maxMessageBytes", 1000000)
+			config.Set("kafka.producer.timeout", "100ms")
+			config.Set("kafka.producer.batch.size", 1000000)
+			var err error
+			k, err = forwarder.NewKafkaForwarder(config)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			if k != nil {
+				k.Close()
+			}
+			if broker != nil {
+				broker.Close()
+			}
+		})
+
+		metadataRequests := func() []*sarama.MetadataRequest {
+			var requests []*sarama.MetadataRequest
+			for _, item := range broker.History() {
+				if request, ok := item.Request.(*sarama.MetadataRequest); ok {
+					requests = append(requests, request)
+				}
+			}
+			return requests
+		}
+
+		It("should succeed while the brokers have the metadata of the topics", func() {
+			Expect(k.Check(nil)).To(Succeed())
+			Expect(k.Check([]string{"sometopic"})).To(Succeed())
+		})
+
+		It("should only refresh the metadata of the topics", func() {
+			sent := len(metadataRequests())
+			Expect(k.Check(nil)).To(Succeed())
+			Expect(metadataRequests()).To(HaveLen(sent))
+			Expect(k.Check([]string{"sometopic"})).To(Succeed())
+			requests := metadataRequests()
+			Expect(requests).To(HaveLen(sent + 1))
+			Expect(requests[sent].Topics).To(Equal([]string{"sv-uploads-sometopic"}))
+		})
+
+		It("should fail without the metadata of a topic", func() {
+			err := k.Check([]string{"sometopic", "othertopic"})
+			Expect(err).To(MatchError(sarama.ErrUnknownTopicOrPartition))
+			Expect(err).To(MatchError(ContainSubstring("sv-uploads-othertopic")))
+		})
+
+		It("should fail once the brokers can't be reached", func() {
+			broker.Close()
+			broker = nil
+			Expect(k.Check(nil)).To(HaveOccurred())
+			Expect(k.Check([]string{"sometopic"})).To(HaveOccurred())
+		})
+
+		It("should close its client", func() {
+			Expect(k.Close()).To(Succeed())
+			Expect(k.Check([]string{"sometopic"})).To(MatchError(sarama.ErrClosedClient))
+			k = nil
+		})
+	})
+})
@@ -0,0 +1,33 @@
+//go:build unit
+// +build unit
+
+package forwarder
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("murmur2", func() {
+	DescribeTable("should match the hashes of the Java client",
+		func(key string, expected int32) {
+			h := newMurmur2()
+			h.Write([]byte(key))
+			Expect(int32(h.Sum32())).To(Equal(expected))
+		},
+		Entry("2 bytes", "21", int32(-973932308)),
+		Entry("3 bytes", "abc", int32(479470107)),
+		Entry("6 bytes", "foobar", int32(-790332482)),
+		Entry("24 bytes", "a-little-bit-long-string", int32(-985981536)),
+		Entry("26 bytes", "a-little-bit-longer-string", int32(-1486304829)),
+		Entry("48 bytes", "lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", int32(-58897971)),
+	)
+
+	It("should hash again after a reset", func() {
+		h := newMurmur2()
+		h.Write([]byte("foo"))
+		h.Reset()
+		h.Write([]byte("21"))
+		Expect(int32(h.Sum32())).To(Equal(int32(-973932308)))
+	})
+})
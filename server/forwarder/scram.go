@@ -0,0 +1,58 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package forwarder
+
+import (
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// scramClient is the client side of a SCRAM exchange, sarama only implements the
+// broker protocol around it
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	// nonce is generated by Begin if empty, tests set it to follow the RFC examples
+	nonce string
+
+	conversation *scram.ClientConversation
+}
+
+func newSCRAMClientGenerator(hashGenerator scram.HashGeneratorFcn) func() sarama.SCRAMClient {
+	return func() sarama.SCRAMClient {
+		return &scramClient{hashGenerator: hashGenerator}
+	}
+}
+
+var (
+	scramSHA256 = newSCRAMClientGenerator(scram.SHA256)
+	scramSHA512 = newSCRAMClientGenerator(scram.SHA512)
+)
+
+// Begin starts the exchange for user
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	if c.nonce != "" {
+		nonce := c.nonce
+		client = client.WithNonceGenerator(func() string { return nonce })
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+// Step returns the client message that answers challenge, the last server message
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+// Done returns whether the exchange finished
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
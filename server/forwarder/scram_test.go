@@ -0,0 +1,60 @@
+//go:build unit
+// +build unit
+
+package forwarder
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("scramClient", func() {
+	// the SCRAM-SHA-256 example of RFC 7677
+	const (
+		clientNonce = "rOprNGfwEbeRWgbNEkqO"
+		serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+		clientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+		serverFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	)
+
+	var c *scramClient
+
+	BeforeEach(func() {
+		c = scramSHA256().(*scramClient)
+		c.nonce = clientNonce
+		Expect(c.Begin("user", "pencil", "")).To(Succeed())
+	})
+
+	It("should follow the RFC example", func() {
+		Expect(c.Step("")).To(Equal("n,,n=user,r=" + clientNonce))
+		Expect(c.Step(serverFirst)).To(Equal(clientFinal))
+		Expect(c.Done()).To(BeFalse())
+		Expect(c.Step(serverFinal)).To(BeEmpty())
+		Expect(c.Done()).To(BeTrue())
+	})
+
+	It("should fail if the server signature doesn't match", func() {
+		c.Step("")
+		c.Step(serverFirst)
+		_, err := c.Step("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+		Expect(err).To(MatchError("server validation failed"))
+	})
+
+	It("should fail if the server rejects the proof", func() {
+		c.Step("")
+		c.Step(serverFirst)
+		_, err := c.Step("e=invalid-proof")
+		Expect(err).To(MatchError("server error: invalid-proof"))
+	})
+
+	It("should fail if the server nonce doesn't extend the client nonce", func() {
+		c.Step("")
+		_, err := c.Step("r=other%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should escape user names", func() {
+		Expect(c.Begin("a=b,c", "pencil", "")).To(Succeed())
+		Expect(c.Step("")).To(Equal("n,,n=a=3Db=2Cc,r=" + clientNonce))
+	})
+})
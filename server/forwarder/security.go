@@ -0,0 +1,241 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/spf13/viper"
+)
+
+// configureSecurity sets the TLS and SASL settings of kafka.producer.tls and
+// kafka.producer.sasl on kafkaConf, failing if they're inconsistent
+func configureSecurity(kafkaConf *sarama.Config, config *viper.Viper) error {
+	if err := configureTLS(kafkaConf, config); err != nil {
+		return err
+	}
+	return configureSASL(kafkaConf, config)
+}
+
+func configureTLS(kafkaConf *sarama.Config, config *viper.Viper) error {
+	caFile := config.GetString("kafka.producer.tls.caFile")
+	certFile := config.GetString("kafka.producer.tls.certFile")
+	keyFile := config.GetString("kafka.producer.tls.keyFile")
+	skipVerify := config.GetBool("kafka.producer.tls.insecureSkipVerify")
+
+	if !config.GetBool("kafka.producer.tls.enabled") {
+		if caFile != "" || certFile != "" || keyFile != "" || skipVerify {
+			return errors.New("kafka.producer.tls settings are set but kafka.producer.tls.enabled is false")
+		}
+		return nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("kafka.producer.tls.certFile and kafka.producer.tls.keyFile should be set together")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("kafka.producer.tls.caFile: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("kafka.producer.tls.caFile %s has no PEM certificates", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("kafka.producer.tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	kafkaConf.Net.TLS.Enable = true
+	kafkaConf.Net.TLS.Config = tlsConfig
+	return nil
+}
+
+func configureSASL(kafkaConf *sarama.Config, config *viper.Viper) error {
+	mechanism := config.GetString("kafka.producer.sasl.mechanism")
+	username := config.GetString("kafka.producer.sasl.username")
+	password := config.GetString("kafka.producer.sasl.password")
+
+	switch mechanism {
+	case "":
+		if username != "" || password != "" {
+			return errors.New("kafka.producer.sasl.username is set but kafka.producer.sasl.mechanism is empty")
+		}
+		return nil
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if username == "" || password == "" {
+			return fmt.Errorf("kafka.producer.sasl.username and kafka.producer.sasl.password are required by %s", mechanism)
+		}
+		kafkaConf.Net.SASL.User = username
+		kafkaConf.Net.SASL.Password = password
+		switch mechanism {
+		case sarama.SASLTypeSCRAMSHA256:
+			kafkaConf.Net.SASL.SCRAMClientGeneratorFunc = scramSHA256
+		case sarama.SASLTypeSCRAMSHA512:
+			kafkaConf.Net.SASL.SCRAMClientGeneratorFunc = scramSHA512
+		}
+	case sarama.SASLTypeOAuth:
+		if username != "" || password != "" {
+			return fmt.Errorf("kafka.producer.sasl.username and kafka.producer.sasl.password aren't used by %s", mechanism)
+		}
+		provider, err := newTokenProvider(config)
+		if err != nil {
+			return err
+		}
+		kafkaConf.Net.SASL.TokenProvider = provider
+	default:
+		return fmt.Errorf(
+			"invalid kafka.producer.sasl.mechanism %q, should be %s, %s, %s or %s", mechanism,
+			sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512, sarama.SASLTypeOAuth,
+		)
+	}
+	kafkaConf.Net.SASL.Enable = true
+	kafkaConf.Net.SASL.Handshake = true
+	kafkaConf.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+	return nil
+}
+
+// newTokenProvider returns the provider of the only one of kafka.producer.sasl.oauthbearer
+// token, tokenFile or tokenUrl that's set
+func newTokenProvider(config *viper.Viper) (sarama.AccessTokenProvider, error) {
+	token := config.GetString("kafka.producer.sasl.oauthbearer.token")
+	tokenFile := config.GetString("kafka.producer.sasl.oauthbearer.tokenFile")
+	tokenURL := config.GetString("kafka.producer.sasl.oauthbearer.tokenUrl")
+
+	set := 0
+	for _, s := range []string{token, tokenFile, tokenURL} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf(
+			"%s requires exactly one of kafka.producer.sasl.oauthbearer.token, tokenFile or tokenUrl",
+			sarama.SASLTypeOAuth,
+		)
+	}
+
+	switch {
+	case token != "":
+		return staticTokenProvider(token), nil
+	case tokenFile != "":
+		if _, err := os.Stat(tokenFile); err != nil {
+			return nil, fmt.Errorf("kafka.producer.sasl.oauthbearer.tokenFile: %w", err)
+		}
+		return fileTokenProvider(tokenFile), nil
+	default:
+		clientID := config.GetString("kafka.producer.sasl.oauthbearer.clientId")
+		clientSecret := config.GetString("kafka.producer.sasl.oauthbearer.clientSecret")
+		if clientID == "" || clientSecret == "" {
+			return nil, errors.New("kafka.producer.sasl.oauthbearer.tokenUrl requires clientId and clientSecret")
+		}
+		return &clientCredentialsTokenProvider{
+			tokenURL:     tokenURL,
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			scopes:       config.GetStringSlice("kafka.producer.sasl.oauthbearer.scopes"),
+			client:       &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+}
+
+type staticTokenProvider string
+
+func (t staticTokenProvider) Token() (*sarama.AccessToken, error) {
+	return &sarama.AccessToken{Token: string(t)}, nil
+}
+
+// fileTokenProvider reads the token on every connection, so it can be rotated by
+// whatever writes the file
+type fileTokenProvider string
+
+func (f fileTokenProvider) Token() (*sarama.AccessToken, error) {
+	token, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.AccessToken{Token: strings.TrimSpace(string(token))}, nil
+}
+
+// clientCredentialsTokenProvider gets tokens with the OAuth 2 client credentials grant,
+// reusing them until shortly before they expire
+type clientCredentialsTokenProvider struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (c *clientCredentialsTokenProvider) Token() (*sarama.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiresAt) {
+		return &sarama.AccessToken{Token: c.token}, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.scopes) > 0 {
+		form.Set("scope", strings.Join(c.scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("token endpoint returned %d: %s", res.StatusCode, message)
+	}
+	body := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("token endpoint returned no access_token")
+	}
+
+	c.token = body.AccessToken
+	// refreshed a bit earlier so connections don't start with a token about to expire
+	lifetime := time.Duration(body.ExpiresIn) * time.Second
+	c.expiresAt = time.Now().Add(lifetime - lifetime/10)
+	return &sarama.AccessToken{Token: c.token}, nil
+}
@@ -0,0 +1,211 @@
+//go:build unit
+// +build unit
+
+package forwarder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/IBM/sarama"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+// writeCertificate writes a self signed certificate and its key to directory
+func writeCertificate(directory string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "eventsgateway"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile := filepath.Join(directory, "cert.pem")
+	keyFile := filepath.Join(directory, "key.pem")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)).To(Succeed())
+	return certFile, keyFile
+}
+
+var _ = Describe("Kafka security", func() {
+	var config *viper.Viper
+
+	// secureConfig returns the default sarama config with the security settings of config
+	secureConfig := func() (*sarama.Config, error) {
+		kafkaConf := sarama.NewConfig()
+		if err := configureSecurity(kafkaConf, config); err != nil {
+			return nil, err
+		}
+		return kafkaConf, kafkaConf.Validate()
+	}
+
+	BeforeEach(func() {
+		config = viper.New()
+	})
+
+	It("should leave TLS and SASL disabled by default", func() {
+		kafkaConf, err := secureConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kafkaConf.Net.TLS.Enable).To(BeFalse())
+		Expect(kafkaConf.Net.SASL.Enable).To(BeFalse())
+	})
+
+	Describe("TLS", func() {
+		It("should load the CA and the client certificate", func() {
+			certFile, keyFile := writeCertificate(GinkgoT().TempDir())
+			config.Set("kafka.producer.tls.enabled", true)
+			config.Set("kafka.producer.tls.caFile", certFile)
+			config.Set("kafka.producer.tls.certFile", certFile)
+			config.Set("kafka.producer.tls.keyFile", keyFile)
+
+			kafkaConf, err := secureConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kafkaConf.Net.TLS.Enable).To(BeTrue())
+			Expect(kafkaConf.Net.TLS.Config.RootCAs).NotTo(BeNil())
+			Expect(kafkaConf.Net.TLS.Config.Certificates).To(HaveLen(1))
+		})
+
+		DescribeTable("should fail on inconsistent settings",
+			func(settings map[string]interface{}, message string) {
+				for key, value := range settings {
+					config.Set(key, value)
+				}
+				_, err := secureConfig()
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("files without tls enabled",
+				map[string]interface{}{"kafka.producer.tls.caFile": "ca.pem"},
+				"kafka.producer.tls.enabled is false"),
+			Entry("cert without key",
+				map[string]interface{}{"kafka.producer.tls.enabled": true, "kafka.producer.tls.certFile": "cert.pem"},
+				"should be set together"),
+			Entry("missing CA",
+				map[string]interface{}{"kafka.producer.tls.enabled": true, "kafka.producer.tls.caFile": "/nonexistent/ca.pem"},
+				"kafka.producer.tls.caFile"),
+		)
+	})
+
+	Describe("SASL", func() {
+		DescribeTable("should configure the mechanism",
+			func(mechanism string, scram bool) {
+				config.Set("kafka.producer.sasl.mechanism", mechanism)
+				config.Set("kafka.producer.sasl.username", "user")
+				config.Set("kafka.producer.sasl.password", "pencil")
+
+				kafkaConf, err := secureConfig()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(kafkaConf.Net.SASL.Enable).To(BeTrue())
+				Expect(string(kafkaConf.Net.SASL.Mechanism)).To(Equal(mechanism))
+				Expect(kafkaConf.Net.SASL.User).To(Equal("user"))
+				Expect(kafkaConf.Net.SASL.SCRAMClientGeneratorFunc != nil).To(Equal(scram))
+			},
+			Entry("PLAIN", sarama.SASLTypePlaintext, false),
+			Entry("SCRAM-SHA-256", sarama.SASLTypeSCRAMSHA256, true),
+			Entry("SCRAM-SHA-512", sarama.SASLTypeSCRAMSHA512, true),
+		)
+
+		DescribeTable("should fail on inconsistent settings",
+			func(settings map[string]interface{}, message string) {
+				for key, value := range settings {
+					config.Set(key, value)
+				}
+				_, err := secureConfig()
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("unknown mechanism",
+				map[string]interface{}{"kafka.producer.sasl.mechanism": "GSSAPI"},
+				"invalid kafka.producer.sasl.mechanism"),
+			Entry("credentials without mechanism",
+				map[string]interface{}{"kafka.producer.sasl.username": "user"},
+				"kafka.producer.sasl.mechanism is empty"),
+			Entry("SCRAM without password",
+				map[string]interface{}{"kafka.producer.sasl.mechanism": sarama.SASLTypeSCRAMSHA512, "kafka.producer.sasl.username": "user"},
+				"are required by SCRAM-SHA-512"),
+			Entry("OAUTHBEARER without token",
+				map[string]interface{}{"kafka.producer.sasl.mechanism": sarama.SASLTypeOAuth},
+				"requires exactly one of"),
+			Entry("OAUTHBEARER with two tokens",
+				map[string]interface{}{
+					"kafka.producer.sasl.mechanism":             sarama.SASLTypeOAuth,
+					"kafka.producer.sasl.oauthbearer.token":     "token",
+					"kafka.producer.sasl.oauthbearer.tokenFile": "token.txt",
+				},
+				"requires exactly one of"),
+			Entry("OAUTHBEARER token url without client",
+				map[string]interface{}{
+					"kafka.producer.sasl.mechanism":            sarama.SASLTypeOAuth,
+					"kafka.producer.sasl.oauthbearer.tokenUrl": "http://localhost/token",
+				},
+				"requires clientId and clientSecret"),
+		)
+
+		It("should read OAUTHBEARER tokens from a file on every connection", func() {
+			tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+			Expect(os.WriteFile(tokenFile, []byte("first\n"), 0o600)).To(Succeed())
+			config.Set("kafka.producer.sasl.mechanism", sarama.SASLTypeOAuth)
+			config.Set("kafka.producer.sasl.oauthbearer.tokenFile", tokenFile)
+
+			kafkaConf, err := secureConfig()
+			Expect(err).NotTo(HaveOccurred())
+			token, err := kafkaConf.Net.SASL.TokenProvider.Token()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(token.Token).To(Equal("first"))
+
+			Expect(os.WriteFile(tokenFile, []byte("second"), 0o600)).To(Succeed())
+			token, err = kafkaConf.Net.SASL.TokenProvider.Token()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(token.Token).To(Equal("second"))
+		})
+
+		It("should get OAUTHBEARER tokens with client credentials and reuse them", func() {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				requests++
+				user, secret, _ := r.BasicAuth()
+				Expect(r.ParseForm()).To(Succeed())
+				Expect(r.Form.Get("grant_type")).To(Equal("client_credentials"))
+				Expect(r.Form.Get("scope")).To(Equal("kafka produce"))
+				Expect(user).To(Equal("gateway"))
+				Expect(secret).To(Equal("s3cret"))
+				fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, requests)
+			}))
+			defer server.Close()
+			config.Set("kafka.producer.sasl.mechanism", sarama.SASLTypeOAuth)
+			config.Set("kafka.producer.sasl.oauthbearer.tokenUrl", server.URL)
+			config.Set("kafka.producer.sasl.oauthbearer.clientId", "gateway")
+			config.Set("kafka.producer.sasl.oauthbearer.clientSecret", "s3cret")
+			config.Set("kafka.producer.sasl.oauthbearer.scopes", []string{"kafka", "produce"})
+
+			kafkaConf, err := secureConfig()
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 2; i++ {
+				token, err := kafkaConf.Net.SASL.TokenProvider.Token()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(token.Token).To(Equal("token-1"))
+			}
+			Expect(requests).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,47 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package forwarder
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// StdoutForwarder writes a Record per message to a writer, usually os.Stdout, for
+// local development without kafka
+type StdoutForwarder struct {
+	mu       sync.Mutex
+	out      io.Writer
+	messages int64
+}
+
+// NewStdoutForwarder ctor
+func NewStdoutForwarder(out io.Writer) *StdoutForwarder {
+	return &StdoutForwarder{out: out}
+}
+
+// Produce writes message as a Record line, the offset returned counts the messages written
+func (s *StdoutForwarder) Produce(
+	ctx context.Context,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) (int32, int64, error) {
+	line, err := encodeRecord(topic, key, headers, message)
+	if err != nil {
+		return -1, -1, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.out.Write(line); err != nil {
+		return -1, -1, err
+	}
+	s.messages++
+	return 0, s.messages - 1, nil
+}
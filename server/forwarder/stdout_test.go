@@ -0,0 +1,35 @@
+//go:build unit
+// +build unit
+
+package forwarder_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+)
+
+var _ = Describe("StdoutForwarder", func() {
+	It("should write a record line per message", func() {
+		var out bytes.Buffer
+		s := forwarder.NewStdoutForwarder(&out)
+		_, _, err := s.Produce(context.Background(), "topic", "key", nil, []byte(`{"id":"1"}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, offset, err := s.Produce(context.Background(), "topic", "", nil, []byte(`{"id":"2"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(offset).To(Equal(int64(1)))
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		var record forwarder.Record
+		Expect(json.Unmarshal([]byte(lines[0]), &record)).To(Succeed())
+		Expect(record.Topic).To(Equal("topic"))
+		Expect(record.Key).To(Equal("key"))
+		Expect(string(record.Message)).To(Equal(`{"id":"1"}`))
+	})
+})
@@ -54,6 +54,36 @@ var (
 
 	// KafkaRequestLatency summary, observes that kafka request latency per topic and status
 	KafkaRequestLatency *prometheus.HistogramVec
+
+	// DuplicatedEventsCounter counts events that were already produced and were not produced again
+	DuplicatedEventsCounter *prometheus.CounterVec
+
+	// RejectedEventsCounter counts the validation violations of rejected events per topic and reason
+	RejectedEventsCounter *prometheus.CounterVec
+
+	// SinkEventsCounter counts the events produced to each sink per topic and status
+	SinkEventsCounter *prometheus.CounterVec
+
+	// RateLimitedEventsCounter counts the events rejected by the rate limits per topic and limit
+	RateLimitedEventsCounter *prometheus.CounterVec
+
+	// LoadShedding is 1 for each reason new requests are being rejected for and 0 otherwise
+	LoadShedding *prometheus.GaugeVec
+
+	// ShedRequestsCounter counts the requests rejected while shedding load per route and reason
+	ShedRequestsCounter *prometheus.CounterVec
+
+	// KafkaActiveCluster is 1 for the kafka cluster events are produced to and 0 for the
+	// other, it's created here since the forwarders are created before StartServer
+	KafkaActiveCluster = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "kafka",
+			Name:      "active_cluster",
+			Help:      "whether events are produced to the primary or the secondary kafka cluster",
+		},
+		[]string{"cluster"},
+	)
 )
 
 func defaultLatencyBuckets(config *viper.Viper) []float64 {
@@ -86,10 +116,16 @@ func RegisterMetrics(collectors []prometheus.Collector) error {
 	return nil
 }
 
+// Route is a path served by the metrics server besides /metrics, like health checks
+type Route struct {
+	Path    string
+	Handler http.Handler
+}
+
 // StartServer runs a metrics server inside a goroutine
 // that reports default application metrics in prometheus format.
 // Any errors that may occur will stop the server and log.Fatal the error.
-func StartServer(config *viper.Viper) {
+func StartServer(config *viper.Viper, routes ...Route) {
 	APIPayloadSize = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "eventsgateway",
@@ -123,10 +159,77 @@ func StartServer(config *viper.Viper) {
 		[]string{LabelStatus, LabelTopic},
 	)
 
+	DuplicatedEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "api",
+			Name:      "duplicated_events",
+			Help:      "the count of duplicated events acknowledged without being produced",
+		},
+		[]string{LabelTopic},
+	)
+
+	RejectedEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "api",
+			Name:      "rejected_events",
+			Help:      "the count of validation violations of rejected events",
+		},
+		[]string{LabelTopic, "reason"},
+	)
+
+	SinkEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "sink",
+			Name:      "events",
+			Help:      "the count of events produced to each sink",
+		},
+		[]string{"sink", LabelTopic, LabelStatus},
+	)
+
+	RateLimitedEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "api",
+			Name:      "rate_limited_events",
+			Help:      "the count of events rejected for exceeding the topic or caller rate limits",
+		},
+		[]string{LabelTopic, "limit"},
+	)
+
+	LoadShedding = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "api",
+			Name:      "load_shedding",
+			Help:      "whether new requests are being rejected due to the produce concurrency or latency",
+		},
+		[]string{"reason"},
+	)
+
+	ShedRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "eventsgateway",
+			Subsystem: "api",
+			Name:      "shed_requests",
+			Help:      "the count of requests rejected while shedding load",
+		},
+		[]string{LabelRoute, "reason"},
+	)
+
 	collectors := []prometheus.Collector{
 		APIResponseTime,
 		APIPayloadSize,
 		KafkaRequestLatency,
+		DuplicatedEventsCounter,
+		RejectedEventsCounter,
+		SinkEventsCounter,
+		RateLimitedEventsCounter,
+		LoadShedding,
+		ShedRequestsCounter,
+		KafkaActiveCluster,
 	}
 
 	err := RegisterMetrics(collectors)
@@ -143,6 +246,9 @@ func StartServer(config *viper.Viper) {
 
 		r := mux.NewRouter()
 		r.Handle("/metrics", promhttp.Handler())
+		for _, route := range routes {
+			r.Handle(route.Path, route.Handler)
+		}
 
 		s := &http.Server{
 			Addr:           config.GetString("prometheus.port"),
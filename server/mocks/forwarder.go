@@ -29,14 +29,14 @@ func (_m *MockForwarder) EXPECT() *_MockForwarderRecorder {
 	return _m.recorder
 }
 
-func (_m *MockForwarder) Produce(ctx context.Context, topic string, message []byte) (int32, int64, error) {
-	ret := _m.ctrl.Call(_m, "Produce", topic, message)
+func (_m *MockForwarder) Produce(ctx context.Context, topic, key string, headers map[string]string, message []byte) (int32, int64, error) {
+	ret := _m.ctrl.Call(_m, "Produce", topic, key, headers, message)
 	ret0, _ := ret[0].(int32)
 	ret1, _ := ret[1].(int64)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockForwarderRecorder) Produce(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Produce", arg0, arg1)
+func (_mr *_MockForwarderRecorder) Produce(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Produce", arg0, arg1, arg2, arg3)
 }
@@ -0,0 +1,159 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons AdmissionController sheds load for, they're the reason label of its metrics
+const (
+	SheddingConcurrency = "concurrency"
+	SheddingLatency     = "latency"
+)
+
+// AdmissionController rejects new requests while too many events are being produced
+// or producing them got too slow, so a slow kafka doesn't pile up goroutines
+type AdmissionController struct {
+	// requests are rejected with maxInFlight produce calls or if the mean latency of
+	// the produce calls of the last window is above maxLatency, zero disables each limit
+	maxInFlight int64
+	maxLatency  time.Duration
+	window      time.Duration
+
+	inFlight    atomic.Int64
+	mu          sync.Mutex
+	windowStart time.Time
+	sum         time.Duration
+	count       int64
+	latency     time.Duration
+}
+
+// NewAdmissionController ctor
+func NewAdmissionController(maxInFlight int, maxLatency, window time.Duration) *AdmissionController {
+	return &AdmissionController{
+		maxInFlight: int64(maxInFlight),
+		maxLatency:  maxLatency,
+		window:      window,
+		windowStart: time.Now(),
+	}
+}
+
+// Start accounts a produce call, the returned func must be called with its latency
+// once it's done
+func (a *AdmissionController) Start() func(latency time.Duration) {
+	a.inFlight.Add(1)
+	return func(latency time.Duration) {
+		a.inFlight.Add(-1)
+		a.mu.Lock()
+		a.rotate(time.Now())
+		a.sum += latency
+		a.count++
+		a.mu.Unlock()
+	}
+}
+
+// rotate moves to the window of now, keeping the mean latency of the previous one,
+// it must be called holding mu
+func (a *AdmissionController) rotate(now time.Time) {
+	elapsed := now.Sub(a.windowStart)
+	if elapsed < a.window {
+		return
+	}
+	a.latency = 0
+	// windows without produce calls don't keep the requests rejected
+	if a.count > 0 && elapsed < 2*a.window {
+		a.latency = a.sum / time.Duration(a.count)
+	}
+	a.windowStart = now
+	a.sum = 0
+	a.count = 0
+}
+
+// Latency returns the mean latency of the produce calls of the last window
+func (a *AdmissionController) Latency() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rotate(time.Now())
+	return a.latency
+}
+
+// InFlight returns how many produce calls are in flight
+func (a *AdmissionController) InFlight() int64 {
+	return a.inFlight.Load()
+}
+
+// Shedding returns why new requests are being rejected, or an empty string if they're
+// being admitted, it also updates metrics.LoadShedding
+func (a *AdmissionController) Shedding() string {
+	concurrency := a.maxInFlight > 0 && a.InFlight() >= a.maxInFlight
+	latency := a.maxLatency > 0 && a.Latency() > a.maxLatency
+	metrics.LoadShedding.WithLabelValues(SheddingConcurrency).Set(boolToFloat(concurrency))
+	metrics.LoadShedding.WithLabelValues(SheddingLatency).Set(boolToFloat(latency))
+	switch {
+	case concurrency:
+		return SheddingConcurrency
+	case latency:
+		return SheddingLatency
+	default:
+		return ""
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// admit returns the Unavailable error of requests to route while shedding load
+func (a *AdmissionController) admit(route string) error {
+	reason := a.Shedding()
+	if reason == "" {
+		return nil
+	}
+	metrics.ShedRequestsCounter.WithLabelValues(route, reason).Inc()
+	return status.Errorf(codes.Unavailable, "shedding load due to %s, retry later", reason)
+}
+
+// UnaryInterceptor rejects requests while shedding load
+func (a *AdmissionController) UnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := a.admit(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor rejects new streams while shedding load, the batches of open
+// streams are still admitted since the connections they're on are recycled by
+// server.maxConnectionAge anyway
+func (a *AdmissionController) StreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := a.admit(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,190 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Dead letter sinks accepted in deadLetter.sink
+const (
+	DeadLetterSinkKafka = "kafka"
+	DeadLetterSinkFile  = "file"
+)
+
+// Reasons events are sent to the dead letter sink
+const (
+	RejectionMissingFields   = "missing_fields"
+	RejectionInvalidProps    = "invalid_props"
+	RejectionMaxMessageBytes = "max_message_bytes"
+	RejectionProduceFailed   = "produce_failed"
+)
+
+// DeadLetter is an event the server rejected, with why and when it was rejected
+type DeadLetter struct {
+	Event  *pb.Event `json:"event"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+	// Route is the grpc method that received the event
+	Route           string `json:"route"`
+	ClientTimestamp int64  `json:"clientTimestamp"`
+	ServerTimestamp int64  `json:"serverTimestamp"`
+}
+
+// DeadLetterSink keeps rejected events so they can be inspected and replayed
+type DeadLetterSink interface {
+	Write(ctx context.Context, letter *DeadLetter) error
+}
+
+// KafkaDeadLetterSink produces dead letters as JSON to a topic, keyed by event id
+type KafkaDeadLetterSink struct {
+	producer forwarder.Forwarder
+	topic    string
+}
+
+// NewKafkaDeadLetterSink ctor
+func NewKafkaDeadLetterSink(producer forwarder.Forwarder, topic string) *KafkaDeadLetterSink {
+	return &KafkaDeadLetterSink{producer: producer, topic: topic}
+}
+
+// Write produces letter to the dead letter topic
+func (k *KafkaDeadLetterSink) Write(ctx context.Context, letter *DeadLetter) error {
+	message, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	_, _, err = k.producer.Produce(ctx, k.topic, letter.Event.GetId(), map[string]string{
+		forwarder.HeaderEventID:   letter.Event.GetId(),
+		forwarder.HeaderEventName: letter.Event.GetName(),
+		"rejection-reason":        letter.Reason,
+	}, message)
+	return err
+}
+
+// FileDeadLetterSink appends dead letters as JSON lines to a local file
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink opens path, creating it if needed
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file}, nil
+}
+
+// Write appends letter to the file
+func (f *FileDeadLetterSink) Write(ctx context.Context, letter *DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close syncs and closes the file
+func (f *FileDeadLetterSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+func newDeadLetterSink(config *viper.Viper, producer forwarder.Forwarder) (DeadLetterSink, error) {
+	config.SetDefault("deadLetter.sink", "")
+	config.SetDefault("deadLetter.topic", "dead-letters")
+	config.SetDefault("deadLetter.file", "eventsgateway-dead-letters.jsonl")
+
+	switch sink := config.GetString("deadLetter.sink"); sink {
+	case "":
+		return nil, nil
+	case DeadLetterSinkKafka:
+		return NewKafkaDeadLetterSink(producer, config.GetString("deadLetter.topic")), nil
+	case DeadLetterSinkFile:
+		return NewFileDeadLetterSink(config.GetString("deadLetter.file"))
+	default:
+		return nil, fmt.Errorf("invalid deadLetter.sink %q, should be %s or %s", sink, DeadLetterSinkKafka, DeadLetterSinkFile)
+	}
+}
+
+// maxMessageBytesError is returned for events bigger than kafka.producer.maxMessageBytes
+type maxMessageBytesError struct {
+	maxMessageBytes int
+	size            int
+}
+
+func (e *maxMessageBytesError) Error() string {
+	return fmt.Sprintf("Event size exceeds kafka.producer.maxMessageBytes %d bytes. Got %d bytes", e.maxMessageBytes, e.size)
+}
+
+// deadLetteredError is returned for events written to the dead letter sink, which
+// are handled even though they weren't produced
+type deadLetteredError struct {
+	error
+}
+
+func (e *deadLetteredError) Unwrap() error {
+	return e.error
+}
+
+// rejectedError is returned for events that won't be produced if retried, its status
+// is the one of the error that rejected them or FailedPrecondition if it has none
+type rejectedError struct {
+	error
+}
+
+func (e *rejectedError) Unwrap() error {
+	return e.error
+}
+
+// GRPCStatus returns the status sync clients get for rejected events, whether they
+// were dead lettered or not
+func (e *rejectedError) GRPCStatus() *status.Status {
+	if st, ok := status.FromError(e.error); ok {
+		return st
+	}
+	return status.New(codes.FailedPrecondition, e.Error())
+}
+
+// rejectionReason returns why an event failed with err, if retrying it won't help
+func rejectionReason(err error) (string, bool) {
+	var validationErr *ValidationError
+	var sizeErr *maxMessageBytesError
+	switch {
+	case errors.As(err, &validationErr):
+		return RejectionInvalidProps, true
+	case errors.As(err, &sizeErr):
+		return RejectionMaxMessageBytes, true
+	case status.Code(err) == codes.FailedPrecondition:
+		return RejectionMissingFields, true
+	case forwarder.IsPermanentError(err):
+		return RejectionProduceFailed, true
+	default:
+		return "", false
+	}
+}
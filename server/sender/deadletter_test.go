@@ -0,0 +1,170 @@
+//go:build unit
+// +build unit
+
+package sender_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Dead letters", func() {
+	var (
+		cfg *viper.Viper
+		ctx context.Context
+	)
+
+	BeforeEach(func() {
+		ctx = methodContext("/eventsgateway.GRPCForwarder/SendEvent")
+		cfg = initConfig()
+		cfg.Set("validation.rules", []map[string]interface{}{
+			{"topic": "purchases", "required": []string{"userId"}},
+		})
+	})
+
+	Describe("file sink", func() {
+		var path string
+
+		readLetters := func() []sender.DeadLetter {
+			file, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			letters := []sender.DeadLetter{}
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(nil, 1024*1024)
+			for scanner.Scan() {
+				letter := sender.DeadLetter{}
+				Expect(json.Unmarshal(scanner.Bytes(), &letter)).To(Succeed())
+				letters = append(letters, letter)
+			}
+			return letters
+		}
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "dead-letters.jsonl")
+			cfg.Set("deadLetter.sink", sender.DeadLetterSinkFile)
+			cfg.Set("deadLetter.file", path)
+		})
+
+		It("should write rejected events with the reason, route and timestamps", func() {
+			k := newKafkaSender(cfg)
+			event := newEvent("someid", "purchases", "someName", map[string]string{})
+			Expect(k.SendEvent(ctx, event)).NotTo(Succeed())
+			unnamed := newEvent("someid", "purchases", "", map[string]string{})
+			Expect(k.SendEvent(ctx, unnamed)).NotTo(Succeed())
+
+			letters := readLetters()
+			Expect(letters).To(HaveLen(2))
+			Expect(letters[0].Event.Id).To(Equal("someid"))
+			Expect(letters[0].Reason).To(Equal(sender.RejectionInvalidProps))
+			Expect(letters[0].Error).To(ContainSubstring("userId is required"))
+			Expect(letters[0].Route).To(Equal("/eventsgateway.GRPCForwarder/SendEvent"))
+			Expect(letters[0].ClientTimestamp).To(Equal(event.Timestamp))
+			Expect(letters[0].ServerTimestamp).To(BeNumerically("~", event.Timestamp, 100))
+			Expect(letters[1].Reason).To(Equal(sender.RejectionMissingFields))
+		})
+
+		It("should not report dead letters as failed in batches", func() {
+			k := newKafkaSender(cfg)
+			mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any())
+			failed, rejected := k.SendEvents(ctx, []*pb.Event{
+				newEvent("someid", "purchases", "someName", map[string]string{}),
+				newEvent("otherid", "purchases", "someName", map[string]string{"userId": "u-1"}),
+			})
+			Expect(failed).To(BeEmpty())
+			Expect(rejected).To(Equal([]int64{0}))
+
+			letters := readLetters()
+			Expect(letters).To(HaveLen(1))
+			Expect(letters[0].Event.Id).To(Equal("someid"))
+		})
+
+		It("should close the file with the sender", func() {
+			k := newKafkaSender(cfg)
+			Expect(k.Close()).To(Succeed())
+			Expect(k.Close()).To(MatchError(os.ErrClosed))
+		})
+
+		It("should write events bigger than maxMessageBytes", func() {
+			k := newKafkaSender(cfg)
+			big := strings.Repeat("a", 30000)
+			Expect(k.SendEvent(ctx, newEvent("someid", "purchases", "someName", map[string]string{
+				"userId": big,
+			}))).NotTo(Succeed())
+
+			letters := readLetters()
+			Expect(letters).To(HaveLen(1))
+			Expect(letters[0].Reason).To(Equal(sender.RejectionMaxMessageBytes))
+		})
+	})
+
+	Describe("kafka sink", func() {
+		BeforeEach(func() {
+			cfg.Set("deadLetter.sink", sender.DeadLetterSinkKafka)
+			cfg.Set("deadLetter.topic", "dead-letters")
+		})
+
+		It("should produce events kafka rejects permanently to the dead letter topic", func() {
+			k := newKafkaSender(cfg)
+			mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(int32(0), int64(0), sarama.ErrMessageSizeTooLarge)
+			mockForwarder.EXPECT().Produce(gomock.Eq("dead-letters"), gomock.Eq("someid"), gomock.Any(), gomock.Any()).Do(
+				func(topic, key string, headers map[string]string, message []byte) {
+					Expect(headers).To(HaveKeyWithValue("rejection-reason", sender.RejectionProduceFailed))
+					letter := sender.DeadLetter{}
+					Expect(json.Unmarshal(message, &letter)).To(Succeed())
+					Expect(letter.Event.Id).To(Equal("someid"))
+					Expect(letter.Reason).To(Equal(sender.RejectionProduceFailed))
+				})
+
+			err := k.SendEvent(ctx, newEvent("someid", "purchases", "someName", map[string]string{"userId": "u-1"}))
+			Expect(err).To(MatchError(sarama.ErrMessageSizeTooLarge))
+			// like in batches, where it's rejected instead of failed
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		})
+
+		It("should report events as failed in batches if their dead letter can't be produced", func() {
+			k := newKafkaSender(cfg)
+			mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(int32(0), int64(0), sarama.ErrMessageSizeTooLarge)
+			mockForwarder.EXPECT().Produce(gomock.Eq("dead-letters"), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(int32(0), int64(0), errors.New("kafka is down"))
+
+			failed, _ := k.SendEvents(ctx, []*pb.Event{
+				newEvent("someid", "purchases", "someName", map[string]string{"userId": "u-1"}),
+			})
+			Expect(failed).To(Equal([]int64{0}))
+		})
+
+		It("should not produce events that can be retried to the dead letter topic", func() {
+			k := newKafkaSender(cfg)
+			mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(int32(0), int64(0), errors.New("kafka is down"))
+
+			err := k.SendEvent(ctx, newEvent("someid", "purchases", "someName", map[string]string{"userId": "u-1"}))
+			Expect(err).To(HaveOccurred())
+			Expect(status.Code(err)).To(Equal(codes.Unknown))
+		})
+	})
+
+	It("should fail to start with an unknown sink", func() {
+		cfg.Set("deadLetter.sink", "s3")
+		_, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+		Expect(err).To(MatchError(ContainSubstring(`invalid deadLetter.sink "s3"`)))
+	})
+})
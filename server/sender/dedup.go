@@ -0,0 +1,102 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Deduplicator keeps the ids of events produced or being produced, so retried events
+// can be acknowledged without being produced again. Implementations backed by a shared
+// store let every server instance see the ids produced by the others.
+type Deduplicator interface {
+	// Reserve records id before its event is produced, atomically, and returns false
+	// if it was already reserved and didn't expire yet
+	Reserve(ctx context.Context, id string) (bool, error)
+	// Release forgets id after producing its event failed, so it can be retried
+	Release(ctx context.Context, id string) error
+}
+
+// MemoryDeduplicator is an in-memory Deduplicator that keeps up to maxSize ids for ttl,
+// evicting the least recently reserved ones first
+type MemoryDeduplicator struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+type dedupEntry struct {
+	id        string
+	expiresAt time.Time
+}
+
+// NewMemoryDeduplicator ctor
+func NewMemoryDeduplicator(ttl time.Duration, maxSize int) *MemoryDeduplicator {
+	return &MemoryDeduplicator{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Reserve records id for ttl, unless it's already kept
+func (m *MemoryDeduplicator) Reserve(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evictExpired()
+	if _, ok := m.entries[id]; ok {
+		return false, nil
+	}
+	m.entries[id] = m.order.PushFront(&dedupEntry{id: id, expiresAt: m.now().Add(m.ttl)})
+	for m.order.Len() > m.maxSize {
+		m.remove(m.order.Back())
+	}
+	return true, nil
+}
+
+// Release forgets id
+func (m *MemoryDeduplicator) Release(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[id]; ok {
+		m.remove(element)
+	}
+	return nil
+}
+
+// Len returns how many ids are currently kept
+func (m *MemoryDeduplicator) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// evictExpired removes expired ids; since every id has the same ttl, the least
+// recently reserved are the first to expire
+func (m *MemoryDeduplicator) evictExpired() {
+	now := m.now()
+	for element := m.order.Back(); element != nil; element = m.order.Back() {
+		if element.Value.(*dedupEntry).expiresAt.After(now) {
+			return
+		}
+		m.remove(element)
+	}
+}
+
+func (m *MemoryDeduplicator) remove(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.entries, element.Value.(*dedupEntry).id)
+}
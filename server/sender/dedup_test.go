@@ -0,0 +1,128 @@
+//go:build unit
+// +build unit
+
+package sender_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("Dedup", func() {
+	var (
+		k          *sender.KafkaSender
+		duplicated float64
+	)
+
+	BeforeEach(func() {
+		cfg := initConfig()
+		cfg.Set("dedup.enabled", true)
+		k = newKafkaSender(cfg)
+		duplicated = testutil.ToFloat64(metrics.DuplicatedEventsCounter.WithLabelValues("sometopic"))
+	})
+
+	It("should produce an event only once within the window", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(1)
+
+		for i := 0; i < 3; i++ {
+			Expect(k.SendEvent(context.Background(), newEvent("someid", "sometopic", "someName", nil))).To(Succeed())
+		}
+		Expect(testutil.ToFloat64(metrics.DuplicatedEventsCounter.WithLabelValues("sometopic"))).To(Equal(duplicated + 2))
+	})
+
+	It("should produce an event again if it failed the first time", func() {
+		gomock.InOrder(
+			mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(int32(0), int64(0), errors.New("kafka is down")),
+			mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()),
+		)
+
+		Expect(k.SendEvent(context.Background(), newEvent("someid", "sometopic", "someName", nil))).NotTo(Succeed())
+		Expect(k.SendEvent(context.Background(), newEvent("someid", "sometopic", "someName", nil))).To(Succeed())
+	})
+
+	It("should report duplicated events in a batch as sent", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+
+		for i := 0; i < 2; i++ {
+			failed, rejected := k.SendEvents(context.Background(), []*pb.Event{
+				newEvent("a", "sometopic", "someName", nil),
+				newEvent("b", "sometopic", "someName", nil),
+			})
+			Expect(failed).To(BeEmpty())
+			Expect(rejected).To(BeEmpty())
+		}
+	})
+
+	It("should produce an event only once if copies are sent while it's produced", func() {
+		release := make(chan struct{})
+		mockForwarder.EXPECT().Produce(gomock.Eq("sometopic"), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(string, string, map[string]string, []byte) (int32, int64, error) {
+				<-release
+				return 0, 0, nil
+			}).Times(1)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			Expect(k.SendEvent(context.Background(), newEvent("someid", "sometopic", "someName", nil))).To(Succeed())
+		}()
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			failed, _ := k.SendEvents(context.Background(), []*pb.Event{
+				newEvent("someid", "sometopic", "someName", nil),
+				newEvent("someid", "sometopic", "someName", nil),
+			})
+			Expect(failed).To(BeEmpty())
+		}()
+		Eventually(func() float64 {
+			return testutil.ToFloat64(metrics.DuplicatedEventsCounter.WithLabelValues("sometopic"))
+		}).Should(Equal(duplicated + 2))
+		close(release)
+		wg.Wait()
+	})
+
+	Describe("MemoryDeduplicator", func() {
+		It("should forget ids after the ttl", func() {
+			d := sender.NewMemoryDeduplicator(50*time.Millisecond, 10)
+			Expect(d.Reserve(context.Background(), "someid")).To(BeTrue())
+			Expect(d.Reserve(context.Background(), "someid")).To(BeFalse())
+			Eventually(func() bool {
+				reserved, _ := d.Reserve(context.Background(), "someid")
+				return reserved
+			}).Should(BeTrue())
+			Expect(d.Len()).To(Equal(1))
+		})
+
+		It("should forget released ids", func() {
+			d := sender.NewMemoryDeduplicator(time.Minute, 10)
+			Expect(d.Reserve(context.Background(), "someid")).To(BeTrue())
+			Expect(d.Release(context.Background(), "someid")).To(Succeed())
+			Expect(d.Reserve(context.Background(), "someid")).To(BeTrue())
+		})
+
+		It("should evict the least recently reserved ids past maxSize", func() {
+			d := sender.NewMemoryDeduplicator(time.Minute, 2)
+			for _, id := range []string{"a", "b", "c"} {
+				Expect(d.Reserve(context.Background(), id)).To(BeTrue())
+			}
+
+			Expect(d.Len()).To(Equal(2))
+			Expect(d.Reserve(context.Background(), "a")).To(BeTrue())
+			Expect(d.Reserve(context.Background(), "c")).To(BeFalse())
+		})
+	})
+})
@@ -8,75 +8,245 @@
 package sender
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/spf13/viper"
-	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
 	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
 	"github.com/topfreegames/eventsgateway/v4/server/logger"
 	"github.com/topfreegames/eventsgateway/v4/server/metrics"
 	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// KeyProp is the reserved prop clients use to set the message key of an event explicitly,
+// it's removed from the props before the event is produced
+const KeyProp = "eventsgateway.key"
+
+// TypesProp is the reserved prop where clients keep the types of typed props, it's
+// produced with the event so consumers can decode them
+const TypesProp = "eventsgateway.types"
+
 type KafkaSender struct {
-	logger   logger.Logger
-	producer forwarder.Forwarder
-	config   *viper.Viper
+	logger       logger.Logger
+	producer     forwarder.Forwarder
+	config       *viper.Viper
+	concurrency  int
+	deduplicator Deduplicator
+	// keyProp is the prop used as message key on topics without one in topicKeyProps
+	keyProp       string
+	topicKeyProps map[string]string
+	serializers   *serializers
+	validator     *Validator
+	deadLetters   DeadLetterSink
+	router        *Router
+	admission     *AdmissionController
 }
 
 func NewKafkaSender(
 	producer forwarder.Forwarder,
 	logger logger.Logger,
 	config *viper.Viper,
-) *KafkaSender {
-	k := &KafkaSender{producer: producer, logger: logger, config: config}
-	return k
+) (*KafkaSender, error) {
+	config.SetDefault("sender.concurrency", 100)
+	serializers, err := newSerializers(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := LoadValidationRules(config)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := NewValidator(rules)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters, err := newDeadLetterSink(config, producer)
+	if err != nil {
+		return nil, err
+	}
+	k := &KafkaSender{
+		producer:    producer,
+		logger:      logger,
+		config:      config,
+		concurrency: config.GetInt("sender.concurrency"),
+		keyProp:     config.GetString("kafka.producer.key.prop"),
+		// viper lower cases map keys, so topics are looked up in lower case
+		topicKeyProps: config.GetStringMapString("kafka.producer.key.topicProps"),
+		serializers:   serializers,
+		validator:     validator,
+		deadLetters:   deadLetters,
+		router: &Router{
+			sinks:        map[string]Sink{DefaultSink: {Forwarder: producer, Required: true}},
+			defaultSinks: []string{DefaultSink},
+		},
+	}
+	config.SetDefault("dedup.enabled", false)
+	config.SetDefault("dedup.ttl", "10m")
+	config.SetDefault("dedup.maxSize", 1000000)
+	if config.GetBool("dedup.enabled") {
+		k.deduplicator = NewMemoryDeduplicator(
+			config.GetDuration("dedup.ttl"),
+			config.GetInt("dedup.maxSize"),
+		)
+	}
+	return k, nil
 }
 
-// SendEvents sends a batch of events to kafka
+// SetDeduplicator replaces the Deduplicator used to skip events already produced,
+// nil disables deduplication
+func (k *KafkaSender) SetDeduplicator(deduplicator Deduplicator) {
+	k.deduplicator = deduplicator
+}
+
+// SetRouter replaces the Router that picks the sinks of each event, by default all
+// events are only produced to the forwarder the KafkaSender was created with
+func (k *KafkaSender) SetRouter(router *Router) {
+	k.router = router
+}
+
+// Close closes the dead letter sink, if it needs to
+func (k *KafkaSender) Close() error {
+	if closer, ok := k.deadLetters.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SetAdmissionController sets the AdmissionController told about every produce call,
+// nil disables it
+func (k *KafkaSender) SetAdmissionController(admission *AdmissionController) {
+	k.admission = admission
+}
+
+// SendEvents sends a batch of events to kafka, using up to sender.concurrency
+// goroutines, and returns the indexes of the events that failed and of the events
+// rejected for good, both in ascending order
 func (k *KafkaSender) SendEvents(
 	ctx context.Context,
 	events []*pb.Event,
-) []int64 {
+) ([]int64, []int64) {
+	workers := k.concurrency
+	if workers <= 0 || workers > len(events) {
+		workers = len(events)
+	}
+
+	// each worker only writes the positions of the events it sent
+	failed := make([]bool, len(events))
+	rejected := make([]bool, len(events))
+	indexes := make(chan int)
 	wg := sync.WaitGroup{}
-	wg.Add(len(events))
-	failureIndexes := make([]int64, 0, len(events))
-	for i := range events {
-		j := i
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
 		go func() {
-			if err := k.SendEvent(ctx, events[j]); err != nil {
-				k.logger.
+			defer wg.Done()
+			for j := range indexes {
+				err := k.SendEvent(ctx, events[j])
+				if err == nil {
+					continue
+				}
+				l := k.logger.
 					WithError(err).
 					WithField("topic", events[j].GetTopic()).
 					WithField("eventName", events[j].GetName()).
-					WithField("eventID", events[j].GetId()).
-					Error("failed to send event to kafka")
-				failureIndexes = append(failureIndexes, int64(j))
+					WithField("eventID", events[j].GetId())
+				var rejectedErr *rejectedError
+				if errors.As(err, &rejectedErr) {
+					l.Warn("event rejected, it won't be produced if retried")
+					rejected[j] = true
+					continue
+				}
+				l.Error("failed to send event to kafka")
+				failed[j] = true
 			}
-			wg.Done()
 		}()
 	}
+	for i := range events {
+		indexes <- i
+	}
+	close(indexes)
 	wg.Wait()
-	return failureIndexes
+
+	return indexesOf(failed), indexesOf(rejected)
 }
 
-// SendEvent sends a event to kafka
+// retryable returns whether an event that failed with err may be produced if retried,
+// events rejected for good are only retried if their dead letter couldn't be written
+func (k *KafkaSender) retryable(err error) bool {
+	var deadLettered *deadLetteredError
+	if errors.As(err, &deadLettered) {
+		return false
+	}
+	_, rejected := rejectionReason(err)
+	return !rejected || k.deadLetters != nil
+}
+
+func indexesOf(flags []bool) []int64 {
+	indexes := make([]int64, 0, len(flags))
+	for i, f := range flags {
+		if f {
+			indexes = append(indexes, int64(i))
+		}
+	}
+	return indexes
+}
+
+// SendEvent sends a event to kafka, events rejected for reasons that retrying won't fix
+// are also written to the dead letter sink, if there's one. The error of events that
+// won't be produced if retried is a rejectedError, both for SendEvent and SendEvents.
 func (k *KafkaSender) SendEvent(
 	ctx context.Context,
 	event *pb.Event,
 ) error {
+	err := k.deadLetter(ctx, event, k.sendEvent(ctx, event))
+	if err != nil && !k.retryable(err) {
+		return &rejectedError{error: err}
+	}
+	return err
+}
+
+// deadLetter writes event to the dead letter sink if it was rejected with err, returning
+// a deadLetteredError once it's written
+func (k *KafkaSender) deadLetter(ctx context.Context, event *pb.Event, err error) error {
+	if err == nil || k.deadLetters == nil {
+		return err
+	}
+	if reason, ok := rejectionReason(err); ok {
+		route, _ := grpc.Method(ctx)
+		letter := &DeadLetter{
+			Event:           event,
+			Reason:          reason,
+			Error:           err.Error(),
+			Route:           route,
+			ClientTimestamp: event.GetTimestamp(),
+			ServerTimestamp: time.Now().UnixNano() / 1000000,
+		}
+		if dlErr := k.deadLetters.Write(ctx, letter); dlErr != nil {
+			k.logger.WithError(dlErr).WithField("eventID", event.GetId()).Error("failed to write dead letter")
+			return err
+		}
+		return &deadLetteredError{error: err}
+	}
+	return err
+}
+
+func (k *KafkaSender) sendEvent(
+	ctx context.Context,
+	event *pb.Event,
+) (err error) {
 	startTime := time.Now()
 	maxMessageBytes := k.config.GetInt("kafka.producer.maxMessageBytes")
 
 	if event.XXX_Size() >= maxMessageBytes {
-		err := errors.New(fmt.Sprintf("Event size exceeds kafka.producer.maxMessageBytes %d bytes. Got %d bytes", maxMessageBytes, event.XXX_Size()))
+		err := &maxMessageBytesError{maxMessageBytes: maxMessageBytes, size: event.XXX_Size()}
 		k.logger.WithError(err).Error("Failed to send event")
 		return err
 	}
@@ -99,39 +269,147 @@ func (k *KafkaSender) SendEvent(
 		event.GetTopic(),
 		event.GetProps(),
 	)
-	// serialize
-	a := avro.NewEvent()
-	a.Id = event.GetId()
-	a.Name = event.GetName()
-	a.Props = event.GetProps()
+	topic := event.GetTopic()
+	topicFullName := fmt.Sprintf("%s%s", k.config.GetString("kafka.producer.topicPrefix"), topic)
 
-	a.ServerTimestamp = time.Now().UnixNano() / 1000000
-	a.ClientTimestamp = event.GetTimestamp()
+	key, props := k.messageKey(topic, event.GetProps())
 
-	var buf bytes.Buffer
+	if err := k.validator.Validate(event, props); err != nil {
+		for _, v := range err.(*ValidationError).Violations {
+			metrics.RejectedEventsCounter.WithLabelValues(topicFullName, v.Reason).Inc()
+		}
+		l.WithError(err).Debug("rejecting invalid event")
+		return err
+	}
+
+	// the id is reserved before producing, so copies of the event sent while it's
+	// produced are duplicates too, and released if it isn't produced
+	if k.deduplicator != nil {
+		reserved, reserveErr := k.deduplicator.Reserve(ctx, event.GetId())
+		if reserveErr != nil {
+			l.WithError(reserveErr).Warn("failed to check if event is duplicated, producing it anyway")
+		} else if !reserved {
+			l.Debug("skipping duplicated event")
+			metrics.DuplicatedEventsCounter.WithLabelValues(topicFullName).Inc()
+			return nil
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if releaseErr := k.deduplicator.Release(ctx, event.GetId()); releaseErr != nil {
+				l.WithError(releaseErr).Warn("failed to release event id, retries will be skipped as duplicated")
+			}
+		}()
+	}
 
 	l.Debugf("serializing event")
-	if err := a.Serialize(&buf); err != nil {
-		l.Warnf("error serializing event")
+	var message []byte
+	message, err = k.serializers.forTopic(topic).Serialize(&pb.Event{
+		Id:        event.GetId(),
+		Name:      event.GetName(),
+		Topic:     topic,
+		Props:     props,
+		Timestamp: event.GetTimestamp(),
+	}, time.Now().UnixNano()/1000000)
+	if err != nil {
+		l.WithError(err).Warn("error serializing event")
 		return err
 	}
 
-	topic := event.GetTopic()
-	partition, offset, err := k.producer.Produce(ctx, topic, buf.Bytes())
+	var done func(time.Duration)
+	if k.admission != nil {
+		done = k.admission.Start()
+	}
+	err = k.produce(ctx, l, k.router.Route(event, props), topic, key, map[string]string{
+		forwarder.HeaderEventID:              event.GetId(),
+		forwarder.HeaderEventName:            event.GetName(),
+		forwarder.HeaderEventClientTimestamp: strconv.FormatInt(event.GetTimestamp(), 10),
+	}, message)
+	if done != nil {
+		done(time.Since(startTime))
+	}
 
-	topicFullName := fmt.Sprintf("%s%s", k.config.GetString("kafka.producer.topicPrefix"), topic)
 	kafkaStatus := "ok"
 	if err != nil {
 		kafkaStatus = "error"
-		l.WithError(err).Error("error producing event to kafka")
 		metrics.KafkaRequestLatency.WithLabelValues(kafkaStatus, topicFullName).Observe(float64(time.Since(startTime).Milliseconds()))
 		return err
 	}
 	metrics.KafkaRequestLatency.WithLabelValues(kafkaStatus, topicFullName).Observe(float64(time.Since(startTime).Milliseconds()))
-	l.WithFields(map[string]interface{}{
-		"partition": partition,
-		"offset":    offset,
-	}).Debug("event sent to kafka")
 
 	return nil
 }
+
+// produce sends message to the sinks concurrently and returns the error of the first
+// required sink that failed, in the order of sinks
+func (k *KafkaSender) produce(
+	ctx context.Context,
+	l logger.Logger,
+	sinks []string,
+	topic, key string,
+	headers map[string]string,
+	message []byte,
+) error {
+	errs := make([]error, len(sinks))
+	produceTo := func(i int) {
+		name := sinks[i]
+		partition, offset, err := k.router.Sink(name).Forwarder.Produce(ctx, topic, key, headers, message)
+		sl := l.WithField("sink", name)
+		sinkStatus := "ok"
+		if err != nil {
+			sinkStatus = "error"
+			sl.WithError(err).Error("error producing event to sink")
+		} else {
+			sl.WithFields(map[string]interface{}{
+				"partition": partition,
+				"offset":    offset,
+			}).Debug("event sent to sink")
+		}
+		metrics.SinkEventsCounter.WithLabelValues(name, topic, sinkStatus).Inc()
+		errs[i] = err
+	}
+
+	if len(sinks) == 1 {
+		produceTo(0)
+	} else {
+		wg := sync.WaitGroup{}
+		wg.Add(len(sinks))
+		for i := range sinks {
+			go func(i int) {
+				defer wg.Done()
+				produceTo(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	for i, err := range errs {
+		if err != nil && k.router.Sink(sinks[i]).Required {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageKey returns the message key of an event, either set by the client on KeyProp
+// or taken from the prop configured for its topic, and its props without KeyProp
+func (k *KafkaSender) messageKey(topic string, props map[string]string) (string, map[string]string) {
+	if key, ok := props[KeyProp]; ok {
+		stripped := make(map[string]string, len(props)-1)
+		for name, value := range props {
+			if name != KeyProp {
+				stripped[name] = value
+			}
+		}
+		return key, stripped
+	}
+	prop, ok := k.topicKeyProps[strings.ToLower(topic)]
+	if !ok {
+		prop = k.keyProp
+	}
+	if prop == "" {
+		return "", props
+	}
+	return props[prop], props
+}
@@ -0,0 +1,125 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+// DefaultSink is the name of the sink of the forwarder the KafkaSender is created with
+const DefaultSink = "default"
+
+// Sink is a forwarder events can be routed to
+type Sink struct {
+	Forwarder forwarder.Forwarder
+	// Required sinks fail the event when they fail to produce it, failures of the
+	// other sinks are only logged and counted
+	Required bool
+}
+
+// SinkConfig is a sink in routing.sinks, Config overrides the server config for its
+// forwarder, e.g. kafka.producer.brokers to produce to another cluster
+type SinkConfig struct {
+	Name     string
+	Type     string
+	Required bool
+	Config   map[string]interface{}
+}
+
+// PropMatch matches events whose prop Name has one of Values
+type PropMatch struct {
+	Name   string
+	Values []string
+}
+
+// RouteRule sends the events matching all of its set fields to Sinks, Topic is
+// compared ignoring case like the other per-topic settings
+type RouteRule struct {
+	Topic string
+	Name  string
+	Props []PropMatch
+	Sinks []string
+}
+
+func (r RouteRule) matches(event *pb.Event, props map[string]string) bool {
+	if r.Topic != "" && !strings.EqualFold(r.Topic, event.GetTopic()) {
+		return false
+	}
+	if r.Name != "" && r.Name != event.GetName() {
+		return false
+	}
+	for _, prop := range r.Props {
+		value, ok := props[prop.Name]
+		if !ok || !contains(prop.Values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Router picks the sinks of each event: the default sinks plus the sinks of every
+// rule the event matches
+type Router struct {
+	sinks        map[string]Sink
+	defaultSinks []string
+	rules        []RouteRule
+}
+
+// NewRouter returns a Router, failing if defaultSinks or rules refer to unknown sinks
+func NewRouter(sinks map[string]Sink, defaultSinks []string, rules []RouteRule) (*Router, error) {
+	for _, name := range defaultSinks {
+		if _, ok := sinks[name]; !ok {
+			return nil, fmt.Errorf("unknown default sink %s", name)
+		}
+	}
+	for _, rule := range rules {
+		if len(rule.Sinks) == 0 {
+			return nil, fmt.Errorf("routing rule without sinks")
+		}
+		for _, name := range rule.Sinks {
+			if _, ok := sinks[name]; !ok {
+				return nil, fmt.Errorf("unknown sink %s in routing rule", name)
+			}
+		}
+	}
+	return &Router{sinks: sinks, defaultSinks: defaultSinks, rules: rules}, nil
+}
+
+// Route returns the names of the sinks of event, without repetitions
+func (r *Router) Route(event *pb.Event, props map[string]string) []string {
+	names := append([]string{}, r.defaultSinks...)
+	for _, rule := range r.rules {
+		if !rule.matches(event, props) {
+			continue
+		}
+		for _, name := range rule.Sinks {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Sink returns the sink called name
+func (r *Router) Sink(name string) Sink {
+	return r.sinks[name]
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
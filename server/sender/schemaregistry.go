@@ -0,0 +1,105 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+)
+
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// SchemaRegistry resolves the id of the avro Event schema on a Confluent compatible
+// Schema Registry, caching it by subject so it's only requested once per topic
+type SchemaRegistry struct {
+	url          string
+	client       *http.Client
+	autoRegister bool
+	schema       string
+	mu           sync.RWMutex
+	ids          map[string]int32
+}
+
+// NewSchemaRegistry ctor, autoRegister registers the schema on subjects that don't have
+// it yet instead of failing the lookup
+func NewSchemaRegistry(registryURL string, timeout time.Duration, autoRegister bool) *SchemaRegistry {
+	return &SchemaRegistry{
+		url:          strings.TrimSuffix(registryURL, "/"),
+		client:       &http.Client{Timeout: timeout},
+		autoRegister: autoRegister,
+		schema:       avro.NewEvent().Schema(),
+		ids:          map[string]int32{},
+	}
+}
+
+// SchemaID returns the id of the Event schema on subject
+func (r *SchemaRegistry) SchemaID(subject string) (int32, error) {
+	r.mu.RLock()
+	id, ok := r.ids[subject]
+	r.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	// registering a schema already registered returns its id, looking it up
+	// fails if it's not registered
+	path := fmt.Sprintf("/subjects/%s", url.PathEscape(subject))
+	if r.autoRegister {
+		path += "/versions"
+	}
+	body, err := json.Marshal(map[string]string{"schema": r.schema})
+	if err != nil {
+		return 0, err
+	}
+	res := struct {
+		ID int32 `json:"id"`
+	}{}
+	if err := r.do(http.MethodPost, path, bytes.NewReader(body), &res); err != nil {
+		return 0, fmt.Errorf("failed to get schema id of subject %s: %w", subject, err)
+	}
+
+	r.mu.Lock()
+	r.ids[subject] = res.ID
+	r.mu.Unlock()
+	return res.ID, nil
+}
+
+// Ping checks if the registry is reachable
+func (r *SchemaRegistry) Ping() error {
+	return r.do(http.MethodGet, "/subjects", nil, &[]string{})
+}
+
+func (r *SchemaRegistry) do(method, path string, body io.Reader, res interface{}) error {
+	req, err := http.NewRequest(method, r.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", schemaRegistryContentType)
+	}
+	httpRes, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(httpRes.Body, 1024))
+		return fmt.Errorf("schema registry returned %d: %s", httpRes.StatusCode, message)
+	}
+	return json.NewDecoder(httpRes.Body).Decode(res)
+}
@@ -14,6 +14,8 @@ import (
 )
 
 type Sender interface {
-	SendEvents(context.Context, []*pb.Event) []int64
+	// SendEvents returns the indexes of the events that failed and may be produced if
+	// retried, and of the events rejected for good
+	SendEvents(context.Context, []*pb.Event) (failureIndexes, rejectedIndexes []int64)
 	SendEvent(context.Context, *pb.Event) error
 }
@@ -0,0 +1,87 @@
+//go:build unit
+// +build unit
+
+package sender_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/eventsgateway/v4/server/logger"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"github.com/topfreegames/eventsgateway/v4/server/mocks"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSender(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sender suite")
+}
+
+var (
+	log           logger.Logger
+	mockCtrl      *gomock.Controller
+	mockForwarder *mocks.MockForwarder
+)
+
+var _ = BeforeEach(func() {
+	log = &logger.NullLogger{}
+	metrics.StartServer(initConfig())
+	mockCtrl = gomock.NewController(GinkgoT())
+	mockForwarder = mocks.NewMockForwarder(mockCtrl)
+})
+
+// initConfig returns the configuration at ../config/test.yaml
+func initConfig() *viper.Viper {
+	cfg := viper.New()
+	cfg.SetConfigFile("../config/test.yaml")
+	cfg.SetConfigType("yaml")
+	cfg.SetEnvPrefix("eventsgateway")
+	cfg.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	cfg.AutomaticEnv()
+	Expect(cfg.ReadInConfig()).To(Succeed())
+	cfg.Set("prometheus.enabled", "false")
+	return cfg
+}
+
+// newKafkaSender returns a KafkaSender producing to mockForwarder
+func newKafkaSender(cfg *viper.Viper) *sender.KafkaSender {
+	kafkaSender, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+	Expect(err).NotTo(HaveOccurred())
+	return kafkaSender
+}
+
+// newEvent returns an event sent now
+func newEvent(id, topic, name string, props map[string]string) *pb.Event {
+	return &pb.Event{
+		Id:        id,
+		Name:      name,
+		Topic:     topic,
+		Props:     props,
+		Timestamp: time.Now().UnixNano() / 1000000,
+	}
+}
+
+// methodStream tells grpc.Method which method a context belongs to
+type methodStream struct {
+	method string
+}
+
+func (m *methodStream) Method() string               { return m.method }
+func (m *methodStream) SetHeader(metadata.MD) error  { return nil }
+func (m *methodStream) SendHeader(metadata.MD) error { return nil }
+func (m *methodStream) SetTrailer(metadata.MD) error { return nil }
+
+// methodContext returns the context of a call to the grpc method
+func methodContext(method string) context.Context {
+	return grpc.NewContextWithServerTransportStream(context.Background(), &methodStream{method: method})
+}
@@ -0,0 +1,221 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/server/logger"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+// Serialization formats accepted in kafka.producer.serializer
+const (
+	SerializerAvro          = "avro"
+	SerializerJSON          = "json"
+	SerializerProtobuf      = "protobuf"
+	SerializerConfluentAvro = "confluent-avro"
+)
+
+// Serializer encodes events into the messages produced to kafka
+type Serializer interface {
+	// Serialize encodes event, received by the server at serverTimestamp in milliseconds
+	Serialize(event *pb.Event, serverTimestamp int64) ([]byte, error)
+}
+
+// AvroSerializer encodes events with the avro Event schema, without any prefix
+type AvroSerializer struct{}
+
+// Serialize encodes event as an avro Event
+func (AvroSerializer) Serialize(event *pb.Event, serverTimestamp int64) ([]byte, error) {
+	a := avro.NewEvent()
+	a.Id = event.GetId()
+	a.Name = event.GetName()
+	a.Props = event.GetProps()
+	a.ServerTimestamp = serverTimestamp
+	a.ClientTimestamp = event.GetTimestamp()
+
+	var buf bytes.Buffer
+	if err := a.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ConfluentAvroSerializer encodes events with the avro Event schema prefixed with the
+// Schema Registry wire format: a zero magic byte and the 4 bytes big endian schema id.
+// The schema id is taken from Registry, by the subject of the topic, if it's set.
+type ConfluentAvroSerializer struct {
+	SchemaID    int32
+	Registry    *SchemaRegistry
+	TopicPrefix string
+}
+
+// Serialize encodes event as an avro Event prefixed with the schema id
+func (c ConfluentAvroSerializer) Serialize(event *pb.Event, serverTimestamp int64) ([]byte, error) {
+	schemaID := c.SchemaID
+	if c.Registry != nil {
+		var err error
+		schemaID, err = c.Registry.SchemaID(c.subject(event.GetTopic()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	body, err := AvroSerializer{}.Serialize(event, serverTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(message[1:], uint32(schemaID))
+	return append(message, body...), nil
+}
+
+// subject follows the registry default TopicNameStrategy
+func (c ConfluentAvroSerializer) subject(topic string) string {
+	return fmt.Sprintf("%s%s-value", c.TopicPrefix, topic)
+}
+
+// JSONEvent is the JSON encoding of an event, with the same fields as the avro Event
+type JSONEvent struct {
+	Id              string            `json:"id"`
+	Name            string            `json:"name"`
+	Props           map[string]string `json:"props"`
+	ServerTimestamp int64             `json:"serverTimestamp"`
+	ClientTimestamp int64             `json:"clientTimestamp"`
+}
+
+// JSONSerializer encodes events as JSONEvent
+type JSONSerializer struct{}
+
+// Serialize encodes event as a JSONEvent
+func (JSONSerializer) Serialize(event *pb.Event, serverTimestamp int64) ([]byte, error) {
+	props := event.GetProps()
+	if props == nil {
+		props = map[string]string{}
+	}
+	return json.Marshal(JSONEvent{
+		Id:              event.GetId(),
+		Name:            event.GetName(),
+		Props:           props,
+		ServerTimestamp: serverTimestamp,
+		ClientTimestamp: event.GetTimestamp(),
+	})
+}
+
+// ProtobufSerializer encodes the pb.Event sent by the client, which doesn't have the
+// server timestamp
+type ProtobufSerializer struct{}
+
+// Serialize encodes event as a pb.Event
+func (ProtobufSerializer) Serialize(event *pb.Event, serverTimestamp int64) ([]byte, error) {
+	return proto.Marshal(event)
+}
+
+// NewSerializer returns the serializer called name, registry is used by confluent-avro
+// serializers and can be nil
+func NewSerializer(name string, config *viper.Viper, registry *SchemaRegistry) (Serializer, error) {
+	switch name {
+	case SerializerAvro:
+		return AvroSerializer{}, nil
+	case SerializerJSON:
+		return JSONSerializer{}, nil
+	case SerializerProtobuf:
+		return ProtobufSerializer{}, nil
+	case SerializerConfluentAvro:
+		return ConfluentAvroSerializer{
+			SchemaID:    config.GetInt32("kafka.producer.serializer.confluentAvro.schemaId"),
+			Registry:    registry,
+			TopicPrefix: config.GetString("kafka.producer.topicPrefix"),
+		}, nil
+	default:
+		return nil, fmt.Errorf(
+			"invalid serializer %q, should be %s, %s, %s or %s",
+			name, SerializerAvro, SerializerJSON, SerializerProtobuf, SerializerConfluentAvro,
+		)
+	}
+}
+
+// serializers picks the serializer of each topic
+type serializers struct {
+	defaultSerializer Serializer
+	topics            map[string]Serializer
+}
+
+func newSerializers(config *viper.Viper, logger logger.Logger) (*serializers, error) {
+	config.SetDefault("kafka.producer.serializer.default", SerializerAvro)
+	config.SetDefault("kafka.producer.serializer.schemaRegistry.url", "")
+	config.SetDefault("kafka.producer.serializer.schemaRegistry.timeout", "1s")
+	config.SetDefault("kafka.producer.serializer.schemaRegistry.autoRegister", true)
+	config.SetDefault("kafka.producer.serializer.schemaRegistry.failOnStartup", true)
+
+	var registry *SchemaRegistry
+	if registryURL := config.GetString("kafka.producer.serializer.schemaRegistry.url"); registryURL != "" {
+		registry = NewSchemaRegistry(
+			registryURL,
+			config.GetDuration("kafka.producer.serializer.schemaRegistry.timeout"),
+			config.GetBool("kafka.producer.serializer.schemaRegistry.autoRegister"),
+		)
+	}
+
+	defaultSerializer, err := NewSerializer(config.GetString("kafka.producer.serializer.default"), config, registry)
+	if err != nil {
+		return nil, err
+	}
+	s := &serializers{
+		defaultSerializer: defaultSerializer,
+		topics:            map[string]Serializer{},
+	}
+	// viper lower cases map keys, so topics are looked up in lower case
+	for topic, name := range config.GetStringMapString("kafka.producer.serializer.topics") {
+		serializer, err := NewSerializer(name, config, registry)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic, err)
+		}
+		s.topics[topic] = serializer
+	}
+
+	if registry != nil {
+		if err := s.warmUp(registry); err != nil {
+			if config.GetBool("kafka.producer.serializer.schemaRegistry.failOnStartup") {
+				return nil, err
+			}
+			logger.WithError(err).Warn("schema registry is unavailable, schema ids will be requested when events arrive")
+		}
+	}
+	return s, nil
+}
+
+// warmUp checks the registry is reachable and caches the schema ids of the topics
+// configured to use confluent-avro
+func (s *serializers) warmUp(registry *SchemaRegistry) error {
+	if err := registry.Ping(); err != nil {
+		return fmt.Errorf("schema registry is unreachable: %w", err)
+	}
+	for topic, serializer := range s.topics {
+		if c, ok := serializer.(ConfluentAvroSerializer); ok {
+			if _, err := registry.SchemaID(c.subject(topic)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *serializers) forTopic(topic string) Serializer {
+	if serializer, ok := s.topics[strings.ToLower(topic)]; ok {
+		return serializer
+	}
+	return s.defaultSerializer
+}
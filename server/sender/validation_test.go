@@ -0,0 +1,177 @@
+//go:build unit
+// +build unit
+
+package sender_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/topfreegames/eventsgateway/v4/server/forwarder"
+	"github.com/topfreegames/eventsgateway/v4/server/metrics"
+	"github.com/topfreegames/eventsgateway/v4/server/sender"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Validation", func() {
+	var k *sender.KafkaSender
+
+	BeforeEach(func() {
+		cfg := initConfig()
+		cfg.Set("validation.rules", []map[string]interface{}{
+			{
+				"topic":          "purchases",
+				"required":       []string{"userId", "amount"},
+				"allowed":        []string{"currency", "store"},
+				"maxValueLength": 16,
+				"props": []map[string]interface{}{
+					{"name": "userId", "regex": "^u-[0-9]+$"},
+					{"name": "amount", "numeric": true, "min": 0},
+					{"name": "store", "enum": []string{"apple", "google"}},
+				},
+			},
+			{
+				"topic":    "purchases",
+				"name":     "refund",
+				"required": []string{"reason"},
+				"allowed":  []string{"reason"},
+			},
+			{
+				"topic":    "small",
+				"maxProps": 1,
+			},
+		})
+		k = newKafkaSender(cfg)
+	})
+
+	It("should produce valid events", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any())
+		Expect(k.SendEvent(context.Background(), newEvent("someid", "purchases", "purchase", map[string]string{
+			"userId": "u-1",
+			"amount": "9.99",
+			"store":  "apple",
+		}))).To(Succeed())
+	})
+
+	It("should ignore the types of typed props", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("small"), gomock.Any(), gomock.Any(), gomock.Any())
+		Expect(k.SendEvent(context.Background(), newEvent("someid", "small", "any", map[string]string{
+			"level":          "3",
+			sender.TypesProp: `{"level":"int"}`,
+		}))).To(Succeed())
+	})
+
+	It("should not validate topics without rules", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("other"), gomock.Any(), gomock.Any(), gomock.Any())
+		Expect(k.SendEvent(context.Background(), newEvent("someid", "other", "purchase", map[string]string{
+			"any": "prop",
+		}))).To(Succeed())
+	})
+
+	It("should reject invalid events with every violation", func() {
+		err := k.SendEvent(context.Background(), newEvent("someid", "purchases", "purchase", map[string]string{
+			"userId":  "someone",
+			"amount":  "-1",
+			"store":   "steam",
+			"comment": "a comment longer than allowed",
+		}))
+		st := status.Convert(err)
+		Expect(st.Code()).To(Equal(codes.InvalidArgument))
+		Expect(st.Message()).To(ContainSubstring("userId doesn't match ^u-[0-9]+$"))
+
+		Expect(st.Details()).To(HaveLen(1))
+		fields := []string{}
+		for _, v := range st.Details()[0].(*errdetails.BadRequest).FieldViolations {
+			fields = append(fields, v.Field)
+		}
+		Expect(fields).To(ConsistOf(
+			"props.comment", "props.comment", "props.userId", "props.amount", "props.store",
+		))
+
+		rejected := metrics.RejectedEventsCounter
+		Expect(testutil.ToFloat64(rejected.WithLabelValues("purchases", sender.ViolationNotAllowed))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(rejected.WithLabelValues("purchases", sender.ViolationMaxLength))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(rejected.WithLabelValues("purchases", sender.ViolationRegex))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(rejected.WithLabelValues("purchases", sender.ViolationRange))).To(Equal(float64(1)))
+		Expect(testutil.ToFloat64(rejected.WithLabelValues("purchases", sender.ViolationEnum))).To(Equal(float64(1)))
+	})
+
+	It("should reject numbers that aren't finite", func() {
+		for _, amount := range []string{"NaN", "Inf", "-inf", "+Infinity"} {
+			err := k.SendEvent(context.Background(), newEvent("someid", "purchases", "purchase", map[string]string{
+				"userId": "u-1",
+				"amount": amount,
+			}))
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring("amount should be a number"))
+		}
+	})
+
+	It("should apply the rules of the event name", func() {
+		err := k.SendEvent(context.Background(), newEvent("someid", "purchases", "refund", map[string]string{
+			"userId": "u-1",
+			"amount": "9.99",
+		}))
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(err.Error()).To(ContainSubstring("reason is required"))
+	})
+
+	It("should reject events with too many props", func() {
+		err := k.SendEvent(context.Background(), newEvent("someid", "small", "any", map[string]string{"a": "1", "b": "2"}))
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(err.Error()).To(ContainSubstring("got 2 props, max is 1"))
+	})
+
+	It("should report invalid events of a batch as rejected, not as failures to retry", func() {
+		mockForwarder.EXPECT().Produce(gomock.Eq("purchases"), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(topic, key string, headers map[string]string, message []byte) (int32, int64, error) {
+				if headers[forwarder.HeaderEventID] == "failing" {
+					return 0, 0, errors.New("kafka is down")
+				}
+				return 0, 0, nil
+			}).Times(2)
+		failed, rejected := k.SendEvents(context.Background(), []*pb.Event{
+			newEvent("failing", "purchases", "purchase", map[string]string{"userId": "u-1", "amount": "1"}),
+			newEvent("someid", "purchases", "purchase", map[string]string{"userId": "u-1"}),
+			newEvent("someid", "purchases", "purchase", map[string]string{}),
+			newEvent("otherid", "purchases", "purchase", map[string]string{"userId": "u-1", "amount": "2"}),
+		})
+		Expect(failed).To(Equal([]int64{0}))
+		Expect(rejected).To(Equal([]int64{1, 2}))
+	})
+
+	It("should load rules from the schema directory", func() {
+		directory := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(directory, "logins.yaml"), []byte(`
+rules:
+  - topic: logins
+    required: [userId]
+`), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(directory, "README.md"), []byte("ignored"), 0o644)).To(Succeed())
+		cfg := initConfig()
+		cfg.Set("validation.directory", directory)
+		k = newKafkaSender(cfg)
+
+		err := k.SendEvent(context.Background(), newEvent("someid", "logins", "login", map[string]string{}))
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(err.Error()).To(ContainSubstring("userId is required"))
+	})
+
+	It("should fail to start with malformed rules", func() {
+		cfg := initConfig()
+		cfg.Set("validation.rules", []map[string]interface{}{
+			{"topic": "purchases", "props": []map[string]interface{}{{"name": "userId", "regex": "("}}},
+		})
+		_, err := sender.NewKafkaSender(mockForwarder, log, cfg)
+		Expect(err).To(MatchError(ContainSubstring("topic purchases prop userId")))
+	})
+})
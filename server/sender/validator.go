@@ -0,0 +1,276 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package sender
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons of the violations reported by Validator
+const (
+	ViolationRequired   = "required"
+	ViolationNotAllowed = "not_allowed"
+	ViolationMaxProps   = "max_props"
+	ViolationMaxLength  = "max_length"
+	ViolationRegex      = "regex"
+	ViolationEnum       = "enum"
+	ViolationNumeric    = "numeric"
+	ViolationRange      = "range"
+)
+
+// ValidationRule constrains the props of the events sent to Topic, or only of the
+// ones called Name if it's set
+type ValidationRule struct {
+	Topic    string
+	Name     string
+	Required []string
+	// Allowed lists the only props accepted besides the required ones, any prop is accepted if it's empty
+	Allowed        []string
+	MaxProps       int
+	MaxValueLength int
+	Props          []PropRule
+}
+
+// PropRule constrains the value of the prop Name
+type PropRule struct {
+	Name    string
+	Regex   string
+	Enum    []string
+	Numeric bool
+	// Min and Max bound numeric values, they're ignored if nil
+	Min *float64
+	Max *float64
+}
+
+// Violation is a prop of an event that doesn't follow a ValidationRule
+type Violation struct {
+	Prop        string
+	Reason      string
+	Description string
+}
+
+// ValidationError is returned for events with violations
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	descriptions := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		descriptions[i] = v.Description
+	}
+	return fmt.Sprintf("invalid props: %s", strings.Join(descriptions, "; "))
+}
+
+// GRPCStatus returns an InvalidArgument status with a BadRequest detail per violation
+func (e *ValidationError) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, e.Error())
+	badRequest := &errdetails.BadRequest{}
+	for _, v := range e.Violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       fmt.Sprintf("props.%s", v.Prop),
+			Description: v.Description,
+		})
+	}
+	if withDetails, err := st.WithDetails(badRequest); err == nil {
+		return withDetails
+	}
+	return st
+}
+
+type compiledRule struct {
+	ValidationRule
+	allowed map[string]bool
+	props   []compiledPropRule
+}
+
+type compiledPropRule struct {
+	PropRule
+	regex *regexp.Regexp
+	enum  map[string]bool
+}
+
+// Validator checks the props of events against the ValidationRules of their topics
+type Validator struct {
+	// rules by lower cased topic
+	rules map[string][]*compiledRule
+}
+
+// NewValidator returns a Validator of rules, failing if any of them is malformed
+func NewValidator(rules []ValidationRule) (*Validator, error) {
+	v := &Validator{rules: map[string][]*compiledRule{}}
+	for _, rule := range rules {
+		if rule.Topic == "" {
+			return nil, fmt.Errorf("validation rule without topic")
+		}
+		c := &compiledRule{ValidationRule: rule}
+		if len(rule.Allowed) > 0 {
+			c.allowed = toSet(rule.Allowed)
+			for _, name := range rule.Required {
+				c.allowed[name] = true
+			}
+		}
+		for _, prop := range rule.Props {
+			p := compiledPropRule{PropRule: prop}
+			if prop.Regex != "" {
+				regex, err := regexp.Compile(prop.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("topic %s prop %s: %w", rule.Topic, prop.Name, err)
+				}
+				p.regex = regex
+			}
+			if len(prop.Enum) > 0 {
+				p.enum = toSet(prop.Enum)
+			}
+			c.props = append(c.props, p)
+		}
+		topic := strings.ToLower(rule.Topic)
+		v.rules[topic] = append(v.rules[topic], c)
+	}
+	return v, nil
+}
+
+// LoadValidationRules reads the rules in validation.rules and in the yaml or json files
+// of validation.directory, each with a list of rules under the rules key
+func LoadValidationRules(config *viper.Viper) ([]ValidationRule, error) {
+	var rules []ValidationRule
+	if err := config.UnmarshalKey("validation.rules", &rules); err != nil {
+		return nil, err
+	}
+	directory := config.GetString("validation.directory")
+	if directory == "" {
+		return rules, nil
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		file := viper.New()
+		file.SetConfigFile(filepath.Join(directory, entry.Name()))
+		if err := file.ReadInConfig(); err != nil {
+			return nil, err
+		}
+		var fileRules []ValidationRule
+		if err := file.UnmarshalKey("rules", &fileRules); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	return rules, nil
+}
+
+// Validate returns a *ValidationError if the props of event violate any rule of its topic
+func (v *Validator) Validate(event *pb.Event, props map[string]string) error {
+	var violations []Violation
+	for _, rule := range v.rules[strings.ToLower(event.GetTopic())] {
+		if rule.Name == "" || rule.Name == event.GetName() {
+			violations = append(violations, rule.validate(props)...)
+		}
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func (r *compiledRule) validate(props map[string]string) []Violation {
+	var violations []Violation
+	violate := func(prop, reason, format string, args ...interface{}) {
+		violations = append(violations, Violation{
+			Prop:        prop,
+			Reason:      reason,
+			Description: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if _, ok := props[TypesProp]; ok {
+		// the types of the props aren't a prop themselves
+		typedProps := make(map[string]string, len(props)-1)
+		for name, value := range props {
+			if name != TypesProp {
+				typedProps[name] = value
+			}
+		}
+		props = typedProps
+	}
+
+	for _, name := range r.Required {
+		if _, ok := props[name]; !ok {
+			violate(name, ViolationRequired, "%s is required", name)
+		}
+	}
+	if r.MaxProps > 0 && len(props) > r.MaxProps {
+		violate("", ViolationMaxProps, "got %d props, max is %d", len(props), r.MaxProps)
+	}
+
+	// sorted so the violations are reported in a stable order
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if r.allowed != nil && !r.allowed[name] {
+			violate(name, ViolationNotAllowed, "%s is not allowed", name)
+		}
+		if r.MaxValueLength > 0 && len(props[name]) > r.MaxValueLength {
+			violate(name, ViolationMaxLength, "%s has %d characters, max is %d", name, len(props[name]), r.MaxValueLength)
+		}
+	}
+
+	for _, prop := range r.props {
+		value, ok := props[prop.Name]
+		if !ok {
+			continue
+		}
+		if prop.regex != nil && !prop.regex.MatchString(value) {
+			violate(prop.Name, ViolationRegex, "%s doesn't match %s", prop.Name, prop.Regex)
+		}
+		if prop.enum != nil && !prop.enum[value] {
+			violate(prop.Name, ViolationEnum, "%s should be one of %s", prop.Name, strings.Join(prop.Enum, ", "))
+		}
+		if prop.Numeric || prop.Min != nil || prop.Max != nil {
+			number, err := strconv.ParseFloat(value, 64)
+			// ParseFloat also takes NaN and Inf, which aren't in any range
+			if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+				violate(prop.Name, ViolationNumeric, "%s should be a number", prop.Name)
+				continue
+			}
+			if (prop.Min != nil && number < *prop.Min) || (prop.Max != nil && number > *prop.Max) {
+				violate(prop.Name, ViolationRange, "%s is out of range", prop.Name)
+			}
+		}
+	}
+	return violations
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
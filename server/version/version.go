@@ -0,0 +1,12 @@
+// eventsgateway
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package version
+
+// Version of the server, set at build time with
+// -ldflags "-X github.com/topfreegames/eventsgateway/v4/server/version.Version=<version>"
+var Version = "dev"
@@ -0,0 +1,322 @@
+// MIT License
+//
+// Copyright (c) 2019 Top Free Games
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/client"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+// ReplayOptions selects the events replayed and how they're sent
+type ReplayOptions struct {
+	// File is a JSONL file of pb.Events, or of dead letters with the event on the event field
+	File string
+	// KafkaTopic is the full name of the topic to read avro events from, used if File is empty
+	KafkaTopic string
+	// Topic and Name filter the events replayed, if set
+	Topic string
+	Name  string
+	// From and To filter the events by client timestamp, if set
+	From time.Time
+	To   time.Time
+	// Rate is the max events sent per second, unlimited if zero
+	Rate float64
+	// DryRun prints the events instead of sending them
+	DryRun bool
+}
+
+// Replay re-sends events previously produced to kafka or written to a JSONL file
+type Replay struct {
+	log     logger.Logger
+	config  *viper.Viper
+	opts    ReplayOptions
+	client  *client.Client
+	out     io.Writer
+	matched int
+	failed  int
+	// idleTimeout is how long a partition is read without messages before it's
+	// considered over, its last offsets might never be delivered
+	idleTimeout time.Duration
+}
+
+// NewReplay ctor
+func NewReplay(log logger.Logger, config *viper.Viper, opts ReplayOptions) (*Replay, error) {
+	if opts.File == "" && opts.KafkaTopic == "" {
+		return nil, fmt.Errorf("either a file or a kafka topic to replay should be informed")
+	}
+	r := &Replay{
+		log:    log,
+		config: config,
+		opts:   opts,
+		out:    os.Stdout,
+	}
+	r.config.SetDefault("replay.kafka.brokers", r.config.GetString("kafka.producer.brokers"))
+	r.config.SetDefault("replay.kafka.topicPrefix", r.config.GetString("kafka.producer.topicPrefix"))
+	r.config.SetDefault("replay.kafka.idleTimeout", 10*time.Second)
+	r.idleTimeout = r.config.GetDuration("replay.kafka.idleTimeout")
+	if r.idleTimeout <= 0 {
+		return nil, fmt.Errorf("replay.kafka.idleTimeout should be positive")
+	}
+	if opts.DryRun {
+		return r, nil
+	}
+	c, err := client.New("", r.config, r.log, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.client = c
+	return r, nil
+}
+
+// Run reads all the events of the source and sends the ones matching the filters
+func (r *Replay) Run() error {
+	var limiter <-chan time.Time
+	if r.opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / r.opts.Rate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	replay := func(event *pb.Event) error {
+		if !r.matches(event) {
+			return nil
+		}
+		r.matched++
+		if r.opts.DryRun {
+			return r.print(event)
+		}
+		if limiter != nil {
+			<-limiter
+		}
+		if err := r.client.Resend(context.Background(), event); err != nil {
+			r.failed++
+		}
+		return nil
+	}
+
+	var err error
+	if r.opts.File != "" {
+		err = r.readFile(replay)
+	} else {
+		err = r.readKafka(replay)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.client != nil {
+		report, err := r.client.Shutdown(context.Background())
+		if err != nil {
+			return err
+		}
+		// spooled events are only sent by a later run
+		r.failed += report.Rejected + report.Spooled + report.Abandoned
+	}
+	r.log.WithFields(map[string]interface{}{
+		"matched": r.matched,
+		"failed":  r.failed,
+		"dryRun":  r.opts.DryRun,
+	}).Info("replay finished")
+	return nil
+}
+
+func (r *Replay) matches(event *pb.Event) bool {
+	if r.opts.Topic != "" && event.GetTopic() != r.opts.Topic {
+		return false
+	}
+	if r.opts.Name != "" && event.GetName() != r.opts.Name {
+		return false
+	}
+	timestamp := time.Unix(0, event.GetTimestamp()*int64(time.Millisecond))
+	if !r.opts.From.IsZero() && timestamp.Before(r.opts.From) {
+		return false
+	}
+	if !r.opts.To.IsZero() && timestamp.After(r.opts.To) {
+		return false
+	}
+	return true
+}
+
+func (r *Replay) print(event *pb.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(r.out, string(line))
+	return err
+}
+
+func (r *Replay) readFile(replay func(*pb.Event) error) error {
+	file, err := os.Open(r.opts.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		event, err := decodeLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", r.opts.File, lineNumber, err)
+		}
+		if err := replay(event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// decodeLine decodes a pb.Event, or the event of a dead letter
+func decodeLine(line []byte) (*pb.Event, error) {
+	deadLetter := struct {
+		Event *pb.Event `json:"event"`
+	}{}
+	if err := json.Unmarshal(line, &deadLetter); err != nil {
+		return nil, err
+	}
+	if deadLetter.Event != nil {
+		return deadLetter.Event, nil
+	}
+	event := &pb.Event{}
+	if err := json.Unmarshal(line, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// readKafka reads the topic from the oldest offset up to the last message produced when
+// it started, the topic of the events is the kafka topic without the topic prefix.
+// Compacted topics and the ones with transactional control records might not deliver
+// the last offsets, so each partition is over once the high-water mark reaches the
+// offset of the last message and there are no messages for replay.kafka.idleTimeout.
+func (r *Replay) readKafka(replay func(*pb.Event) error) error {
+	kafkaConf := sarama.NewConfig()
+	kafkaConf.ClientID = "eventsgateway-replay"
+	kafkaConf.Version = sarama.V2_2_0_0
+	kafkaConf.Consumer.Return.Errors = true
+
+	brokers := strings.Split(r.config.GetString("replay.kafka.brokers"), ",")
+	kafkaClient, err := sarama.NewClient(brokers, kafkaConf)
+	if err != nil {
+		return err
+	}
+	defer kafkaClient.Close()
+	consumer, err := sarama.NewConsumerFromClient(kafkaClient)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	topic := strings.TrimPrefix(r.opts.KafkaTopic, r.config.GetString("replay.kafka.topicPrefix"))
+	partitions, err := consumer.Partitions(r.opts.KafkaTopic)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		newest, err := kafkaClient.GetOffset(r.opts.KafkaTopic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		oldest, err := kafkaClient.GetOffset(r.opts.KafkaTopic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		if oldest >= newest {
+			continue
+		}
+		if err := r.readPartition(consumer, partition, newest, topic, replay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replay) readPartition(
+	consumer sarama.Consumer,
+	partition int32,
+	newest int64,
+	topic string,
+	replay func(*pb.Event) error,
+) error {
+	partitionConsumer, err := consumer.ConsumePartition(r.opts.KafkaTopic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	defer partitionConsumer.Close()
+
+	idle := time.NewTimer(r.idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-idle.C:
+			if partitionConsumer.HighWaterMarkOffset() >= newest {
+				return nil
+			}
+			return fmt.Errorf(
+				"partition %d: no messages for %s before reaching offset %d",
+				partition, r.idleTimeout, newest-1,
+			)
+		case consumerErr := <-partitionConsumer.Errors():
+			return consumerErr
+		case msg := <-partitionConsumer.Messages():
+			a, err := avro.DeserializeEvent(bytes.NewReader(msg.Value))
+			if err != nil {
+				r.log.WithFields(map[string]interface{}{
+					"partition": partition,
+					"offset":    msg.Offset,
+				}).WithError(err).Warn("skipping message that isn't an avro event")
+			} else if err := replay(&pb.Event{
+				Id:        a.Id,
+				Name:      a.Name,
+				Topic:     topic,
+				Props:     a.Props,
+				Timestamp: a.ClientTimestamp,
+			}); err != nil {
+				return err
+			}
+			if msg.Offset >= newest-1 {
+				return nil
+			}
+			idle.Reset(r.idleTimeout)
+		}
+	}
+}
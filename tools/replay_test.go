@@ -0,0 +1,182 @@
+// eventsgateway
+//go:build unit
+// +build unit
+
+// https://github.com/topfreegames/eventsgateway
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2019 Top Free Games <backend@tfgco.com>
+
+package tools
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	avro "github.com/topfreegames/avro/go/eventsgateway/generated"
+	"github.com/topfreegames/eventsgateway/v4/logger"
+	pb "github.com/topfreegames/protos/eventsgateway/grpc/generated"
+)
+
+var _ = Describe("Replay", func() {
+	var config *viper.Viper
+
+	newReplay := func(opts ReplayOptions) *Replay {
+		opts.DryRun = true
+		r, err := NewReplay(&logger.NullLogger{}, config, opts)
+		Expect(err).NotTo(HaveOccurred())
+		return r
+	}
+
+	BeforeEach(func() {
+		config = viper.New()
+		config.Set("replay.kafka.idleTimeout", 50*time.Millisecond)
+	})
+
+	Describe("matches", func() {
+		event := &pb.Event{
+			Id:        "someid",
+			Name:      "someName",
+			Topic:     "sometopic",
+			Timestamp: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond),
+		}
+
+		DescribeTable("should filter events",
+			func(opts ReplayOptions, matches bool) {
+				opts.File = "events.jsonl"
+				Expect(newReplay(opts).matches(event)).To(Equal(matches))
+			},
+			Entry("without filters", ReplayOptions{}, true),
+			Entry("by topic", ReplayOptions{Topic: "sometopic"}, true),
+			Entry("by other topic", ReplayOptions{Topic: "othertopic"}, false),
+			Entry("by name", ReplayOptions{Name: "someName"}, true),
+			Entry("by other name", ReplayOptions{Name: "otherName"}, false),
+			Entry("from before", ReplayOptions{From: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, true),
+			Entry("from after", ReplayOptions{From: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)}, false),
+			Entry("to after", ReplayOptions{To: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)}, true),
+			Entry("to before", ReplayOptions{To: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, false),
+		)
+	})
+
+	Describe("decodeLine", func() {
+		It("should decode events", func() {
+			event, err := decodeLine([]byte(`{"id":"someid","name":"someName","topic":"sometopic","props":{"a":"b"},"timestamp":1}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(event.Id).To(Equal("someid"))
+			Expect(event.Topic).To(Equal("sometopic"))
+			Expect(event.Props).To(Equal(map[string]string{"a": "b"}))
+			Expect(event.Timestamp).To(Equal(int64(1)))
+		})
+
+		It("should decode the event of dead letters", func() {
+			event, err := decodeLine([]byte(`{"event":{"id":"someid","name":"someName","topic":"sometopic","timestamp":1},"reason":"invalid_props"}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(event.Id).To(Equal("someid"))
+			Expect(event.Name).To(Equal("someName"))
+		})
+
+		It("should fail on lines that aren't JSON", func() {
+			_, err := decodeLine([]byte(`not json`))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("dry run", func() {
+		It("should print the matching events of a file", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "events.jsonl")
+			Expect(os.WriteFile(file, []byte(strings.Join([]string{
+				`{"id":"a","name":"someName","topic":"sometopic","timestamp":1}`,
+				``,
+				`{"event":{"id":"b","name":"someName","topic":"sometopic","timestamp":1},"reason":"invalid_props"}`,
+				`{"id":"c","name":"someName","topic":"othertopic","timestamp":1}`,
+			}, "\n")), 0644)).To(Succeed())
+
+			r := newReplay(ReplayOptions{File: file, Topic: "sometopic"})
+			out := &bytes.Buffer{}
+			r.out = out
+			Expect(r.Run()).To(Succeed())
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			for i, id := range []string{"a", "b"} {
+				event, err := decodeLine([]byte(lines[i]))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(event.Id).To(Equal(id))
+				Expect(event.Topic).To(Equal("sometopic"))
+			}
+		})
+
+		It("should fail with the line of invalid events", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "events.jsonl")
+			Expect(os.WriteFile(file, []byte("{}\nnot json\n"), 0644)).To(Succeed())
+			err := newReplay(ReplayOptions{File: file}).Run()
+			Expect(err).To(MatchError(ContainSubstring("events.jsonl:2")))
+		})
+	})
+
+	Describe("readPartition", func() {
+		const kafkaTopic = "prefix-sometopic"
+
+		var (
+			consumer *mocks.Consumer
+			replayed []string
+		)
+
+		replay := func(event *pb.Event) error {
+			replayed = append(replayed, event.Id)
+			return nil
+		}
+
+		yield := func(partitionConsumer *mocks.PartitionConsumer, ids ...string) {
+			for _, id := range ids {
+				buffer := &bytes.Buffer{}
+				event := avro.NewEvent()
+				event.Id = id
+				event.Name = "someName"
+				Expect(event.Serialize(buffer)).To(Succeed())
+				partitionConsumer.YieldMessage(&sarama.ConsumerMessage{Value: buffer.Bytes()})
+			}
+		}
+
+		BeforeEach(func() {
+			consumer = mocks.NewConsumer(GinkgoT(), nil)
+			replayed = nil
+		})
+
+		AfterEach(func() {
+			Expect(consumer.Close()).To(Succeed())
+		})
+
+		It("should stop at the last message produced when it started", func() {
+			yield(consumer.ExpectConsumePartition(kafkaTopic, 0, sarama.OffsetOldest), "a", "b", "c")
+			r := newReplay(ReplayOptions{KafkaTopic: kafkaTopic})
+			Expect(r.readPartition(consumer, 0, 2, "sometopic", replay)).To(Succeed())
+			Expect(replayed).To(Equal([]string{"a", "b"}))
+		})
+
+		It("should stop once idle if the last offsets aren't delivered, such as on compacted topics", func() {
+			// the mock high-water mark is past the offset of the last message yielded
+			yield(consumer.ExpectConsumePartition(kafkaTopic, 0, sarama.OffsetOldest), "a", "b")
+			r := newReplay(ReplayOptions{KafkaTopic: kafkaTopic})
+			Expect(r.readPartition(consumer, 0, 3, "sometopic", replay)).To(Succeed())
+			Expect(replayed).To(Equal([]string{"a", "b"}))
+		})
+
+		It("should fail once idle if the high-water mark didn't reach the last message", func() {
+			yield(consumer.ExpectConsumePartition(kafkaTopic, 0, sarama.OffsetOldest), "a")
+			r := newReplay(ReplayOptions{KafkaTopic: kafkaTopic})
+			err := r.readPartition(consumer, 0, 10, "sometopic", replay)
+			Expect(err).To(MatchError(ContainSubstring("partition 0: no messages")))
+			Expect(replayed).To(Equal([]string{"a"}))
+		})
+	})
+})